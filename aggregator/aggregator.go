@@ -4,12 +4,14 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"log"
+	"net/http"
 	"os"
 	"os/signal"
 	"pacproxy/shared/config"
+	"pacproxy/shared/kafkautils"
 	"pacproxy/shared/mongoutils"
 	"pacproxy/shared/statistics"
+	"strconv"
 	"sync"
 	"time"
 
@@ -21,31 +23,54 @@ import (
 	"go.mongodb.org/mongo-driver/v2/mongo/writeconcern"
 )
 
-const (
-	//mongoUri string = "localhost"
-	dbWriteInterval time.Duration = 5 * time.Second
-	consumerGroupId string        = "aggregators"
-)
-
 type consumerHandler struct {
+	mu                  sync.Mutex // claims are consumed concurrently, one goroutine per partition
+	config              *config.Config
 	sessionGenerationId int32
 	mongoClient         *mongo.Client
-	statsByKeystem      map[string]*statistics.KeyStats
+	statsByKeystem      map[string]*statistics.KeyStats // stats received since the last write
+	bucketsByKey        map[bucketKey]*statistics.KeyStatsBucket
+	deletedKeystems     map[string]bool              // keystems whose stats must be reset on the next write
+	rangeDeletions      []*statistics.DeleteRequest  // time ranges whose stats must be deleted on the next write
+	appliedDeletions    []mongoutils.AppliedDeletion // delete jobs to mark applied, or failed, on the next write
+	pendingEvents       []*mongoutils.PackEvent      // raw pack events of the stats received since the last write
+	unarchivedEvents    []*mongoutils.PackEvent      // raw pack events of written stats that couldn't be archived yet
 	offsetByPartition   map[int32]int64
+	dedupeByPartition   map[int32]*dedupeWindow
 	consumerGroup       *sarama.ConsumerGroup
 	lastWrite           time.Time
 }
 
+// Batches of pack events kept while the event archive can't be written
+const maxPendingEventBatches int = 10
+
+// bucketKey identifies a time bucket of one keystem
+type bucketKey struct {
+	keystem     string
+	granularity string
+	start       int64 // unix seconds
+}
+
 func main() {
 
 	slog.SetLogLoggerLevel(slog.LevelDebug)
 	var handler consumerHandler
 	var err error
 
+	handler.config, err = config.Load(os.Args[1:])
+	if err != nil {
+		slog.Error(fmt.Errorf("invalid configuration: %s", err).Error())
+		os.Exit(2)
+	}
+	slog.Info("effective configuration:\n" + handler.config.Redacted())
+
 	// Attempt to connect to mongodb
 	handler.statsByKeystem = make(map[string]*statistics.KeyStats)
+	handler.bucketsByKey = make(map[bucketKey]*statistics.KeyStatsBucket)
+	handler.deletedKeystems = make(map[string]bool)
 	handler.offsetByPartition = make(map[int32]int64)
-	handler.mongoClient, err = mongoutils.InitMongoSession()
+	handler.dedupeByPartition = make(map[int32]*dedupeWindow)
+	handler.mongoClient, err = mongoutils.InitMongoSession(handler.config.Mongo)
 	if err != nil {
 		slog.Error(fmt.Errorf("couldn't initiate a mongodb connection: %s", err).Error())
 		return
@@ -55,12 +80,29 @@ func main() {
 			panic(err)
 		}
 	}()
+	err = mongoutils.RunMigrations(handler.mongoClient)
+	if err != nil {
+		slog.Error(fmt.Errorf("couldn't migrate the database: %s", err).Error())
+		return
+	}
+	if handler.config.Aggregator.EventRetention > 0 {
+		err = mongoutils.EnsureEventsCollection(context.Background(), handler.mongoClient, handler.config.Aggregator.EventRetention)
+		if err != nil {
+			slog.Error(fmt.Errorf("couldn't create the pack event archive: %s", err).Error())
+			return
+		}
+	}
 	slog.Info("connected to mongodb")
 
 	// Attempt to connect to kafka
-	kafkaConfig := config.GetDefaultKafkaConfig()
+	kafkaConfig := handler.config.Kafka
+	err = kafkautils.EnsureTopic(kafkaConfig)
+	if err != nil {
+		slog.Error(fmt.Errorf("couldn't provision the kafka topic: %s", err).Error())
+		return
+	}
 	saramaConfig := config.GetSaramaConfig()
-	client, err := sarama.NewConsumerGroup(kafkaConfig.Brokers, consumerGroupId, saramaConfig)
+	client, err := sarama.NewConsumerGroup(kafkaConfig.Brokers, kafkaConfig.ConsumerGroupID, saramaConfig)
 	if err != nil {
 		slog.Error(fmt.Errorf("couldn't initiate a connection to kafka: %s", err).Error())
 		return
@@ -70,6 +112,14 @@ func main() {
 	slog.Info("connected to kafka")
 	handler.consumerGroup = &client
 
+	// Expose metrics in the Prometheus text format
+	go func() {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", metricsRegistry)
+		err := http.ListenAndServe(handler.config.Aggregator.MetricsAddr, mux)
+		slog.Error(fmt.Errorf("metrics server stopped: %s", err).Error())
+	}()
+
 	// Start consumer process
 	slog.Info("starting the consumer")
 	ctx, cancel := context.WithCancel(context.Background())
@@ -100,6 +150,8 @@ func main() {
 // Setup() runs when the consumer is initializing or is reconnecting to kafka
 func (h *consumerHandler) Setup(sess sarama.ConsumerGroupSession) error {
 	slog.Debug("Setting up handler")
+	h.mu.Lock()
+	defer h.mu.Unlock()
 	h.loadReset(sess)
 	return nil
 }
@@ -113,76 +165,123 @@ func (h *consumerHandler) Cleanup(sarama.ConsumerGroupSession) error {
 func (h *consumerHandler) ConsumeClaim(sess sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
 
 	// If partition assignment have been rebalanced, pause messages retrieval and get new offsets from the database
+	h.mu.Lock()
 	if h.sessionGenerationId != sess.GenerationID() {
 		slog.Info("Partition reassignment detected, fetching stored data.")
 		(*h.consumerGroup).PauseAll()
 		h.loadReset(sess)
 		(*h.consumerGroup).ResumeAll()
 	}
+	h.mu.Unlock()
 
 	// Process messages
 	for msg := range claim.Messages() {
-		messageType := getMessageType(msg)
-		slog.Debug("message received: type: " + messageType)
-		// If we see a delete request, we reset all data for that keystem and write it to the DB
-		if messageType == config.MessageTypeDelete {
-			var dr statistics.DeleteRequest
-			err := json.Unmarshal(msg.Value, &dr)
+		h.mu.Lock()
+		h.processMessage(msg, claim.HighWaterMarkOffset())
+		h.mu.Unlock()
+		sess.MarkMessage(msg, "")
+	}
+
+	return nil
+}
+
+// processMessage() aggregates one message into the stats held in memory, and writes them to the
+// database if it's time to
+func (h *consumerHandler) processMessage(msg *sarama.ConsumerMessage, highWaterMark int64) {
+	messageType := getMessageType(msg)
+	slog.Debug("message received: type: " + messageType)
+	partition := strconv.Itoa(int(msg.Partition))
+	messagesConsumed.Inc(partition, messageType)
+	consumerLag.Set(float64(highWaterMark-msg.Offset-1), partition)
+	// If we see a delete request, we delete the data of that keystem, or of a time range of it, and write it to the DB
+	if messageType == config.MessageTypeDelete {
+		var dr statistics.DeleteRequest
+		err := json.Unmarshal(msg.Value, &dr)
+		if err != nil {
+			slog.Error(fmt.Errorf("error occurred while unmarshaling delete request:%s", err).Error())
+			return
+		}
+		if dr.IsRange() {
+			// Stats received before the delete request are written first, then deleted if they're in the range
+			h.rangeDeletions = append(h.rangeDeletions, &dr)
+		} else {
+			// Stats received before the delete request are discarded along with the stored ones
+			delete(h.statsByKeystem, dr.UsedKeystem)
+			h.clearKeystemBuckets(dr.UsedKeystem)
+			h.deletedKeystems[dr.UsedKeystem] = true
+		}
+		if dr.ID != "" {
+			h.appliedDeletions = append(h.appliedDeletions, mongoutils.AppliedDeletion{ID: dr.ID, Partition: msg.Partition, Offset: msg.Offset})
+		}
+		h.offsetByPartition[msg.Partition] = msg.Offset
+		err = h.writeStats()
+		if err != nil {
+			slog.Error(fmt.Errorf("write aborted: error occurred while writing stats to the database: %s", err).Error())
+		} else {
+			h.lastWrite = time.Now()
+		}
+		// If we see a stats message, we aggregate it with the rest
+	} else if messageType == config.MessageTypeStats {
+		var stats statistics.Stats
+		err := json.Unmarshal(msg.Value, &stats)
+		if err != nil {
+			slog.Error(fmt.Errorf("error occurred while unmarshaling stats message:%s", err).Error())
+			return
+		}
+		if _, keyExists := h.statsByKeystem[stats.UsedKeystem]; !keyExists {
+			h.statsByKeystem[stats.UsedKeystem] = statistics.NewKeyStats(stats.UsedKeystem)
+		}
+		h.offsetByPartition[msg.Partition] = msg.Offset // Update offset
+		if h.isDuplicate(msg, &stats) {
+			slog.Debug("dropping duplicate event " + stats.EventID)
+			duplicatesDropped.Inc(partition)
+			h.statsByKeystem[stats.UsedKeystem].DuplicateCount++
+			return
+		}
+		h.statsByKeystem[stats.UsedKeystem].AggregateStats(&stats)
+		if h.config.Aggregator.EventRetention > 0 {
+			event, err := mongoutils.NewPackEvent(&stats, msg.Partition, msg.Offset)
 			if err != nil {
-				slog.Error(fmt.Errorf("error occurred while unmarshaling delete request:%s", err).Error())
-				continue
+				slog.Error(fmt.Errorf("error occurred while archiving pack event: %s", err).Error())
+			} else {
+				h.pendingEvents = append(h.pendingEvents, event)
 			}
-			if _, keyExists := h.statsByKeystem[dr.UsedKeystem]; !keyExists {
-				// If the keystem being deleted isn't stored locally, create an empty one to write
-				h.statsByKeystem[dr.UsedKeystem] = statistics.NewKeyStats(dr.UsedKeystem)
-			}
-			h.statsByKeystem[dr.UsedKeystem].Reset()
-			h.offsetByPartition[msg.Partition] = msg.Offset
-			h.writeStats()
-			// If we see a stats message, we aggregate it with the rest
-		} else if messageType == config.MessageTypeStats {
-			var stats statistics.Stats
-			err := json.Unmarshal(msg.Value, &stats)
+		}
+		err = h.aggregateBuckets(&stats)
+		if err != nil {
+			slog.Error(fmt.Errorf("error occurred while aggregating time-bucketed stats: %s", err).Error())
+		}
+		keystemsInMemory.Set(float64(len(h.statsByKeystem)))
+		// Write stats to db if enough time has passed since last write
+		if time.Since(h.lastWrite) >= h.config.Aggregator.DBWriteInterval {
+			slog.Debug("Writing stats")
+			err := h.writeStats()
 			if err != nil {
-				slog.Error(fmt.Errorf("error occurred while unmarshaling stats message:%s", err).Error())
-				continue
-			}
-			if _, keyExists := h.statsByKeystem[stats.UsedKeystem]; !keyExists {
-				h.statsByKeystem[stats.UsedKeystem] = statistics.NewKeyStats(stats.UsedKeystem) // initialize in case the database does not have any data on this keystem
-				keyStatsMap, err := mongoutils.GetKeyStats(h.mongoClient, []string{stats.UsedKeystem})
-
-				if err != nil {
-					slog.Error(fmt.Errorf("error occurred while getting stats from the database: %s", err).Error())
-				}
-				for keystem, keyStats := range keyStatsMap {
-					h.statsByKeystem[keystem] = keyStats
-				}
-			}
-			h.statsByKeystem[stats.UsedKeystem].AggregateStats(&stats)
-			h.offsetByPartition[msg.Partition] = msg.Offset // Update offset
-			// Write stats to db if enough time has passed since last write
-			log.Println(time.Since(h.lastWrite))
-			if time.Since(h.lastWrite) >= dbWriteInterval {
-				slog.Debug("Writing stats")
-				err := h.writeStats()
-				if err != nil {
-					slog.Error(fmt.Errorf("write aborted: error occurred while writing stats to the database: %s", err).Error())
-				} else {
-					h.lastWrite = time.Now()
-					slog.Debug("stats written successfully")
-				}
+				slog.Error(fmt.Errorf("write aborted: error occurred while writing stats to the database: %s", err).Error())
+			} else {
+				h.lastWrite = time.Now()
+				slog.Debug("stats written successfully")
 			}
-		} else {
-			slog.Debug("No message header")
 		}
-		sess.MarkMessage(msg, "")
+	} else {
+		slog.Debug("No message header")
 	}
-
-	return nil
 }
 
 // writeStats() writes keystats and the updated partition offset to the database
 func (h *consumerHandler) writeStats() error {
+	start := time.Now()
+	err := h.writeStatsTransaction()
+	flushDuration.Observe(time.Since(start).Seconds())
+	if err != nil {
+		flushFailures.Inc()
+	}
+	return err
+}
+
+// writeStatsTransaction() applies the stats received since the last write and the partition offsets in a
+// single transaction, then clears the applied stats. If the transaction fails, they're kept for the next write.
+func (h *consumerHandler) writeStatsTransaction() error {
 	wc := writeconcern.Majority()
 	txnOptions := options.Transaction().SetWriteConcern(wc)
 	// Starts a session on the client
@@ -192,49 +291,247 @@ func (h *consumerHandler) writeStats() error {
 	}
 	// Defers ending the session after the transaction is committed or ended
 	defer session.EndSession(context.TODO())
-	// Inserts multiple documents into a collection within a transaction,
-	// then commits or ends the transaction
+	buckets := make([]*statistics.KeyStatsBucket, 0, len(h.bucketsByKey))
+	for _, bucket := range h.bucketsByKey {
+		buckets = append(buckets, bucket)
+	}
+	var dedupeEntries []mongoutils.DedupeEntry
+	for _, window := range h.dedupeByPartition {
+		dedupeEntries = append(dedupeEntries, window.pending...)
+	}
+	oldestOffsets := h.oldestDedupeOffsets()
+	// Writes to several collections within a transaction, then commits or ends the transaction.
+	// Every write must use the transaction's context to be part of it.
 	_, err = session.WithTransaction(context.TODO(), func(ctx context.Context) (interface{}, error) {
-		offsetAck, err := mongoutils.CreateUpdateOffsets(h.mongoClient, h.offsetByPartition)
+		// Deletions come first, since stats received after a delete request must be kept
+		resetAck, err := mongoutils.ResetKeyStats(ctx, h.mongoClient, mapKeys(h.deletedKeystems))
+		if err != nil {
+			return resetAck, err
+		} else if !resetAck {
+			return resetAck, fmt.Errorf("write acknowledgement not received from database")
+		}
+		offsetAck, err := mongoutils.CreateUpdateOffsets(ctx, h.mongoClient, h.offsetByPartition)
 		if err != nil {
 			return offsetAck, err
 		} else if !offsetAck {
 			return offsetAck, fmt.Errorf("write acknowledgement not received from database")
 		}
-		statsAck, err := mongoutils.CreateUpdateKeyStats(h.mongoClient, h.statsByKeystem)
+		dedupeAck, err := mongoutils.CreateDedupeEntries(ctx, h.mongoClient, dedupeEntries, oldestOffsets)
+		if err != nil {
+			return dedupeAck, err
+		} else if !dedupeAck {
+			return dedupeAck, fmt.Errorf("write acknowledgement not received from database")
+		}
+		statsAck, err := mongoutils.ApplyKeyStatsDeltas(ctx, h.mongoClient, h.statsByKeystem)
 		if err != nil {
 			return statsAck, err
 		} else if !statsAck {
 			return statsAck, fmt.Errorf("write acknowledgement not received from database")
 		}
+		bucketsAck, err := mongoutils.ApplyKeyStatsBucketDeltas(ctx, h.mongoClient, buckets)
+		if err != nil {
+			return bucketsAck, err
+		} else if !bucketsAck {
+			return bucketsAck, fmt.Errorf("write acknowledgement not received from database")
+		}
+		// Range deletions come last, since they also delete the stats received before them
+		for _, dr := range h.rangeDeletions {
+			rangeAck, reason, err := mongoutils.DeleteKeyStatsRange(ctx, h.mongoClient, dr.UsedKeystem, *dr.From, *dr.To)
+			if err != nil {
+				return rangeAck, err
+			} else if !rangeAck {
+				return rangeAck, fmt.Errorf("write acknowledgement not received from database")
+			}
+			if reason != "" {
+				slog.Warn(fmt.Sprintf("couldn't delete the stats of keystem %s from %s to %s: %s", dr.UsedKeystem, dr.From, dr.To, reason))
+			}
+			for i := range h.appliedDeletions {
+				if dr.ID != "" && h.appliedDeletions[i].ID == dr.ID {
+					h.appliedDeletions[i].FailureReason = reason
+				}
+			}
+		}
+		deletionsAck, err := mongoutils.MarkDeletionsApplied(ctx, h.mongoClient, h.appliedDeletions)
+		if err != nil {
+			return deletionsAck, err
+		} else if !deletionsAck {
+			return deletionsAck, fmt.Errorf("write acknowledgement not received from database")
+		}
+		// The summary is shared by every aggregator, so it's written last to keep conflicts short. Transactions
+		// aborted by a conflict are retried by WithTransaction().
+		summaryAck, err := mongoutils.ApplySummaryDeltas(ctx, h.mongoClient, h.statsByKeystem)
+		if err != nil {
+			return summaryAck, err
+		} else if !summaryAck {
+			return summaryAck, fmt.Errorf("write acknowledgement not received from database")
+		}
 		return true, nil
 	}, txnOptions)
+	if err == nil {
+		h.writeEvents()
+		h.clearKeyStats()
+		h.clearBuckets()
+		for part, window := range h.dedupeByPartition {
+			window.pending = nil
+			window.prune(oldestOffsets[part])
+		}
+	}
 	return err
 }
 
-// LoadReset() loads and applies the new partition offsets from the database and clears previous KeyStats
-// Called after startup or a partition reassignment.
+// writeEvents() archives the raw pack events of the stats just written. Events that can't be written are
+// kept for the next write, up to a limit past which the oldest are dropped, since their stats were written.
+// Kept events are looked up before they're written again, since a failed write may have archived some.
+func (h *consumerHandler) writeEvents() {
+	ctx := context.TODO()
+	var err error
+	if len(h.unarchivedEvents) > 0 {
+		var unarchived []*mongoutils.PackEvent
+		unarchived, err = mongoutils.UnarchivedPackEvents(ctx, h.mongoClient, h.unarchivedEvents)
+		if err == nil {
+			h.unarchivedEvents = unarchived
+		}
+	}
+	h.unarchivedEvents = append(h.unarchivedEvents, h.pendingEvents...)
+	h.pendingEvents = nil
+	if err == nil && len(h.unarchivedEvents) > 0 {
+		h.unarchivedEvents, err = mongoutils.InsertPackEvents(ctx, h.mongoClient, h.unarchivedEvents, h.config.Aggregator.EventBatchSize)
+	}
+	if err == nil {
+		return
+	}
+	slog.Error(fmt.Errorf("error occurred while archiving pack events: %s", err).Error())
+	eventWriteFailures.Inc()
+	if excess := len(h.unarchivedEvents) - maxPendingEventBatches*h.config.Aggregator.EventBatchSize; excess > 0 {
+		eventsDropped.Add(float64(excess))
+		h.unarchivedEvents = h.unarchivedEvents[excess:]
+	}
+}
+
+// isDuplicate() reports whether a stats message carries the event ID of a message already consumed from
+// its partition, and remembers the ID if not
+func (h *consumerHandler) isDuplicate(msg *sarama.ConsumerMessage, stats *statistics.Stats) bool {
+	if h.config.Aggregator.DedupeWindow == 0 || stats.EventID == "" {
+		return false
+	}
+	window, found := h.dedupeByPartition[msg.Partition]
+	if !found {
+		window = newDedupeWindow()
+		h.dedupeByPartition[msg.Partition] = window
+	}
+	return !window.add(msg.Partition, stats.EventID, msg.Offset)
+}
+
+// oldestDedupeOffsets() returns the offset of the oldest message each partition's dedupe window covers,
+// counting back from the last message consumed from it
+func (h *consumerHandler) oldestDedupeOffsets() map[int32]int64 {
+	oldestOffsets := make(map[int32]int64)
+	for part := range h.dedupeByPartition {
+		oldestOffsets[part] = h.offsetByPartition[part] - int64(h.config.Aggregator.DedupeWindow) + 1
+	}
+	return oldestOffsets
+}
+
+// loadDedupeWindows() replaces the remembered event IDs with those stored for the given partitions
+func (h *consumerHandler) loadDedupeWindows(partitions []int32) error {
+	entries, err := mongoutils.GetDedupeEntries(h.mongoClient, partitions)
+	if err != nil {
+		return err
+	}
+	h.restoreDedupeWindows(entries)
+	return nil
+}
+
+// restoreDedupeWindows() replaces the remembered event IDs with stored ones. IDs seen since the last write
+// are forgotten, since their messages will be consumed again.
+func (h *consumerHandler) restoreDedupeWindows(entries []mongoutils.DedupeEntry) {
+	clear(h.dedupeByPartition)
+	for _, entry := range entries {
+		window, found := h.dedupeByPartition[entry.Partition]
+		if !found {
+			window = newDedupeWindow()
+			h.dedupeByPartition[entry.Partition] = window
+		}
+		window.seen[entry.EventID] = entry.Offset
+	}
+}
+
+// aggregateBuckets() aggregates a Stats instance into the minute, hour and day buckets of its
+// keystem containing the time of the event
+func (h *consumerHandler) aggregateBuckets(stats *statistics.Stats) error {
+	eventTime, err := statistics.ParseTimeStamp(stats.TimeStamp)
+	if err != nil {
+		return fmt.Errorf("couldn't parse timestamp %q: %s", stats.TimeStamp, err)
+	}
+	for _, granularity := range statistics.Granularities {
+		start, err := statistics.BucketStart(eventTime, granularity)
+		if err != nil {
+			return err
+		}
+		key := bucketKey{keystem: stats.UsedKeystem, granularity: granularity, start: start.Unix()}
+		bucket, keyExists := h.bucketsByKey[key]
+		if !keyExists {
+			bucket, err = statistics.NewKeyStatsBucket(stats.UsedKeystem, granularity, eventTime)
+			if err != nil {
+				return err
+			}
+			h.bucketsByKey[key] = bucket
+		}
+		bucket.AggregateStats(stats)
+	}
+	return nil
+}
+
+// LoadReset() loads and applies the new partition offsets from the database and clears stats that weren't
+// written yet, since their messages will be consumed again. Called after startup or a partition reassignment.
 func (h *consumerHandler) loadReset(sess sarama.ConsumerGroupSession) error {
-	obp, err := mongoutils.GetOffsets(h.mongoClient, sess.Claims()[config.GetDefaultKafkaConfig().Topic])
+	h.sessionGenerationId = sess.GenerationID()
+	partitions := sess.Claims()[h.config.Kafka.Topic]
+	obp, err := mongoutils.GetOffsets(h.mongoClient, partitions)
 	h.offsetByPartition = obp
 	if err != nil {
 		return err
 	}
-	// Set new offsets for each partition if an offset for that partition one was saved to the database
+	err = h.loadDedupeWindows(partitions)
+	if err != nil {
+		return err
+	}
+	// Resume each partition after the last message written to the database, if any was. Stats are
+	// incremented rather than overwritten, so that message must not be consumed again.
 	for part, offset := range h.offsetByPartition {
-		sess.ResetOffset(config.GetDefaultKafkaConfig().Topic, part, offset, "")
+		sess.ResetOffset(h.config.Kafka.Topic, part, offset+1, "")
 	}
 	// delete all KeyStats
 	h.clearKeyStats()
+	h.clearBuckets()
+	h.pendingEvents = nil
 	return nil
 }
 
-// clearKeyStats() deletes all keys in our map of KeyStats. This is called when partition
-// assignment are updated, and not when a request comes in to delete keystem data.
+// clearKeyStats() deletes all keys in our map of KeyStats. This is called after a write and when
+// partition assignment are updated, and not when a request comes in to delete keystem data.
 func (h *consumerHandler) clearKeyStats() {
 	for k := range h.statsByKeystem {
 		delete(h.statsByKeystem, k)
 	}
+	keystemsInMemory.Set(0)
+}
+
+// clearBuckets() drops all in-memory buckets and pending deletions
+func (h *consumerHandler) clearBuckets() {
+	clear(h.bucketsByKey)
+	clear(h.deletedKeystems)
+	h.rangeDeletions = nil
+	h.appliedDeletions = nil
+}
+
+// clearKeystemBuckets() drops the in-memory buckets of one keystem
+func (h *consumerHandler) clearKeystemBuckets(keystem string) {
+	for key := range h.bucketsByKey {
+		if key.keystem == keystem {
+			delete(h.bucketsByKey, key)
+		}
+	}
 }
 
 // getMessageType() returns a string representing the type of message (stats or delete)
@@ -246,3 +543,11 @@ func getMessageType(msg *sarama.ConsumerMessage) string {
 	}
 	return ""
 }
+
+func mapKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	return keys
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"pacproxy/shared/mongoutils"
+)
+
+// dedupeWindow remembers the event IDs of the last stats messages consumed from one partition, so that
+// a message produced twice is only aggregated once
+type dedupeWindow struct {
+	seen    map[string]int64 // event ID -> offset of the message that carried it
+	pending []mongoutils.DedupeEntry
+}
+
+func newDedupeWindow() *dedupeWindow {
+	return &dedupeWindow{seen: make(map[string]int64)}
+}
+
+// add() remembers an event ID, and reports false if it was already seen
+func (w *dedupeWindow) add(partition int32, eventID string, offset int64) bool {
+	if _, found := w.seen[eventID]; found {
+		return false
+	}
+	w.seen[eventID] = offset
+	w.pending = append(w.pending, mongoutils.DedupeEntry{Partition: partition, EventID: eventID, Offset: offset})
+	return true
+}
+
+// prune() forgets event IDs carried by messages older than oldestOffset
+func (w *dedupeWindow) prune(oldestOffset int64) {
+	for eventID, offset := range w.seen {
+		if offset < oldestOffset {
+			delete(w.seen, eventID)
+		}
+	}
+}
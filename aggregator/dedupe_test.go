@@ -0,0 +1,141 @@
+package main
+
+import (
+	"pacproxy/shared/config"
+	"pacproxy/shared/mongoutils"
+	"pacproxy/shared/statistics"
+	"testing"
+
+	"github.com/IBM/sarama"
+)
+
+func newTestHandler(windowSize int) *consumerHandler {
+	return &consumerHandler{
+		config:            &config.Config{Aggregator: config.AggregatorConfig{DedupeWindow: windowSize}},
+		offsetByPartition: make(map[int32]int64),
+		dedupeByPartition: make(map[int32]*dedupeWindow),
+	}
+}
+
+// consume() checks an event consumed at an offset of a partition for duplicates, as processMessage() does
+func consume(h *consumerHandler, partition int32, offset int64, eventID string) (duplicate bool) {
+	h.offsetByPartition[partition] = offset
+	return h.isDuplicate(&sarama.ConsumerMessage{Partition: partition, Offset: offset}, &statistics.Stats{EventID: eventID})
+}
+
+// flush() stores the pending event IDs and prunes the windows, as a successful writeStatsTransaction() does
+func flush(h *consumerHandler, stored []mongoutils.DedupeEntry) []mongoutils.DedupeEntry {
+	oldestOffsets := h.oldestDedupeOffsets()
+	var kept []mongoutils.DedupeEntry
+	for _, entry := range stored {
+		if entry.Offset >= oldestOffsets[entry.Partition] {
+			kept = append(kept, entry)
+		}
+	}
+	for part, window := range h.dedupeByPartition {
+		for _, entry := range window.pending {
+			if entry.Offset >= oldestOffsets[part] {
+				kept = append(kept, entry)
+			}
+		}
+		window.pending = nil
+		window.prune(oldestOffsets[part])
+	}
+	return kept
+}
+
+func TestDedupeWindow(t *testing.T) {
+	h := newTestHandler(10)
+	tests := []struct {
+		partition int32
+		offset    int64
+		eventID   string
+		duplicate bool
+	}{
+		{0, 0, "a", false},
+		{0, 1, "b", false},
+		{0, 2, "a", true},
+		{1, 0, "a", false}, // windows are kept per partition
+		{0, 3, "", false},  // messages without an event ID are never duplicates
+		{0, 4, "", false},
+		{0, 5, "b", true},
+	}
+	for _, test := range tests {
+		if got := consume(h, test.partition, test.offset, test.eventID); got != test.duplicate {
+			t.Errorf("event %q at offset %d of partition %d: duplicate = %v, want %v", test.eventID, test.offset, test.partition, got, test.duplicate)
+		}
+	}
+	if pending := len(h.dedupeByPartition[0].pending); pending != 2 {
+		t.Errorf("%d event IDs pending on partition 0, want 2", pending)
+	}
+
+	disabled := newTestHandler(0)
+	consume(disabled, 0, 0, "a")
+	if consume(disabled, 0, 1, "a") {
+		t.Error("a duplicate was dropped with deduplication disabled")
+	}
+}
+
+func TestDedupeWindowEviction(t *testing.T) {
+	h := newTestHandler(3)
+	for offset, eventID := range []string{"a", "b", "c", "d", "e"} {
+		consume(h, 0, int64(offset), eventID)
+	}
+	stored := flush(h, nil)
+	// The window covers offsets 2 to 4
+	if len(stored) != 3 || len(h.dedupeByPartition[0].seen) != 3 {
+		t.Errorf("%d event IDs stored and %d remembered, want 3", len(stored), len(h.dedupeByPartition[0].seen))
+	}
+	if consume(h, 0, 5, "a") {
+		t.Error("an event older than the window was dropped")
+	}
+	if !consume(h, 0, 6, "d") {
+		t.Error("an event within the window wasn't dropped")
+	}
+	stored = flush(h, stored)
+	for _, entry := range stored {
+		if entry.Offset < 4 {
+			t.Errorf("event %q at offset %d is still stored after the window moved past it", entry.EventID, entry.Offset)
+		}
+	}
+}
+
+// After a restart or a reassignment, the stored window is reloaded and the partition is consumed again from
+// the message after the last one written, as loadReset() does with ResetOffset(offset+1)
+func TestDedupeWindowReload(t *testing.T) {
+	h := newTestHandler(10)
+	for offset, eventID := range []string{"a", "b", "c"} {
+		consume(h, 0, int64(offset), eventID)
+	}
+	stored := flush(h, nil)
+	writtenOffset := h.offsetByPartition[0]
+	// Consumed but never written, since the aggregator stopped before its next write
+	consume(h, 0, 3, "d")
+	consume(h, 0, 4, "e")
+
+	reloaded := newTestHandler(10)
+	reloaded.offsetByPartition[0] = writtenOffset
+	reloaded.restoreDedupeWindows(stored)
+	if len(reloaded.dedupeByPartition[0].seen) != 3 {
+		t.Fatalf("%d event IDs reloaded, want 3", len(reloaded.dedupeByPartition[0].seen))
+	}
+	// The messages that weren't written are consumed again, and aren't duplicates of themselves
+	for offset, eventID := range []string{"d", "e"} {
+		if consume(reloaded, 0, writtenOffset+1+int64(offset), eventID) {
+			t.Errorf("replayed event %q was dropped", eventID)
+		}
+	}
+	// A resend of a written event is still dropped, as would be the last written message if it were replayed
+	if !consume(reloaded, 0, 5, "b") {
+		t.Error("a resend of a written event wasn't dropped after a reload")
+	}
+	if !consume(reloaded, 0, 6, "c") {
+		t.Error("the last written event wasn't dropped after a reload")
+	}
+
+	// Reloading forgets the event IDs seen since the last write
+	h.restoreDedupeWindows(stored)
+	if _, found := h.dedupeByPartition[0].seen["d"]; found || len(h.dedupeByPartition[0].pending) != 0 {
+		t.Error("event IDs that weren't written survived a reload")
+	}
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"pacproxy/shared/metrics"
+)
+
+// Metrics exposed on /metrics
+var (
+	metricsRegistry = metrics.NewRegistry()
+
+	messagesConsumed = metricsRegistry.NewCounterVec("aggregator_messages_consumed_total",
+		"Messages consumed from Kafka, by partition and message type.",
+		"partition", "type")
+	consumerLag = metricsRegistry.NewGaugeVec("aggregator_consumer_lag_messages",
+		"Messages in a partition not yet consumed, measured from the partition's high water mark.",
+		"partition")
+	flushDuration = metricsRegistry.NewHistogramVec("aggregator_flush_duration_seconds",
+		"Time taken to write aggregated statistics and offsets to the database.",
+		metrics.DefaultBuckets)
+	flushFailures = metricsRegistry.NewCounterVec("aggregator_flush_failures_total",
+		"Writes of aggregated statistics to the database that failed.")
+	duplicatesDropped = metricsRegistry.NewCounterVec("aggregator_duplicates_dropped_total",
+		"Stats messages dropped because a message with the same event ID was already consumed, by partition.",
+		"partition")
+	keystemsInMemory = metricsRegistry.NewGaugeVec("aggregator_keystems_in_memory",
+		"Keystems whose statistics are held in memory.")
+	eventWriteFailures = metricsRegistry.NewCounterVec("aggregator_event_write_failures_total",
+		"Writes of raw pack events to the event archive that failed.")
+	eventsDropped = metricsRegistry.NewCounterVec("aggregator_events_dropped_total",
+		"Raw pack events dropped because the event archive couldn't be written for too long.")
+)
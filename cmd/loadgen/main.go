@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"os/signal"
+	"pacproxy/shared/statistics"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Largest pack request read from the requests file
+const maxLineSize int = 16 << 20
+
+// options configures a load test
+type options struct {
+	target         string
+	file           string
+	rate           float64
+	concurrency    int
+	duration       time.Duration
+	requests       int
+	keystems       int
+	randomizeAuth  bool
+	authorization  string
+	apiKey         string
+	timeout        time.Duration
+	reportInterval time.Duration
+}
+
+// results gathers the outcome of every request sent
+type results struct {
+	mu              sync.Mutex
+	sent            int
+	transportErrors int
+	statusCodes     map[string]int
+	latencies       *statistics.LatencySketch
+	maxLatency      time.Duration
+	duration        time.Duration // time taken by the test
+}
+
+func main() {
+	var opts options
+	flags := flag.NewFlagSet("loadgen", flag.ExitOnError)
+	flags.StringVar(&opts.target, "target", "http://localhost:8080/", "URL pack requests are sent to")
+	flags.StringVar(&opts.file, "file", "requests.jsonl", "file of pack requests, one JSON request body per line")
+	flags.Float64Var(&opts.rate, "rate", 0, "requests per second across all workers, 0 to send as fast as the workers can")
+	flags.IntVar(&opts.concurrency, "concurrency", 10, "requests in flight at once")
+	flags.DurationVar(&opts.duration, "duration", 30*time.Second, "how long to send requests for")
+	flags.IntVar(&opts.requests, "requests", 0, "requests to send before stopping, 0 for no limit")
+	flags.IntVar(&opts.keystems, "keystems", 0, "spread requests across this many synthetic keystems, sent as X-Keystem, 0 to send none")
+	flags.BoolVar(&opts.randomizeAuth, "randomize-authorization", false, "also send a synthetic Authorization header per keystem")
+	flags.StringVar(&opts.authorization, "authorization", "", "Authorization header sent with every request")
+	flags.StringVar(&opts.apiKey, "api-key", "", "X-Api-Key header sent with every request")
+	flags.DurationVar(&opts.timeout, "timeout", 60*time.Second, "deadline of each request")
+	flags.DurationVar(&opts.reportInterval, "report-interval", 5*time.Second, "time between progress reports, 0 for none")
+	flags.Parse(os.Args[1:])
+	if opts.concurrency < 1 || opts.rate < 0 || opts.duration <= 0 || opts.requests < 0 || opts.keystems < 0 {
+		slog.Error("concurrency must be at least 1, duration positive, and rate, requests and keystems not negative")
+		os.Exit(2)
+	}
+
+	bodies, err := readRequests(opts.file)
+	if err != nil {
+		slog.Error(fmt.Errorf("couldn't read pack requests: %s", err).Error())
+		os.Exit(1)
+	}
+	slog.Info(fmt.Sprintf("replaying %d pack requests against %s", len(bodies), opts.target))
+
+	ctx, cancel := context.WithTimeout(context.Background(), opts.duration)
+	defer cancel()
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt)
+	defer stop()
+	r := run(ctx, &opts, bodies)
+	r.report(os.Stdout)
+}
+
+// readRequests() returns the non-empty lines of a JSONL file
+func readRequests(file string) ([][]byte, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var bodies [][]byte
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64<<10), maxLineSize)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) > 0 {
+			bodies = append(bodies, slices.Clone(line))
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(bodies) == 0 {
+		return nil, fmt.Errorf("%s has no requests", file)
+	}
+	return bodies, nil
+}
+
+// run() sends the pack requests in turn, looping over them, until ctx is done or enough were sent.
+// Requests are paced to opts.rate if it's set, and sent by opts.concurrency workers.
+func run(ctx context.Context, opts *options, bodies [][]byte) *results {
+	r := &results{statusCodes: make(map[string]int), latencies: statistics.NewLatencySketch()}
+	client := &http.Client{Timeout: opts.timeout, Transport: &http.Transport{MaxIdleConnsPerHost: opts.concurrency}}
+	jobs := make(chan []byte)
+	var wg sync.WaitGroup
+	for range opts.concurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for body := range jobs {
+				r.record(send(ctx, client, opts, body))
+			}
+		}()
+	}
+
+	start := time.Now()
+	if opts.reportInterval > 0 {
+		go func() {
+			ticker := time.NewTicker(opts.reportInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+					r.progress(time.Since(start))
+				}
+			}
+		}()
+	}
+
+	var tick <-chan time.Time
+	if opts.rate > 0 {
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / opts.rate))
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+dispatch:
+	for i := 0; opts.requests == 0 || i < opts.requests; i++ {
+		if tick != nil {
+			select {
+			case <-ctx.Done():
+				break dispatch
+			case <-tick:
+			}
+		}
+		select {
+		case <-ctx.Done():
+			break dispatch
+		case jobs <- bodies[i%len(bodies)]:
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	r.duration = time.Since(start)
+	return r
+}
+
+// outcome is the result of one request
+type outcome struct {
+	statusCode string // "" if no response was received
+	latency    time.Duration
+}
+
+// send() sends one pack request. Requests interrupted by the end of the test aren't counted.
+func send(ctx context.Context, client *http.Client, opts *options, body []byte) *outcome {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, opts.target, bytes.NewReader(body))
+	if err != nil {
+		slog.Error(fmt.Errorf("couldn't create request: %s", err).Error())
+		return nil
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if opts.authorization != "" {
+		req.Header.Set("Authorization", opts.authorization)
+	}
+	if opts.apiKey != "" {
+		req.Header.Set("X-Api-Key", opts.apiKey)
+	}
+	if opts.keystems > 0 {
+		keystem := "loadgen-" + strconv.Itoa(rand.IntN(opts.keystems))
+		req.Header.Set("X-Keystem", keystem)
+		if opts.randomizeAuth {
+			req.Header.Set("Authorization", "Bearer "+keystem)
+		}
+	}
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil
+		}
+		return &outcome{latency: time.Since(start)}
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	return &outcome{statusCode: strconv.Itoa(resp.StatusCode), latency: time.Since(start)}
+}
+
+func (r *results) record(o *outcome) {
+	if o == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.sent++
+	if o.statusCode == "" {
+		r.transportErrors++
+		return
+	}
+	r.statusCodes[o.statusCode]++
+	r.latencies.Add(float64(o.latency))
+	r.maxLatency = max(r.maxLatency, o.latency)
+}
+
+// failed() returns the requests that got no response or an error status. Callers hold the lock.
+func (r *results) failed() int {
+	failed := r.transportErrors
+	for statusCode, count := range r.statusCodes {
+		if !strings.HasPrefix(statusCode, "2") {
+			failed += count
+		}
+	}
+	return failed
+}
+
+// progress() logs the requests sent so far
+func (r *results) progress(elapsed time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	slog.Info(fmt.Sprintf("%s: %d sent, %.1f req/s, %d errors", elapsed.Round(time.Second), r.sent, float64(r.sent)/elapsed.Seconds(), r.failed()))
+}
+
+// report() writes the throughput, latency percentiles and error rates of the test
+func (r *results) report(w io.Writer) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	failed := r.failed()
+	percentiles := r.latencies.Percentiles()
+	ms := func(nanos float64) string {
+		return strconv.FormatFloat(nanos/float64(time.Millisecond), 'f', 1, 64) + "ms"
+	}
+	fmt.Fprintf(w, "duration:     %s\n", r.duration.Round(time.Millisecond))
+	fmt.Fprintf(w, "requests:     %d\n", r.sent)
+	fmt.Fprintf(w, "throughput:   %.1f req/s\n", float64(r.sent)/r.duration.Seconds())
+	fmt.Fprintf(w, "latency:      p50 %s, p90 %s, p95 %s, p99 %s, max %s\n",
+		ms(percentiles.P50), ms(percentiles.P90), ms(percentiles.P95), ms(percentiles.P99), ms(float64(r.maxLatency)))
+	fmt.Fprintf(w, "errors:       %d (%.2f%%), %d without a response\n", failed, 100*float64(failed)/float64(max(r.sent, 1)), r.transportErrors)
+	statusCodes := make([]string, 0, len(r.statusCodes))
+	for statusCode := range r.statusCodes {
+		statusCodes = append(statusCodes, statusCode)
+	}
+	slices.Sort(statusCodes)
+	for _, statusCode := range statusCodes {
+		fmt.Fprintf(w, "status %s:   %d\n", statusCode, r.statusCodes[statusCode])
+	}
+}
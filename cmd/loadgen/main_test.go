@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestReadRequests(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "requests.jsonl")
+	os.WriteFile(file, []byte("{\"a\":1}\n\n  {\"b\":2}  \r\n\n"), 0o644)
+	bodies, err := readRequests(file)
+	if err != nil || len(bodies) != 2 || string(bodies[0]) != `{"a":1}` || string(bodies[1]) != `{"b":2}` {
+		t.Errorf("readRequests() = %q, %v", bodies, err)
+	}
+
+	empty := filepath.Join(dir, "empty.jsonl")
+	os.WriteFile(empty, []byte("\n\n"), 0o644)
+	if _, err := readRequests(empty); err == nil {
+		t.Error("a file without requests was accepted")
+	}
+	if _, err := readRequests(filepath.Join(dir, "missing.jsonl")); err == nil {
+		t.Error("a missing file was accepted")
+	}
+}
+
+// Requests received by a test server
+type received struct {
+	mu       sync.Mutex
+	bodies   map[string]int
+	keystems map[string]bool
+	headers  []http.Header
+}
+
+func newTestTarget(t *testing.T) (*httptest.Server, *received) {
+	rec := &received{bodies: make(map[string]int), keystems: make(map[string]bool)}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		rec.mu.Lock()
+		rec.bodies[string(body)]++
+		rec.keystems[req.Header.Get("X-Keystem")] = true
+		rec.headers = append(rec.headers, req.Header.Clone())
+		rec.mu.Unlock()
+		if string(body) == "fail" {
+			w.WriteHeader(500)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server, rec
+}
+
+func TestRun(t *testing.T) {
+	server, rec := newTestTarget(t)
+	opts := &options{target: server.URL, concurrency: 3, requests: 9, keystems: 2, randomizeAuth: true, apiKey: "key", timeout: time.Second}
+	r := run(context.Background(), opts, [][]byte{[]byte("a"), []byte("b"), []byte("fail")})
+
+	// The bodies are sent in turn until the request limit
+	if r.sent != 9 || rec.bodies["a"] != 3 || rec.bodies["b"] != 3 || rec.bodies["fail"] != 3 {
+		t.Errorf("sent %d requests, received %v", r.sent, rec.bodies)
+	}
+	if r.statusCodes["200"] != 6 || r.statusCodes["500"] != 3 || r.failed() != 3 || r.transportErrors != 0 {
+		t.Errorf("status codes %v, %d failed", r.statusCodes, r.failed())
+	}
+	for keystem := range rec.keystems {
+		if keystem != "loadgen-0" && keystem != "loadgen-1" {
+			t.Errorf("sent keystem %q", keystem)
+		}
+	}
+	for _, header := range rec.headers {
+		if header.Get("Authorization") != "Bearer "+header.Get("X-Keystem") || header.Get("X-Api-Key") != "key" ||
+			header.Get("Content-Type") != "application/json" {
+			t.Errorf("sent headers %v", header)
+		}
+	}
+
+	var report strings.Builder
+	r.report(&report)
+	for _, line := range []string{"requests:     9\n", "errors:       3 (33.33%), 0 without a response\n", "status 200:   6\n", "status 500:   3\n"} {
+		if !strings.Contains(report.String(), line) {
+			t.Errorf("report doesn't contain %q:\n%s", line, report.String())
+		}
+	}
+}
+
+func TestRunPacing(t *testing.T) {
+	server, _ := newTestTarget(t)
+	opts := &options{target: server.URL, concurrency: 5, requests: 5, rate: 50, timeout: time.Second}
+	r := run(context.Background(), opts, [][]byte{[]byte("a")})
+	// The first request waits for a tick too, so 5 requests at 50 per second take at least 100ms
+	if r.sent != 5 || r.duration < 100*time.Millisecond {
+		t.Errorf("sent %d requests in %s", r.sent, r.duration)
+	}
+
+	// The test stops when its context ends, without counting interrupted requests
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	opts = &options{target: server.URL, concurrency: 2, rate: 100, timeout: time.Second}
+	r = run(ctx, opts, [][]byte{[]byte("a")})
+	if r.sent > 6 || r.duration > time.Second {
+		t.Errorf("sent %d requests in %s, past the end of the test", r.sent, r.duration)
+	}
+}
+
+func TestRunTransportErrors(t *testing.T) {
+	server, _ := newTestTarget(t)
+	server.Close()
+	opts := &options{target: server.URL, concurrency: 2, requests: 4, timeout: time.Second}
+	r := run(context.Background(), opts, [][]byte{[]byte("a")})
+	if r.sent != 4 || r.transportErrors != 4 || r.failed() != 4 || len(r.statusCodes) != 0 {
+		t.Errorf("sent %d requests with %d transport errors and status codes %v", r.sent, r.transportErrors, r.statusCodes)
+	}
+}
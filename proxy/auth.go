@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"pacproxy/shared/config"
+	"pacproxy/shared/mongoutils"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+)
+
+// Roles of API keys. Readers can read the stats of the keystems in their scope, and admins can also
+// delete stats and manage API keys.
+const (
+	roleReader string = "reader"
+	roleAdmin  string = "admin"
+)
+
+// Header carrying API keys on requests forwarded to upstreams, whose Authorization header is the upstream's
+const apiKeyHeader string = "X-Api-Key"
+
+// Context key of the authenticated API key
+const apiKeyContextKey string = "apiKey"
+
+// Looked up keys kept before expired ones are dropped
+const maxCachedAPIKeys int = 10000
+
+// authenticator checks the API keys of requests against the hashes stored in the database. Looked up
+// keys are trusted for a while, so a revoked key may still be accepted by other instances until then.
+type authenticator struct {
+	lookup        func(ctx context.Context, hash string) (*mongoutils.APIKey, error) // nil key if none has the hash
+	config        config.AuthConfig
+	bootstrapHash string
+	mu            sync.Mutex
+	cache         map[string]cachedAPIKey // by key hash
+}
+
+type cachedAPIKey struct {
+	apiKey  *mongoutils.APIKey // nil if no key has this hash
+	expires time.Time
+}
+
+// newAuthenticator() returns an authenticator checking keys against those stored in the database. It fails
+// if auth is enabled while no key could be accepted, since no key could then be created either.
+func newAuthenticator(mongoClient *mongo.Client, authConfig config.AuthConfig) (*authenticator, error) {
+	a := &authenticator{
+		lookup: func(ctx context.Context, hash string) (*mongoutils.APIKey, error) {
+			return mongoutils.GetAPIKey(ctx, mongoClient, hash)
+		},
+		config: authConfig,
+		cache:  make(map[string]cachedAPIKey),
+	}
+	if authConfig.BootstrapAdminKey != "" {
+		a.bootstrapHash = apiKeyHash(authConfig.BootstrapAdminKey)
+	}
+	if !authConfig.Enabled || authConfig.BootstrapAdminKey != "" {
+		return a, nil
+	}
+	storedKeys, err := mongoutils.CountAPIKeys(context.Background(), mongoClient)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't count the stored API keys: %s", err)
+	}
+	err = checkBootstrap(authConfig, storedKeys)
+	if err != nil {
+		return nil, err
+	}
+	slog.Warn("auth.bootstrapAdminKey isn't set, so only API keys stored in the database are accepted")
+	return a, nil
+}
+
+// checkBootstrap() fails if auth is enabled without a bootstrap admin key while no API key is stored
+func checkBootstrap(authConfig config.AuthConfig, storedKeys int64) error {
+	if authConfig.Enabled && authConfig.BootstrapAdminKey == "" && storedKeys == 0 {
+		return fmt.Errorf("auth.enabled requires auth.bootstrapAdminKey until an API key is stored, or every /api request would be rejected")
+	}
+	return nil
+}
+
+// require() returns a middleware rejecting requests without an API key of the given role. Admin keys
+// have every role. Requests pass through untouched if auth is disabled.
+func (a *authenticator) require(role string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !a.config.Enabled {
+			return
+		}
+		apiKey, err := a.authenticate(c)
+		if err != nil {
+			err = fmt.Errorf("error occurred checking API key: %s", err)
+			slog.Error(err.Error())
+			c.AbortWithStatusJSON(500, ErrorResponse{err.Error()})
+			return
+		}
+		if apiKey == nil {
+			c.AbortWithStatusJSON(401, ErrorResponse{"a valid API key is required"})
+			return
+		}
+		if role == roleAdmin && apiKey.Role != roleAdmin {
+			c.AbortWithStatusJSON(403, ErrorResponse{"an admin API key is required"})
+			return
+		}
+		c.Set(apiKeyContextKey, apiKey)
+	}
+}
+
+// authenticate() returns the API key of a request, sent as a bearer token or in the X-Api-Key header,
+// or nil if it has no valid key. Forwarded requests can only use X-Api-Key, since their Authorization
+// header is meant for the upstream.
+func (a *authenticator) authenticate(c *gin.Context) (*mongoutils.APIKey, error) {
+	key := c.GetHeader(apiKeyHeader)
+	if bearer, found := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer "); key == "" && found && strings.HasPrefix(c.Request.URL.Path, "/api/") {
+		key = bearer
+	}
+	key = strings.TrimSpace(key)
+	if key == "" {
+		return nil, nil
+	}
+	hash := apiKeyHash(key)
+	if a.bootstrapHash != "" && subtle.ConstantTimeCompare([]byte(hash), []byte(a.bootstrapHash)) == 1 {
+		return &mongoutils.APIKey{ID: "bootstrap", Name: "bootstrap", Role: roleAdmin}, nil
+	}
+
+	a.mu.Lock()
+	cached, found := a.cache[hash]
+	a.mu.Unlock()
+	if found && time.Now().Before(cached.expires) {
+		return cached.apiKey, nil
+	}
+	apiKey, err := a.lookup(c.Request.Context(), hash)
+	if err != nil {
+		return nil, err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := time.Now()
+	if len(a.cache) >= maxCachedAPIKeys {
+		for cachedHash, cached := range a.cache {
+			if now.After(cached.expires) {
+				delete(a.cache, cachedHash)
+			}
+		}
+	}
+	if len(a.cache) < maxCachedAPIKeys {
+		a.cache[hash] = cachedAPIKey{apiKey: apiKey, expires: now.Add(a.config.KeyCacheTTL)}
+	}
+	return apiKey, nil
+}
+
+// forget() stops trusting a revoked key on this instance
+func (a *authenticator) forget(hash string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.cache, hash)
+}
+
+// canAccessKeystem() reports whether the request's API key can read a keystem's stats. Only keys without
+// a keystem scope can read the stats of all keystems.
+func canAccessKeystem(c *gin.Context, keystem string) bool {
+	value, found := c.Get(apiKeyContextKey)
+	if !found {
+		return true // auth is disabled
+	}
+	apiKey := value.(*mongoutils.APIKey)
+	return len(apiKey.Keystems) == 0 || slices.Contains(apiKey.Keystems, keystem)
+}
+
+// keystemScope() returns the keystems the request's API key can read, or nil if it can read every keystem
+func keystemScope(c *gin.Context) []string {
+	value, found := c.Get(apiKeyContextKey)
+	if !found {
+		return nil
+	}
+	apiKey := value.(*mongoutils.APIKey)
+	if len(apiKey.Keystems) == 0 {
+		return nil
+	}
+	return apiKey.Keystems
+}
+
+// newAPIKey() returns a random API key, and the public ID it's managed through
+func newAPIKey() (string, string) {
+	key := make([]byte, 32)
+	rand.Read(key)
+	id := make([]byte, 8)
+	rand.Read(id)
+	return "pk_" + hex.EncodeToString(key), hex.EncodeToString(id)
+}
+
+func apiKeyHash(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"pacproxy/shared/config"
+	"pacproxy/shared/mongoutils"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// newTestAuthenticator() returns an authenticator looking keys up in a map, and counting lookups
+func newTestAuthenticator(authConfig config.AuthConfig, keys map[string]*mongoutils.APIKey, lookups *int) *authenticator {
+	a := &authenticator{
+		lookup: func(ctx context.Context, hash string) (*mongoutils.APIKey, error) {
+			*lookups++
+			for key, apiKey := range keys {
+				if apiKeyHash(key) == hash {
+					return apiKey, nil
+				}
+			}
+			if hash == apiKeyHash("broken") {
+				return nil, errors.New("database unavailable")
+			}
+			return nil, nil
+		},
+		config: authConfig,
+		cache:  make(map[string]cachedAPIKey),
+	}
+	if authConfig.BootstrapAdminKey != "" {
+		a.bootstrapHash = apiKeyHash(authConfig.BootstrapAdminKey)
+	}
+	return a
+}
+
+var testAPIKeys = map[string]*mongoutils.APIKey{
+	"pk_reader": {ID: "r", Role: roleReader},
+	"pk_scoped": {ID: "s", Role: roleReader, Keystems: []string{"a", "b"}},
+	"pk_admin":  {ID: "a", Role: roleAdmin},
+}
+
+func TestCheckBootstrap(t *testing.T) {
+	tests := []struct {
+		name       string
+		authConfig config.AuthConfig
+		storedKeys int64
+		ok         bool
+	}{
+		{"disabled", config.AuthConfig{}, 0, true},
+		{"bootstrap key", config.AuthConfig{Enabled: true, BootstrapAdminKey: "pk_bootstrap"}, 0, true},
+		{"stored keys", config.AuthConfig{Enabled: true}, 1, true},
+		{"no key", config.AuthConfig{Enabled: true}, 0, false},
+	}
+	for _, test := range tests {
+		if err := checkBootstrap(test.authConfig, test.storedKeys); (err == nil) != test.ok {
+			t.Errorf("%s: checkBootstrap() = %v", test.name, err)
+		}
+	}
+}
+
+func TestRequireRole(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	var lookups int
+	authConfig := config.AuthConfig{Enabled: true, BootstrapAdminKey: "pk_bootstrap", KeyCacheTTL: time.Minute}
+	a := newTestAuthenticator(authConfig, testAPIKeys, &lookups)
+	router := gin.New()
+	ok := func(c *gin.Context) { c.Status(200) }
+	router.GET("/api/stats", a.require(roleReader), ok)
+	router.DELETE("/api/stats", a.require(roleAdmin), ok)
+	router.GET("/forwarded", a.require(roleReader), ok)
+
+	tests := []struct {
+		method string
+		path   string
+		header string
+		key    string
+		want   int
+	}{
+		{http.MethodGet, "/api/stats", "", "", 401},
+		{http.MethodGet, "/api/stats", apiKeyHeader, "pk_unknown", 401},
+		{http.MethodGet, "/api/stats", apiKeyHeader, "pk_reader", 200},
+		{http.MethodGet, "/api/stats", apiKeyHeader, " pk_reader ", 200},
+		{http.MethodGet, "/api/stats", "Authorization", "Bearer pk_reader", 200},
+		{http.MethodGet, "/api/stats", "Authorization", "pk_reader", 401},
+		{http.MethodGet, "/api/stats", apiKeyHeader, "broken", 500},
+		{http.MethodDelete, "/api/stats", apiKeyHeader, "pk_reader", 403},
+		{http.MethodDelete, "/api/stats", apiKeyHeader, "pk_scoped", 403},
+		{http.MethodDelete, "/api/stats", apiKeyHeader, "pk_admin", 200},
+		{http.MethodDelete, "/api/stats", "Authorization", "Bearer pk_bootstrap", 200},
+		{http.MethodGet, "/forwarded", apiKeyHeader, "pk_reader", 200},
+		// Bearer tokens of forwarded requests are the upstream's
+		{http.MethodGet, "/forwarded", "Authorization", "Bearer pk_reader", 401},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest(test.method, test.path, nil)
+		if test.header != "" {
+			req.Header.Set(test.header, test.key)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != test.want {
+			t.Errorf("%s %s with %s %q: %d, want %d", test.method, test.path, test.header, test.key, w.Code, test.want)
+		}
+	}
+
+	// Every request passes with auth disabled
+	a.config.Enabled = false
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/api/stats", nil))
+	if w.Code != 200 {
+		t.Errorf("request without a key got %d with auth disabled", w.Code)
+	}
+}
+
+func TestKeystemScope(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	tests := []struct {
+		name    string
+		apiKey  *mongoutils.APIKey
+		scope   []string
+		allowed []string
+		denied  []string
+	}{
+		{"auth disabled", nil, nil, []string{"a", "all"}, nil},
+		{"unscoped", testAPIKeys["pk_reader"], nil, []string{"a", "c", "all"}, nil},
+		{"scoped", testAPIKeys["pk_scoped"], []string{"a", "b"}, []string{"a", "b"}, []string{"c", "all", ""}},
+	}
+	for _, test := range tests {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		if test.apiKey != nil {
+			c.Set(apiKeyContextKey, test.apiKey)
+		}
+		if scope := keystemScope(c); !slices.Equal(scope, test.scope) {
+			t.Errorf("%s: keystemScope() = %v, want %v", test.name, scope, test.scope)
+		}
+		for _, keystem := range test.allowed {
+			if !canAccessKeystem(c, keystem) {
+				t.Errorf("%s: can't access keystem %q", test.name, keystem)
+			}
+		}
+		for _, keystem := range test.denied {
+			if canAccessKeystem(c, keystem) {
+				t.Errorf("%s: can access keystem %q", test.name, keystem)
+			}
+		}
+	}
+}
+
+func TestAPIKeyCache(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	var lookups int
+	keys := map[string]*mongoutils.APIKey{"pk_reader": testAPIKeys["pk_reader"]}
+	a := newTestAuthenticator(config.AuthConfig{Enabled: true, KeyCacheTTL: time.Minute}, keys, &lookups)
+	authenticate := func(key string) *mongoutils.APIKey {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest(http.MethodGet, "/api/stats", nil)
+		c.Request.Header.Set(apiKeyHeader, key)
+		apiKey, err := a.authenticate(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return apiKey
+	}
+
+	authenticate("pk_reader")
+	authenticate("pk_reader")
+	if lookups != 1 {
+		t.Errorf("%d lookups of a key within its TTL, want 1", lookups)
+	}
+	// Unknown keys are cached too, so they can't make every request query the database
+	authenticate("pk_unknown")
+	authenticate("pk_unknown")
+	if lookups != 2 {
+		t.Errorf("%d lookups after an unknown key was sent twice, want 2", lookups)
+	}
+
+	// A revoked key is trusted until its TTL is up
+	delete(keys, "pk_reader")
+	if authenticate("pk_reader") == nil {
+		t.Error("a cached key was looked up again before its TTL was up")
+	}
+	hash := apiKeyHash("pk_reader")
+	a.cache[hash] = cachedAPIKey{apiKey: a.cache[hash].apiKey, expires: time.Now().Add(-time.Second)}
+	if authenticate("pk_reader") != nil || lookups != 3 {
+		t.Errorf("an expired key was trusted without being looked up again (%d lookups)", lookups)
+	}
+
+	// Keys revoked on this instance are forgotten at once
+	keys["pk_reader"] = testAPIKeys["pk_reader"]
+	a.forget(hash)
+	if authenticate("pk_reader") == nil || lookups != 4 {
+		t.Errorf("a forgotten key wasn't looked up again (%d lookups)", lookups)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"pacproxy/shared/config"
+)
+
+// CachedResponse is a Paccurate response stored in the cache
+type CachedResponse struct {
+	StatusCode int    `json:"statusCode"`
+	Body       []byte `json:"body"`
+}
+
+// Cache stores Paccurate responses keyed by a request fingerprint
+type Cache interface {
+	// Get returns the response stored under key. found is false on a cache miss.
+	Get(ctx context.Context, key string) (resp *CachedResponse, found bool, err error)
+	// Set stores a response under key
+	Set(ctx context.Context, key string, resp *CachedResponse) error
+	Close() error
+}
+
+// newCache() creates the cache backend selected in the cache config.
+// A nil Cache is returned if caching is disabled.
+func newCache(cacheConfig config.CacheConfig) (Cache, error) {
+	switch cacheConfig.Backend {
+	case config.CacheBackendNone, "":
+		return nil, nil
+	case config.CacheBackendLRU:
+		return newLRUCache(cacheConfig.Capacity, cacheConfig.TTL), nil
+	case config.CacheBackendRedis:
+		return newRedisCache(cacheConfig), nil
+	}
+	return nil, fmt.Errorf("unknown cache backend %q", cacheConfig.Backend)
+}
+
+// isCacheable() reports whether the response to a pack request can be reused.
+// Random packs, and packs that aren't seeded, can produce a different result each time.
+func isCacheable(packRequest *PackRequest) bool {
+	return !packRequest.Random && packRequest.Seed
+}
+
+// Pack request fields identifying a call rather than the pack asked for, left out of fingerprints so that
+// identical orders packed again under new IDs share a cached response
+var perCallRequestFields = []string{"requestId", "orderId", "timeout"}
+
+// requestFingerprint() returns a canonical hash of a pack request body and the caller's identity: its
+// keystem if it was learned from its credentials, or else its credentials.
+// The body is decoded and re-encoded so that key order and whitespace don't change the fingerprint.
+func requestFingerprint(body []byte, identity string) (string, error) {
+	var request map[string]any
+	err := json.Unmarshal(body, &request)
+	if err != nil {
+		return "", err
+	}
+	for _, field := range perCallRequestFields {
+		delete(request, field)
+	}
+	canonical, err := json.Marshal(request) // maps are encoded with sorted keys
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	h.Write([]byte(identity))
+	h.Write([]byte{0})
+	h.Write(canonical)
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import "testing"
+
+func TestRequestFingerprint(t *testing.T) {
+	base := `{"requestId":"r-1","orderId":"o-1","seed":true,"itemSets":[{"refId":1,"quantity":2}]}`
+	tests := []struct {
+		name     string
+		body     string
+		identity string
+		same     bool
+	}{
+		{"same request", base, "keystem:a", true},
+		{"key order and whitespace", `{ "itemSets":[{"quantity":2,"refId":1}], "seed":true, "orderId":"o-1", "requestId":"r-1" }`, "keystem:a", true},
+		{"new request and order IDs", `{"requestId":"r-2","orderId":"o-2","seed":true,"itemSets":[{"refId":1,"quantity":2}]}`, "keystem:a", true},
+		{"without IDs", `{"seed":true,"itemSets":[{"refId":1,"quantity":2}]}`, "keystem:a", true},
+		{"other timeout", `{"requestId":"r-1","orderId":"o-1","timeout":10,"seed":true,"itemSets":[{"refId":1,"quantity":2}]}`, "keystem:a", true},
+		{"other items", `{"requestId":"r-1","orderId":"o-1","seed":true,"itemSets":[{"refId":1,"quantity":3}]}`, "keystem:a", false},
+		{"other caller", base, "keystem:b", false},
+	}
+	want, err := requestFingerprint([]byte(base), "keystem:a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range tests {
+		got, err := requestFingerprint([]byte(test.body), test.identity)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if (got == want) != test.same {
+			t.Errorf("%s: fingerprint %s, compared to %s", test.name, got, want)
+		}
+	}
+	if _, err = requestFingerprint([]byte(`[1, 2]`), "keystem:a"); err == nil {
+		t.Error("a body that isn't an object was fingerprinted")
+	}
+}
+
+func TestIsCacheable(t *testing.T) {
+	tests := []struct {
+		random, seed, want bool
+	}{
+		{false, true, true},
+		{true, true, false},
+		{false, false, false},
+		{true, false, false},
+	}
+	for _, test := range tests {
+		if got := isCacheable(&PackRequest{Random: test.random, Seed: test.seed}); got != test.want {
+			t.Errorf("isCacheable(random %v, seed %v) = %v, want %v", test.random, test.seed, got, test.want)
+		}
+	}
+}
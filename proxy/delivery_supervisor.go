@@ -0,0 +1,226 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"pacproxy/shared/config"
+	"sync"
+	"time"
+
+	"github.com/IBM/sarama"
+)
+
+// deliverySupervisor drains the producer's Successes() and Errors() channels.
+// Failed messages are resent with exponential backoff, and after too many attempts
+// they're written to a journal on disk, which is replayed periodically.
+// Messages sent meanwhile aren't held back, so a resent or replayed message can land after later messages
+// of its keystem: the order of a keystem's messages is only kept while Kafka acknowledges them.
+type deliverySupervisor struct {
+	producer       sarama.AsyncProducer
+	journal        *journal
+	maxRetries     int
+	retryBackoff   time.Duration
+	replayInterval time.Duration
+
+	mu      sync.RWMutex // guards closing. Held for reading while sending to the producer.
+	closing bool
+	stop    chan struct{} // closed by Close(), so that sends blocked on a stalled producer give up
+
+	replayMu          sync.Mutex
+	replayOutstanding int // replayed messages not yet acknowledged or journaled again
+
+	retries sync.WaitGroup // resends waiting on their backoff
+	done    chan struct{}
+}
+
+// Longest backoff before a failed message is resent
+const maxRetryBackoff time.Duration = 5 * time.Minute
+
+// deliveryMetadata is attached to each message sent through the supervisor
+type deliveryMetadata struct {
+	attempts int
+	replayed bool
+}
+
+// startDeliverySupervisor() opens the journal and starts draining the producer
+func startDeliverySupervisor(producer *sarama.AsyncProducer, deliveryConfig config.DeliveryConfig) (*deliverySupervisor, error) {
+	j, err := openJournal(deliveryConfig.JournalPath)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't open the delivery journal: %s", err)
+	}
+	s := &deliverySupervisor{
+		producer:       *producer,
+		journal:        j,
+		maxRetries:     deliveryConfig.MaxRetries,
+		retryBackoff:   deliveryConfig.RetryBackoff,
+		replayInterval: deliveryConfig.ReplayInterval,
+		stop:           make(chan struct{}),
+		done:           make(chan struct{}),
+	}
+	journalSize.Set(float64(j.Len()))
+	if pending := j.Len(); pending > 0 {
+		slog.Info(fmt.Sprintf("%d undelivered messages found in the delivery journal", pending))
+	}
+	go s.run()
+	return s, nil
+}
+
+// Send() enqueues a message on the producer, or journals it if the supervisor is closing, including while
+// waiting on a producer that isn't accepting messages
+func (s *deliverySupervisor) Send(msg *sarama.ProducerMessage) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closing {
+		s.spill(msg)
+		return
+	}
+	select {
+	case s.producer.Input() <- msg:
+	case <-s.stop:
+		s.spill(msg)
+	}
+}
+
+// Close() flushes the producer and stops the supervisor. Messages still failing are journaled.
+func (s *deliverySupervisor) Close() error {
+	close(s.stop) // releases blocked senders, so the lock can be taken
+	s.mu.Lock()
+	s.closing = true
+	s.mu.Unlock()
+	s.producer.AsyncClose()
+	<-s.done
+	s.retries.Wait() // pending resends are journaled now that closing is set
+	return s.journal.Close()
+}
+
+func (s *deliverySupervisor) run() {
+	defer close(s.done)
+	successes := s.producer.Successes()
+	errors := s.producer.Errors()
+	ticker := time.NewTicker(s.replayInterval)
+	defer ticker.Stop()
+
+	for successes != nil || errors != nil {
+		select {
+		case msg, ok := <-successes:
+			if !ok {
+				successes = nil
+				continue
+			}
+			if metadata(msg).replayed {
+				s.replayDone()
+			}
+		case producerErr, ok := <-errors:
+			if !ok {
+				errors = nil
+				continue
+			}
+			s.retry(producerErr)
+		case <-ticker.C:
+			s.replay()
+		}
+	}
+}
+
+// retry() schedules a failed message to be resent, or journals it once it's out of attempts
+func (s *deliverySupervisor) retry(producerErr *sarama.ProducerError) {
+	msg := producerErr.Msg
+	md := metadata(msg)
+	if md.attempts >= s.maxRetries {
+		kafkaDeliveryFailures.Inc("journaled")
+		slog.Error(fmt.Errorf("giving up on message after %d attempts, writing it to the journal: %s", md.attempts+1, producerErr.Err).Error())
+		s.spill(msg)
+		return
+	}
+	kafkaDeliveryFailures.Inc("retried")
+	backoff := s.retryBackoffFor(md.attempts)
+	slog.Warn(fmt.Sprintf("message delivery failed, retrying in %s: %s", backoff, producerErr.Err))
+	resend := copyMessage(msg)
+	resend.Metadata = deliveryMetadata{attempts: md.attempts + 1, replayed: md.replayed}
+	s.retries.Add(1)
+	time.AfterFunc(backoff, func() {
+		defer s.retries.Done()
+		s.Send(resend)
+	})
+}
+
+// retryBackoffFor() returns the backoff before a message is resent for the given attempt: the configured
+// backoff, doubled on each attempt up to maxRetryBackoff
+func (s *deliverySupervisor) retryBackoffFor(attempts int) time.Duration {
+	backoff := min(s.retryBackoff, maxRetryBackoff)
+	for range attempts {
+		if backoff >= maxRetryBackoff/2 {
+			return maxRetryBackoff
+		}
+		backoff *= 2
+	}
+	return backoff
+}
+
+// spill() writes a message to the journal
+func (s *deliverySupervisor) spill(msg *sarama.ProducerMessage) {
+	err := s.journal.Append(msg)
+	if err != nil {
+		slog.Error(fmt.Errorf("couldn't write message to the delivery journal, it will be lost: %s", err).Error())
+	}
+	journalSize.Set(float64(s.journal.Len()))
+	if metadata(msg).replayed {
+		s.replayDone()
+	}
+}
+
+// replay() resends journaled messages, unless an earlier replay is still in flight
+func (s *deliverySupervisor) replay() {
+	s.replayMu.Lock()
+	if s.replayOutstanding > 0 || s.journal.Len() == 0 {
+		s.replayMu.Unlock()
+		return
+	}
+	messages, err := s.journal.StartReplay()
+	if err != nil {
+		s.replayMu.Unlock()
+		slog.Error(fmt.Errorf("couldn't replay the delivery journal: %s", err).Error())
+		return
+	}
+	s.replayOutstanding = len(messages)
+	s.replayMu.Unlock()
+	journalSize.Set(0)
+
+	slog.Info(fmt.Sprintf("replaying %d journaled messages", len(messages)))
+	// Sent from a separate goroutine, since the producer can only accept them while
+	// run() keeps draining its Successes() and Errors() channels
+	go func() {
+		for _, msg := range messages {
+			msg.Metadata = deliveryMetadata{replayed: true}
+			s.Send(msg)
+		}
+	}()
+}
+
+// replayDone() records that a replayed message has been settled
+func (s *deliverySupervisor) replayDone() {
+	s.replayMu.Lock()
+	defer s.replayMu.Unlock()
+	s.replayOutstanding--
+	if s.replayOutstanding == 0 {
+		if err := s.journal.FinishReplay(); err != nil {
+			slog.Error(fmt.Errorf("couldn't remove the journal replay file: %s", err).Error())
+		}
+	}
+}
+
+func metadata(msg *sarama.ProducerMessage) deliveryMetadata {
+	md, _ := msg.Metadata.(deliveryMetadata)
+	return md
+}
+
+// copyMessage() copies the fields of a message set by its sender, so it can be enqueued again
+func copyMessage(msg *sarama.ProducerMessage) *sarama.ProducerMessage {
+	return &sarama.ProducerMessage{
+		Topic:    msg.Topic,
+		Key:      msg.Key,
+		Value:    msg.Value,
+		Headers:  msg.Headers,
+		Metadata: msg.Metadata,
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"pacproxy/shared/config"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/IBM/sarama"
+)
+
+// stalledProducer never takes messages from its input, like a producer whose buffer is full while the
+// brokers are down
+type stalledProducer struct {
+	sarama.AsyncProducer
+	input     chan *sarama.ProducerMessage
+	successes chan *sarama.ProducerMessage
+	errors    chan *sarama.ProducerError
+}
+
+func newStalledProducer() *stalledProducer {
+	return &stalledProducer{
+		input:     make(chan *sarama.ProducerMessage),
+		successes: make(chan *sarama.ProducerMessage),
+		errors:    make(chan *sarama.ProducerError),
+	}
+}
+
+func (p *stalledProducer) Input() chan<- *sarama.ProducerMessage     { return p.input }
+func (p *stalledProducer) Successes() <-chan *sarama.ProducerMessage { return p.successes }
+func (p *stalledProducer) Errors() <-chan *sarama.ProducerError      { return p.errors }
+func (p *stalledProducer) AsyncClose() {
+	close(p.successes)
+	close(p.errors)
+}
+
+func TestCloseJournalsBlockedSends(t *testing.T) {
+	var producer sarama.AsyncProducer = newStalledProducer()
+	s, err := startDeliverySupervisor(&producer, config.DeliveryConfig{
+		JournalPath:    filepath.Join(t.TempDir(), "journal.jsonl"),
+		RetryBackoff:   time.Second,
+		ReplayInterval: time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	const senders = 3
+	sent := make(chan struct{})
+	for range senders {
+		go func() {
+			s.Send(&sarama.ProducerMessage{Topic: "statistics", Value: sarama.StringEncoder("stats")})
+			sent <- struct{}{}
+		}()
+	}
+	time.Sleep(10 * time.Millisecond) // let the senders block on the producer
+
+	closed := make(chan error)
+	go func() { closed <- s.Close() }()
+	select {
+	case err = <-closed:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Close() is blocked by senders waiting on the producer")
+	}
+	for range senders {
+		<-sent
+	}
+	if s.journal.records != senders {
+		t.Errorf("journaled %d messages, want %d", s.journal.records, senders)
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	s := &deliverySupervisor{retryBackoff: 500 * time.Millisecond}
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{0, 500 * time.Millisecond},
+		{1, time.Second},
+		{4, 8 * time.Second},
+		{9, 256 * time.Second},
+		{10, maxRetryBackoff},
+		{40, maxRetryBackoff},
+		{64, maxRetryBackoff},
+		{1000, maxRetryBackoff},
+	}
+	for _, test := range tests {
+		if got := s.retryBackoffFor(test.attempts); got != test.want {
+			t.Errorf("retryBackoffFor(%d) = %s, want %s", test.attempts, got, test.want)
+		}
+	}
+	s.retryBackoff = time.Hour
+	if got := s.retryBackoffFor(0); got != maxRetryBackoff {
+		t.Errorf("a configured backoff longer than the maximum gave %s", got)
+	}
+}
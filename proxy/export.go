@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"pacproxy/shared/mongoutils"
+	"pacproxy/shared/statistics"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+)
+
+// Export formats, by content type
+const (
+	exportFormatCSV    string = "text/csv"
+	exportFormatNDJSON string = "application/x-ndjson"
+)
+
+// Rows written between flushes of an export
+const exportFlushRows int = 100
+
+// Count maps of KeyStats, exported as one CSV column per key
+var exportCountMaps = []string{"boxTypes", "statusCodes", "errorClasses", "errorCategories"}
+
+// Columns of a CSV export before those of the count maps, and how to read them
+var exportColumns = []struct {
+	name  string
+	value func(*statistics.KeyStatsBucket) string
+}{
+	{"usedKeystem", func(b *statistics.KeyStatsBucket) string { return escapeCSVCell(b.UsedKeystem) }},
+	{"totalRequests", func(b *statistics.KeyStatsBucket) string { return strconv.Itoa(b.TotalRequests) }},
+	{"totalItems", func(b *statistics.KeyStatsBucket) string { return strconv.Itoa(b.TotalItems) }},
+	{"totalVolume", func(b *statistics.KeyStatsBucket) string { return formatFloat(b.TotalVolume) }},
+	{"avgItemsPerPack", func(b *statistics.KeyStatsBucket) string { return formatFloat(b.AvgItemsPerPack) }},
+	{"avgVolumeUtilization", func(b *statistics.KeyStatsBucket) string { return formatFloat(b.AvgVolumeUtilization) }},
+	{"packCount", func(b *statistics.KeyStatsBucket) string { return strconv.Itoa(b.PackCount) }},
+	{"totalCost", func(b *statistics.KeyStatsBucket) string { return strconv.Itoa(b.TotalCost) }},
+	{"avgCostPerPack", func(b *statistics.KeyStatsBucket) string { return formatFloat(b.AvgCostPerPack) }},
+	{"totalWeight", func(b *statistics.KeyStatsBucket) string { return formatFloat(b.TotalWeight) }},
+	{"avgWeightUtilization", func(b *statistics.KeyStatsBucket) string { return formatFloat(b.AvgWeightUtilization) }},
+	{"totalBoxes", func(b *statistics.KeyStatsBucket) string { return strconv.Itoa(b.TotalBoxes) }},
+	{"avgBoxesPerPack", func(b *statistics.KeyStatsBucket) string { return formatFloat(b.AvgBoxesPerPack) }},
+	{"totalLeftovers", func(b *statistics.KeyStatsBucket) string { return strconv.Itoa(b.TotalLeftovers) }},
+	{"leftoverRate", func(b *statistics.KeyStatsBucket) string { return formatFloat(b.LeftoverRate) }},
+	{"dimWeightBoxes", func(b *statistics.KeyStatsBucket) string { return strconv.Itoa(b.DimWeightBoxes) }},
+	{"dimWeightRate", func(b *statistics.KeyStatsBucket) string { return formatFloat(b.DimWeightRate) }},
+	{"avgPackTime", func(b *statistics.KeyStatsBucket) string { return formatFloat(b.AvgPackTime) }},
+	{"requestErrorCount", func(b *statistics.KeyStatsBucket) string { return strconv.Itoa(b.RequestErrorCount) }},
+	{"errorCount", func(b *statistics.KeyStatsBucket) string { return strconv.Itoa(b.ErrorResponseCount) }},
+	{"errorRate", func(b *statistics.KeyStatsBucket) string { return formatFloat(b.ErrorRate) }},
+	{"cacheHits", func(b *statistics.KeyStatsBucket) string { return strconv.Itoa(b.CacheHits) }},
+	{"duplicateCount", func(b *statistics.KeyStatsBucket) string { return strconv.Itoa(b.DuplicateCount) }},
+	{"retryCount", func(b *statistics.KeyStatsBucket) string { return strconv.Itoa(b.RetryCount) }},
+	{"circuitOpenCount", func(b *statistics.KeyStatsBucket) string { return strconv.Itoa(b.CircuitOpenCount) }},
+	{"avgLatency", func(b *statistics.KeyStatsBucket) string { return formatFloat(b.AvgLatency) }},
+	{"maxLatency", func(b *statistics.KeyStatsBucket) string { return formatFloat(b.HighestLatency.Latency) }},
+	{"p50Latency", func(b *statistics.KeyStatsBucket) string { return formatFloat(b.LatencyPercentiles.P50) }},
+	{"p90Latency", func(b *statistics.KeyStatsBucket) string { return formatFloat(b.LatencyPercentiles.P90) }},
+	{"p95Latency", func(b *statistics.KeyStatsBucket) string { return formatFloat(b.LatencyPercentiles.P95) }},
+	{"p99Latency", func(b *statistics.KeyStatsBucket) string { return formatFloat(b.LatencyPercentiles.P99) }},
+}
+
+// exportFormat() picks the format of an export from the format query parameter (csv or ndjson), or else
+// from the Accept header. CSV is the default. "" is returned if no supported format was asked for.
+func exportFormat(c *gin.Context) string {
+	switch c.Query("format") {
+	case "csv":
+		return exportFormatCSV
+	case "ndjson":
+		return exportFormatNDJSON
+	case "":
+		return c.NegotiateFormat(exportFormatCSV, exportFormatNDJSON)
+	}
+	return ""
+}
+
+// writeExport() streams the statistics of a query to the response in the given format. Once the first
+// row is written the status can't change, so later errors end the export early and are returned.
+func writeExport(c *gin.Context, mongoClient *mongo.Client, query *mongoutils.ExportQuery, format string) error {
+	mapKeys := func() (map[string][]string, error) {
+		return mongoutils.KeyStatsMapKeys(c.Request.Context(), mongoClient, query, exportCountMaps)
+	}
+	stream := func(fn func(*statistics.KeyStatsBucket) error) error {
+		return mongoutils.StreamKeyStats(c.Request.Context(), mongoClient, query, fn)
+	}
+	return streamExport(c, query, format, mapKeys, stream)
+}
+
+// streamExport() writes an export of the statistics passed by stream, reading the keys of the count maps
+// from mapKeys for CSV exports. Every exportFlushRows rows are flushed to the client.
+func streamExport(c *gin.Context, query *mongoutils.ExportQuery, format string, getMapKeys func() (map[string][]string, error),
+	stream func(func(*statistics.KeyStatsBucket) error) error) error {
+	var header []string
+	var mapKeys map[string][]string
+	if format == exportFormatCSV {
+		var err error
+		mapKeys, err = getMapKeys()
+		if err != nil {
+			c.JSON(500, ErrorResponse{fmt.Errorf("error encountered while exporting stats: %s", err).Error()})
+			return err
+		}
+		header = exportHeader(query, mapKeys)
+	}
+
+	extension := map[string]string{exportFormatCSV: "csv", exportFormatNDJSON: "ndjson"}[format]
+	c.Header("Content-Type", format)
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=\"keystats.%s\"", extension))
+	c.Status(200)
+	var write func(*statistics.KeyStatsBucket) error
+	var flush func() error
+	if format == exportFormatCSV {
+		w := csv.NewWriter(c.Writer)
+		if err := w.Write(header); err != nil {
+			return err
+		}
+		write = func(bucket *statistics.KeyStatsBucket) error {
+			return w.Write(exportRow(query, mapKeys, bucket))
+		}
+		flush = func() error {
+			w.Flush()
+			return w.Error()
+		}
+	} else {
+		encoder := json.NewEncoder(c.Writer)
+		write = func(bucket *statistics.KeyStatsBucket) error {
+			if query.Granularity == "" {
+				return encoder.Encode(&bucket.KeyStats)
+			}
+			return encoder.Encode(bucket)
+		}
+		flush = func() error { return nil }
+	}
+
+	rows := 0
+	err := stream(func(bucket *statistics.KeyStatsBucket) error {
+		if err := write(bucket); err != nil {
+			return err
+		}
+		rows++
+		if rows%exportFlushRows == 0 {
+			if err := flush(); err != nil {
+				return err
+			}
+			c.Writer.Flush()
+		}
+		return nil
+	})
+	if flushErr := flush(); err == nil {
+		err = flushErr
+	}
+	c.Writer.Flush()
+	return err
+}
+
+// exportHeader() returns the columns of a CSV export. Count maps get one column per key, named
+// like boxTypes.<key>.
+func exportHeader(query *mongoutils.ExportQuery, mapKeys map[string][]string) []string {
+	var header []string
+	if query.Granularity != "" {
+		header = append(header, "granularity", "start")
+	}
+	for _, column := range exportColumns {
+		header = append(header, column.name)
+	}
+	for _, field := range exportCountMaps {
+		for _, key := range mapKeys[field] {
+			header = append(header, field+"."+key)
+		}
+	}
+	return header
+}
+
+// exportRow() returns the CSV row of one keystem's statistics
+func exportRow(query *mongoutils.ExportQuery, mapKeys map[string][]string, bucket *statistics.KeyStatsBucket) []string {
+	var row []string
+	if query.Granularity != "" {
+		row = append(row, bucket.Granularity, bucket.Start.UTC().Format(time.RFC3339))
+	}
+	for _, column := range exportColumns {
+		row = append(row, column.value(bucket))
+	}
+	counts := map[string]map[string]int{
+		"boxTypes":        bucket.BoxTypes,
+		"statusCodes":     bucket.StatusCodes,
+		"errorClasses":    bucket.ErrorClasses,
+		"errorCategories": bucket.ErrorCategories,
+	}
+	for _, field := range exportCountMaps {
+		for _, key := range mapKeys[field] {
+			row = append(row, strconv.Itoa(counts[field][key]))
+		}
+	}
+	return row
+}
+
+// escapeCSVCell() prefixes a cell holding text from clients with ' if it starts like a formula, so that
+// spreadsheets opening the export show it as text instead of evaluating it
+func escapeCSVCell(cell string) string {
+	if cell != "" && strings.ContainsRune("=+-@\t\r", rune(cell[0])) {
+		return "'" + cell
+	}
+	return cell
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"pacproxy/shared/mongoutils"
+	"pacproxy/shared/statistics"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestExportFormat(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	tests := []struct {
+		name   string
+		query  string
+		accept string
+		want   string
+	}{
+		{"default", "", "", exportFormatCSV},
+		{"any", "", "*/*", exportFormatCSV},
+		{"csv parameter", "?format=csv", "application/x-ndjson", exportFormatCSV},
+		{"ndjson parameter", "?format=ndjson", "text/csv", exportFormatNDJSON},
+		{"csv accepted", "", "text/csv", exportFormatCSV},
+		{"ndjson accepted", "", "application/x-ndjson", exportFormatNDJSON},
+		{"first acceptable", "", "application/x-ndjson, text/csv", exportFormatNDJSON},
+		{"unknown parameter", "?format=xml", "", ""},
+		{"nothing acceptable", "", "application/xml", ""},
+	}
+	for _, test := range tests {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest("GET", "/api/export/keydata"+test.query, nil)
+		if test.accept != "" {
+			c.Request.Header.Set("Accept", test.accept)
+		}
+		if got := exportFormat(c); got != test.want {
+			t.Errorf("%s: exportFormat() = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func testExportBucket(keystem string, start time.Time) *statistics.KeyStatsBucket {
+	bucket := &statistics.KeyStatsBucket{Granularity: statistics.GranularityHour, Start: start, KeyStats: *statistics.NewKeyStats(keystem)}
+	bucket.TotalRequests = 3
+	bucket.StatusCodes["200"] = 2
+	bucket.StatusCodes["500"] = 1
+	bucket.BoxTypes["small"] = 4
+	return bucket
+}
+
+// Response recorder counting the flushes of a response
+type flushRecorder struct {
+	*httptest.ResponseRecorder
+	flushes int
+}
+
+func (recorder *flushRecorder) Flush() {
+	recorder.flushes++
+	recorder.ResponseRecorder.Flush()
+}
+
+// runExport() exports the buckets in the given format, calling check after each row is passed to the export
+func runExport(query *mongoutils.ExportQuery, format string, mapKeys map[string][]string, buckets []*statistics.KeyStatsBucket,
+	check func(row int, recorder *flushRecorder)) (*flushRecorder, error) {
+	recorder := &flushRecorder{ResponseRecorder: httptest.NewRecorder()}
+	c, _ := gin.CreateTestContext(recorder)
+	c.Request = httptest.NewRequest("GET", "/api/export/keydata", nil)
+	getMapKeys := func() (map[string][]string, error) { return mapKeys, nil }
+	stream := func(fn func(*statistics.KeyStatsBucket) error) error {
+		for i, bucket := range buckets {
+			if err := fn(bucket); err != nil {
+				return err
+			}
+			if check != nil {
+				check(i+1, recorder)
+			}
+		}
+		return nil
+	}
+	err := streamExport(c, query, format, getMapKeys, stream)
+	return recorder, err
+}
+
+func TestExportColumns(t *testing.T) {
+	start := time.Date(2025, 3, 25, 10, 0, 0, 0, time.UTC)
+	mapKeys := map[string][]string{"statusCodes": {"200", "500"}, "boxTypes": {"large", "small"}}
+	query := &mongoutils.ExportQuery{Granularity: statistics.GranularityHour}
+	recorder, err := runExport(query, exportFormatCSV, mapKeys, []*statistics.KeyStatsBucket{testExportBucket("=cmd|' /C calc'!A0", start)}, nil)
+	if err != nil {
+		t.Fatalf("export failed: %s", err)
+	}
+	if recorder.Header().Get("Content-Type") != exportFormatCSV {
+		t.Errorf("content type %s", recorder.Header().Get("Content-Type"))
+	}
+	records, err := csv.NewReader(recorder.Body).ReadAll()
+	if err != nil || len(records) != 2 {
+		t.Fatalf("export isn't a header and a row: %v %s", records, err)
+	}
+	header, row := records[0], records[1]
+
+	// Scalar columns in their fixed order, then the count map keys in the order of exportCountMaps
+	want := []string{"granularity", "start"}
+	for _, column := range exportColumns {
+		want = append(want, column.name)
+	}
+	want = append(want, "boxTypes.large", "boxTypes.small", "statusCodes.200", "statusCodes.500")
+	if !slices.Equal(header, want) {
+		t.Errorf("header %v, want %v", header, want)
+	}
+	values := map[string]string{
+		"granularity":     statistics.GranularityHour,
+		"start":           "2025-03-25T10:00:00Z",
+		"usedKeystem":     "'=cmd|' /C calc'!A0",
+		"totalRequests":   "3",
+		"boxTypes.large":  "0",
+		"boxTypes.small":  "4",
+		"statusCodes.200": "2",
+		"statusCodes.500": "1",
+	}
+	for column, value := range values {
+		if i := slices.Index(header, column); i < 0 || row[i] != value {
+			t.Errorf("column %s holds %v, want %s", column, row, value)
+		}
+	}
+
+	// Exports of the summaries have no bucket columns
+	recorder, _ = runExport(&mongoutils.ExportQuery{}, exportFormatCSV, nil, nil, nil)
+	if header, _ := csv.NewReader(recorder.Body).Read(); header[0] != "usedKeystem" {
+		t.Errorf("summary export header %v", header)
+	}
+}
+
+func TestEscapeCSVCell(t *testing.T) {
+	tests := map[string]string{
+		"keystem":   "keystem",
+		"":          "",
+		"=SUM(A1)":  "'=SUM(A1)",
+		"+1":        "'+1",
+		"-1":        "'-1",
+		"@cmd":      "'@cmd",
+		"\tcmd":     "'\tcmd",
+		"key=stem":  "key=stem",
+		"'=SUM(A1)": "'=SUM(A1)",
+	}
+	for cell, want := range tests {
+		if got := escapeCSVCell(cell); got != want {
+			t.Errorf("escapeCSVCell(%q) = %q, want %q", cell, got, want)
+		}
+	}
+}
+
+func TestExportStreaming(t *testing.T) {
+	start := time.Date(2025, 3, 25, 10, 0, 0, 0, time.UTC)
+	var buckets []*statistics.KeyStatsBucket
+	for i := 0; i < 2*exportFlushRows+10; i++ {
+		buckets = append(buckets, testExportBucket(fmt.Sprintf("keystem-%03d", i), start))
+	}
+	for _, format := range []string{exportFormatCSV, exportFormatNDJSON} {
+		headerLines := map[string]int{exportFormatCSV: 1, exportFormatNDJSON: 0}[format]
+		// The rows must reach the client in batches while the stream is still being read
+		check := func(row int, recorder *flushRecorder) {
+			lines := strings.Count(recorder.Body.String(), "\n")
+			flushed := row - row%exportFlushRows
+			if recorder.flushes != row/exportFlushRows || (flushed > 0 && lines < flushed+headerLines) {
+				t.Errorf("%s: %d flushes and %d lines written after %d rows, want %d and %d", format, recorder.flushes, lines, row,
+					row/exportFlushRows, flushed+headerLines)
+			}
+		}
+		recorder, err := runExport(&mongoutils.ExportQuery{}, format, nil, buckets, check)
+		if err != nil {
+			t.Errorf("%s: export failed: %s", format, err)
+		}
+		if lines := strings.Count(recorder.Body.String(), "\n"); lines != len(buckets)+headerLines {
+			t.Errorf("%s: %d lines exported, want %d", format, lines, len(buckets)+headerLines)
+		}
+		if recorder.flushes != len(buckets)/exportFlushRows+1 {
+			t.Errorf("%s: export flushed %d times", format, recorder.flushes)
+		}
+		if format == exportFormatNDJSON {
+			var keyStats statistics.KeyStats
+			line, _, _ := strings.Cut(recorder.Body.String(), "\n")
+			if err := json.Unmarshal([]byte(line), &keyStats); err != nil || keyStats.UsedKeystem != "keystem-000" {
+				t.Errorf("ndjson line %s", line)
+			}
+		}
+	}
+
+	// A failure partway ends the export with what was written
+	recorder := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(recorder)
+	c.Request = httptest.NewRequest("GET", "/api/export/keydata", nil)
+	failure := errors.New("cursor failed")
+	stream := func(fn func(*statistics.KeyStatsBucket) error) error {
+		fn(buckets[0])
+		return failure
+	}
+	err := streamExport(c, &mongoutils.ExportQuery{}, exportFormatNDJSON, nil, stream)
+	if err != failure || recorder.Code != 200 || strings.Count(recorder.Body.String(), "\n") != 1 {
+		t.Errorf("failed export returned %v with status %d and body %s", err, recorder.Code, recorder.Body)
+	}
+}
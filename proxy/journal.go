@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/IBM/sarama"
+)
+
+// journal is an append-only file of messages that couldn't be delivered to Kafka.
+// Replaying moves the journal aside to a replay file, which is only removed once every
+// replayed message has been acknowledged or journaled again.
+type journal struct {
+	mu      sync.Mutex
+	path    string
+	file    *os.File
+	records int
+}
+
+type journalRecord struct {
+	Topic   string          `json:"topic"`
+	Key     []byte          `json:"key,omitempty"`
+	Value   []byte          `json:"value"`
+	Headers []journalHeader `json:"headers,omitempty"`
+}
+
+type journalHeader struct {
+	Key   []byte `json:"key"`
+	Value []byte `json:"value"`
+}
+
+// openJournal() opens the journal at path, recovering records from an unfinished replay
+func openJournal(path string) (*journal, error) {
+	j := &journal{path: path}
+	replayed, err := readJournalFile(j.replayPath())
+	if err != nil {
+		return nil, err
+	}
+	existing, err := readJournalFile(path)
+	if err != nil {
+		return nil, err
+	}
+	j.file, err = os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	j.records = len(existing)
+	for _, record := range replayed {
+		if err = j.appendRecord(record); err != nil {
+			j.file.Close()
+			return nil, err
+		}
+	}
+	if err = os.Remove(j.replayPath()); err != nil && !errors.Is(err, os.ErrNotExist) {
+		j.file.Close()
+		return nil, err
+	}
+	return j, nil
+}
+
+// Append() durably writes a message to the journal
+func (j *journal) Append(msg *sarama.ProducerMessage) error {
+	record := journalRecord{Topic: msg.Topic}
+	var err error
+	if msg.Key != nil {
+		if record.Key, err = msg.Key.Encode(); err != nil {
+			return err
+		}
+	}
+	if msg.Value != nil {
+		if record.Value, err = msg.Value.Encode(); err != nil {
+			return err
+		}
+	}
+	for _, header := range msg.Headers {
+		record.Headers = append(record.Headers, journalHeader{Key: header.Key, Value: header.Value})
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.appendRecord(record)
+}
+
+// Len() returns the number of messages waiting in the journal
+func (j *journal) Len() int {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.records
+}
+
+// StartReplay() moves the journal aside and returns its messages so they can be resent.
+// FinishReplay() must be called once they have all been acknowledged or journaled again.
+func (j *journal) StartReplay() ([]*sarama.ProducerMessage, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.records == 0 {
+		return nil, nil
+	}
+	err := j.file.Close()
+	if err != nil {
+		return nil, err
+	}
+	err = os.Rename(j.path, j.replayPath())
+	if err != nil {
+		return nil, err
+	}
+	j.file, err = os.OpenFile(j.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	j.records = 0
+
+	records, err := readJournalFile(j.replayPath())
+	if err != nil {
+		return nil, err
+	}
+	messages := make([]*sarama.ProducerMessage, 0, len(records))
+	for _, record := range records {
+		msg := &sarama.ProducerMessage{
+			Topic: record.Topic,
+			Value: sarama.ByteEncoder(record.Value),
+		}
+		if record.Key != nil {
+			msg.Key = sarama.ByteEncoder(record.Key)
+		}
+		for _, header := range record.Headers {
+			msg.Headers = append(msg.Headers, sarama.RecordHeader{Key: header.Key, Value: header.Value})
+		}
+		messages = append(messages, msg)
+	}
+	return messages, nil
+}
+
+// FinishReplay() removes the replay file
+func (j *journal) FinishReplay() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	err := os.Remove(j.replayPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+func (j *journal) Close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.file.Close()
+}
+
+func (j *journal) replayPath() string {
+	return j.path + ".replay"
+}
+
+// appendRecord() writes and syncs one record. The caller must hold the lock.
+func (j *journal) appendRecord(record journalRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	_, err = j.file.Write(append(line, '\n'))
+	if err != nil {
+		return err
+	}
+	err = j.file.Sync()
+	if err != nil {
+		return err
+	}
+	j.records++
+	return nil
+}
+
+// readJournalFile() reads every record in a journal file. A missing file holds no records.
+func readJournalFile(path string) ([]journalRecord, error) {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var records []journalRecord
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 && line[len(line)-1] == '\n' {
+			var record journalRecord
+			if jsonErr := json.Unmarshal(line, &record); jsonErr == nil {
+				records = append(records, record)
+			}
+			// A line that doesn't decode was torn by a crash mid-write and is skipped
+		}
+		if err == io.EOF {
+			return records, nil
+		} else if err != nil {
+			return nil, err
+		}
+	}
+}
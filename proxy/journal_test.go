@@ -0,0 +1,75 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/IBM/sarama"
+)
+
+func TestJournalReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal.jsonl")
+	j, err := openJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := &sarama.ProducerMessage{
+		Topic:   "statistics",
+		Key:     sarama.StringEncoder("keystem"),
+		Value:   sarama.StringEncoder(`{"usedKeystem":"keystem"}`),
+		Headers: []sarama.RecordHeader{{Key: []byte("type"), Value: []byte("stats")}},
+	}
+	for range 2 {
+		if err = j.Append(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	messages, err := j.StartReplay()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 2 || j.Len() != 0 {
+		t.Fatalf("replaying returned %d messages and left %d, want 2 and 0", len(messages), j.Len())
+	}
+	replayed := messages[0]
+	key, _ := replayed.Key.Encode()
+	value, _ := replayed.Value.Encode()
+	if replayed.Topic != "statistics" || string(key) != "keystem" || string(value) != `{"usedKeystem":"keystem"}` ||
+		len(replayed.Headers) != 1 || string(replayed.Headers[0].Value) != "stats" {
+		t.Errorf("replayed message %+v differs from the journaled one", replayed)
+	}
+
+	// A replay that didn't finish is recovered when the journal is opened again
+	if err = j.Append(msg); err != nil {
+		t.Fatal(err)
+	}
+	j.Close()
+	j, err = openJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+	if j.Len() != 3 {
+		t.Errorf("reopened journal holds %d messages, want 3", j.Len())
+	}
+	if _, err = os.Stat(j.replayPath()); !os.IsNotExist(err) {
+		t.Errorf("replay file wasn't removed: %v", err)
+	}
+}
+
+func TestJournalSkipsTornRecords(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal.jsonl")
+	content := `{"topic":"statistics","value":"e30="}` + "\n" + `{"topic":"stat` + "\n" + `{"topic":"statistics","val`
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	records, err := readJournalFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || string(records[0].Value) != "{}" {
+		t.Errorf("read %+v, want the one complete record", records)
+	}
+}
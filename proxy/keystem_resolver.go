@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"pacproxy/shared/mongoutils"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/mongo"
+)
+
+// How long a credential without a learned keystem is remembered as unknown, before it's looked up again
+const unknownCredentialTTL time.Duration = time.Minute
+
+// Credentials remembered before the least recently used ones are forgotten
+const maxKnownCredentials int = 10000
+
+// keystemResolver attributes a request to a keystem before it's forwarded, from the keystem learned for
+// its Authorization header or, failing that, from its X-Keystem header. Credentials are only stored as
+// hashes, in memory and in the database.
+type keystemResolver struct {
+	load  func(ctx context.Context, hash string) (string, error) // "" if no keystem was learned for the hash
+	store func(ctx context.Context, hash string, keystem string) error
+	mu    sync.Mutex
+	known *lru[string] // keystems by credential hash, "" for credentials without a learned keystem
+}
+
+func newKeystemResolver(mongoClient *mongo.Client) *keystemResolver {
+	return &keystemResolver{
+		load: func(ctx context.Context, hash string) (string, error) {
+			return mongoutils.GetCredentialKeystem(ctx, mongoClient, hash)
+		},
+		store: func(ctx context.Context, hash string, keystem string) error {
+			return mongoutils.SetCredentialKeystem(ctx, mongoClient, hash, keystem)
+		},
+		known: newLRU[string](maxKnownCredentials),
+	}
+}
+
+// resolve() returns the keystem of a request, and whether it was learned from the request's credentials
+// rather than claimed by the caller. "" is returned if the keystem is unknown.
+func (r *keystemResolver) resolve(req *http.Request) (string, bool) {
+	if authorization := req.Header.Get("Authorization"); authorization != "" {
+		keystem, err := r.lookup(req.Context(), credentialHash(authorization))
+		if err != nil {
+			slog.Error(fmt.Errorf("error occurred looking up the keystem of a credential: %s", err).Error())
+		} else if keystem != "" {
+			return keystem, true
+		}
+	}
+	return strings.TrimSpace(req.Header.Get("X-Keystem")), false
+}
+
+// learn() remembers the keystem Paccurate used for a credential, storing it in the database if it changed
+func (r *keystemResolver) learn(authorization string, keystem string) {
+	if authorization == "" || keystem == "" {
+		return
+	}
+	hash := credentialHash(authorization)
+	r.mu.Lock()
+	previous, _ := r.known.get(hash)
+	r.known.set(hash, keystem, 0)
+	r.mu.Unlock()
+	if previous == keystem {
+		return
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		err := r.store(ctx, hash, keystem)
+		if err != nil {
+			slog.Error(fmt.Errorf("error occurred storing the keystem of a credential: %s", err).Error())
+		}
+	}()
+}
+
+// lookup() returns the keystem learned for a credential hash, from memory or else from the database
+func (r *keystemResolver) lookup(ctx context.Context, hash string) (string, error) {
+	r.mu.Lock()
+	keystem, found := r.known.get(hash)
+	r.mu.Unlock()
+	if found {
+		return keystem, nil
+	}
+
+	keystem, err := r.load(ctx, hash)
+	if err != nil {
+		return "", err
+	}
+	r.mu.Lock()
+	// Don't overwrite a keystem learned in the meantime
+	if current, _ := r.known.get(hash); current == "" {
+		if keystem == "" {
+			r.known.set(hash, "", unknownCredentialTTL)
+		} else {
+			r.known.set(hash, keystem, 0)
+		}
+	}
+	r.mu.Unlock()
+	return keystem, nil
+}
+
+func credentialHash(authorization string) string {
+	sum := sha256.Sum256([]byte(authorization))
+	return hex.EncodeToString(sum[:])
+}
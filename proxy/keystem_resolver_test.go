@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Credential keystems stored in memory, as the database would hold them
+type testCredentialStore struct {
+	mu       sync.Mutex
+	keystems map[string]string // by credential hash
+	loads    int
+	stored   chan string
+}
+
+func newTestResolver(capacity int) (*keystemResolver, *testCredentialStore) {
+	store := &testCredentialStore{keystems: make(map[string]string), stored: make(chan string, 10)}
+	r := &keystemResolver{
+		load: func(ctx context.Context, hash string) (string, error) {
+			store.mu.Lock()
+			defer store.mu.Unlock()
+			store.loads++
+			if hash == credentialHash("broken") {
+				return "", errors.New("database unavailable")
+			}
+			return store.keystems[hash], nil
+		},
+		store: func(ctx context.Context, hash string, keystem string) error {
+			store.mu.Lock()
+			store.keystems[hash] = keystem
+			store.mu.Unlock()
+			store.stored <- keystem
+			return nil
+		},
+		known: newLRU[string](capacity),
+	}
+	return r, store
+}
+
+func (store *testCredentialStore) loadCount() int {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	return store.loads
+}
+
+func resolveRequest(r *keystemResolver, authorization string, claimed string) (string, bool) {
+	req := httptest.NewRequest("POST", "/", nil)
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+	if claimed != "" {
+		req.Header.Set("X-Keystem", claimed)
+	}
+	return r.resolve(req)
+}
+
+func TestKeystemResolver(t *testing.T) {
+	r, store := newTestResolver(10)
+	store.keystems[credentialHash("stored")] = "stored-keystem"
+	r.learn("learned", "learned-keystem")
+	if keystem := <-store.stored; keystem != "learned-keystem" {
+		t.Errorf("stored keystem %q", keystem)
+	}
+
+	tests := []struct {
+		name            string
+		authorization   string
+		claimed         string
+		keystem         string
+		fromCredentials bool
+	}{
+		{"learned", "learned", "", "learned-keystem", true},
+		{"learned over claimed", "learned", "claimed", "learned-keystem", true},
+		{"stored", "stored", "claimed", "stored-keystem", true},
+		{"unknown credential", "unknown", " claimed ", "claimed", false},
+		{"lookup failure", "broken", "claimed", "claimed", false},
+		{"no credential", "", "claimed", "claimed", false},
+		{"nothing", "", "", "", false},
+	}
+	for _, test := range tests {
+		keystem, fromCredentials := resolveRequest(r, test.authorization, test.claimed)
+		if keystem != test.keystem || fromCredentials != test.fromCredentials {
+			t.Errorf("%s: resolve() = %q, %v, want %q, %v", test.name, keystem, fromCredentials, test.keystem, test.fromCredentials)
+		}
+	}
+
+	// Learning the same keystem again doesn't store it again
+	r.learn("learned", "learned-keystem")
+	r.learn("learned", "moved-keystem")
+	if keystem := <-store.stored; keystem != "moved-keystem" {
+		t.Errorf("stored keystem %q, want the changed one", keystem)
+	}
+	if keystem, _ := resolveRequest(r, "learned", ""); keystem != "moved-keystem" {
+		t.Errorf("resolved %q after the keystem changed", keystem)
+	}
+}
+
+func TestKeystemResolverMemory(t *testing.T) {
+	r, store := newTestResolver(2)
+	store.keystems[credentialHash("a")] = "keystem-a"
+	store.keystems[credentialHash("b")] = "keystem-b"
+	store.keystems[credentialHash("c")] = "keystem-c"
+
+	// Known credentials are resolved from memory
+	resolveRequest(r, "a", "")
+	resolveRequest(r, "b", "")
+	resolveRequest(r, "a", "")
+	if loads := store.loadCount(); loads != 2 {
+		t.Errorf("%d lookups for 2 credentials", loads)
+	}
+
+	// Past capacity, the least recently used credential is forgotten and looked up again
+	resolveRequest(r, "c", "")
+	resolveRequest(r, "a", "")
+	if loads := store.loadCount(); loads != 3 {
+		t.Errorf("%d lookups, want a still remembered", loads)
+	}
+	if keystem, _ := resolveRequest(r, "b", ""); keystem != "keystem-b" || store.loadCount() != 4 {
+		t.Errorf("evicted credential resolved to %q after %d lookups", keystem, store.loadCount())
+	}
+
+	// Credentials without a keystem are remembered as unknown for a while, then looked up again
+	r, store = newTestResolver(10)
+	resolveRequest(r, "unknown", "")
+	resolveRequest(r, "unknown", "")
+	if loads := store.loadCount(); loads != 1 {
+		t.Errorf("%d lookups of an unknown credential, want 1", loads)
+	}
+	r.known.set(credentialHash("unknown"), "", time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	store.keystems[credentialHash("unknown")] = "found-keystem"
+	if keystem, _ := resolveRequest(r, "unknown", ""); keystem != "found-keystem" || store.loadCount() != 2 {
+		t.Errorf("expired unknown credential resolved to %q after %d lookups", keystem, store.loadCount())
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+)
+
+// lruCache is an in-process cache that evicts the least recently used entry when full
+type lruCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries *lru[*CachedResponse]
+}
+
+func newLRUCache(capacity int, ttl time.Duration) *lruCache {
+	return &lruCache{ttl: ttl, entries: newLRU[*CachedResponse](capacity)}
+}
+
+func (c *lruCache) Get(ctx context.Context, key string) (*CachedResponse, bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	resp, found := c.entries.get(key)
+	return resp, found, nil
+}
+
+func (c *lruCache) Set(ctx context.Context, key string, resp *CachedResponse) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries.set(key, resp, c.ttl)
+	return nil
+}
+
+func (c *lruCache) Close() error {
+	return nil
+}
+
+// lru holds up to capacity values, evicting the least recently used one when full, and expired ones when
+// they're read. It isn't safe for concurrent use.
+type lru[V any] struct {
+	capacity int        // 0 for no limit
+	order    *list.List // front is most recently used
+	entries  map[string]*list.Element
+}
+
+type lruEntry[V any] struct {
+	key       string
+	value     V
+	expiresAt time.Time // zero if the entry doesn't expire
+}
+
+func newLRU[V any](capacity int) *lru[V] {
+	return &lru[V]{capacity: capacity, order: list.New(), entries: make(map[string]*list.Element)}
+}
+
+// get() returns the value of a key if it's present and hasn't expired
+func (l *lru[V]) get(key string) (V, bool) {
+	var zero V
+	elem, found := l.entries[key]
+	if !found {
+		return zero, false
+	}
+	entry := elem.Value.(*lruEntry[V])
+	if !entry.expiresAt.IsZero() && time.Now().After(entry.expiresAt) {
+		l.order.Remove(elem)
+		delete(l.entries, key)
+		return zero, false
+	}
+	l.order.MoveToFront(elem)
+	return entry.value, true
+}
+
+// set() stores the value of a key for ttl, or until it's evicted if ttl is 0
+func (l *lru[V]) set(key string, value V, ttl time.Duration) {
+	var expiresAt time.Time
+	if ttl > 0 {
+		expiresAt = time.Now().Add(ttl)
+	}
+	if elem, found := l.entries[key]; found {
+		entry := elem.Value.(*lruEntry[V])
+		entry.value = value
+		entry.expiresAt = expiresAt
+		l.order.MoveToFront(elem)
+		return
+	}
+	l.entries[key] = l.order.PushFront(&lruEntry[V]{key: key, value: value, expiresAt: expiresAt})
+	for l.capacity > 0 && l.order.Len() > l.capacity {
+		oldest := l.order.Back()
+		l.order.Remove(oldest)
+		delete(l.entries, oldest.Value.(*lruEntry[V]).key)
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestLRUEvictsLeastRecentlyUsed(t *testing.T) {
+	l := newLRU[string](2)
+	l.set("a", "1", 0)
+	l.set("b", "2", 0)
+	l.get("a")
+	l.set("c", "3", 0)
+
+	tests := []struct {
+		key   string
+		value string
+		found bool
+	}{
+		{"a", "1", true},
+		{"b", "", false},
+		{"c", "3", true},
+	}
+	for _, test := range tests {
+		value, found := l.get(test.key)
+		if value != test.value || found != test.found {
+			t.Errorf("get(%q) = %q, %v, want %q, %v", test.key, value, found, test.value, test.found)
+		}
+	}
+	if l.order.Len() != 2 || len(l.entries) != 2 {
+		t.Errorf("holds %d entries, want 2", l.order.Len())
+	}
+}
+
+func TestLRUDropsExpiredEntries(t *testing.T) {
+	l := newLRU[string](0)
+	l.set("unknown", "", time.Millisecond)
+	l.set("known", "keystem", 0)
+	time.Sleep(5 * time.Millisecond)
+
+	if _, found := l.get("unknown"); found {
+		t.Error("expired entry was returned")
+	}
+	if _, found := l.entries["unknown"]; found {
+		t.Error("expired entry was kept after being read")
+	}
+	if value, found := l.get("known"); !found || value != "keystem" {
+		t.Errorf("get(known) = %q, %v, want an entry that doesn't expire", value, found)
+	}
+}
+
+func TestLRUCacheTTL(t *testing.T) {
+	ctx := context.Background()
+	c := newLRUCache(10, time.Millisecond)
+	c.Set(ctx, "key", &CachedResponse{StatusCode: 200})
+	if _, found, _ := c.Get(ctx, "key"); !found {
+		t.Fatal("fresh response wasn't found")
+	}
+	time.Sleep(5 * time.Millisecond)
+	if _, found, _ := c.Get(ctx, "key"); found {
+		t.Error("expired response was returned")
+	}
+
+	forever := newLRUCache(10, 0)
+	forever.Set(ctx, "key", &CachedResponse{StatusCode: 200})
+	time.Sleep(2 * time.Millisecond)
+	if _, found, _ := forever.Get(ctx, "key"); !found {
+		t.Error("response without a TTL expired")
+	}
+}
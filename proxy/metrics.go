@@ -0,0 +1,61 @@
+package main
+
+import (
+	"pacproxy/shared/metrics"
+	"pacproxy/shared/statistics"
+	"time"
+)
+
+// Metrics exposed on /metrics
+var (
+	metricsRegistry = metrics.NewRegistry()
+
+	requestsTotal = metricsRegistry.NewCounterVec("pacproxy_pack_requests_total",
+		"Pack requests handled, by keystem, upstream status code and whether they were served from the cache.",
+		"keystem", "status", "cache")
+	requestDuration = metricsRegistry.NewHistogramVec("pacproxy_upstream_request_duration_seconds",
+		"Round trip latency of pack requests forwarded to Paccurate, by keystem and upstream status code.",
+		metrics.DefaultBuckets, "keystem", "status")
+	packErrorResponses = metricsRegistry.NewCounterVec("pacproxy_pack_error_responses_total",
+		"Error responses to pack requests from Paccurate, by keystem and error category.",
+		"keystem", "category")
+	rateLimitedRequests = metricsRegistry.NewCounterVec("pacproxy_rate_limited_requests_total",
+		"Pack requests rejected with a 429 because their keystem exceeded proxy.rateLimit, by keystem.",
+		"keystem")
+	upstreamRetries = metricsRegistry.NewCounterVec("pacproxy_upstream_retries_total",
+		"Requests resent to an upstream after a transport error or a 502, 503 or 504, by upstream host.",
+		"upstream")
+	upstreamShortCircuits = metricsRegistry.NewCounterVec("pacproxy_upstream_short_circuits_total",
+		"Requests rejected without calling an upstream because its circuit breaker was open, by upstream host.",
+		"upstream")
+	upstreamErrors = metricsRegistry.NewCounterVec("pacproxy_upstream_errors_total",
+		"Requests that got no response from an upstream, by upstream host and error class (dns, connect, tls, timeout or other).",
+		"upstream", "class")
+	kafkaEnqueueFailures = metricsRegistry.NewCounterVec("pacproxy_kafka_enqueue_failures_total",
+		"Messages that couldn't be enqueued on the Kafka producer, by message type.",
+		"type")
+	kafkaDeliveryFailures = metricsRegistry.NewCounterVec("pacproxy_kafka_delivery_failures_total",
+		"Messages Kafka failed to acknowledge, by what happened next (retried or journaled).",
+		"outcome")
+	journalSize = metricsRegistry.NewGaugeVec("pacproxy_delivery_journal_messages",
+		"Messages waiting in the delivery journal.")
+)
+
+// recordRequestMetrics() counts a pack request, and records its latency if it was forwarded to Paccurate.
+// Metrics are labeled with keystem rather than the request's stats, which may hold one claimed by the caller.
+func recordRequestMetrics(stats *statistics.Stats, keystem string) {
+	requestsTotal.Inc(keystem, stats.StatusCode, cacheLabel(stats.CacheHit))
+	if stats.ErrorCategory != "" {
+		packErrorResponses.Inc(keystem, stats.ErrorCategory)
+	}
+	if !stats.CacheHit {
+		requestDuration.Observe(time.Duration(stats.Latency).Seconds(), keystem, stats.StatusCode)
+	}
+}
+
+func cacheLabel(cacheHit bool) string {
+	if cacheHit {
+		return "hit"
+	}
+	return "miss"
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"pacproxy/shared/statistics"
+	"strings"
+)
+
+// Phrases of Paccurate error messages, by the category of error they point to. Categories are tried in
+// order, so that an item that fits in no box counts as no box fitting rather than as an invalid item.
+var packErrorPhrases = []struct {
+	category string
+	phrases  []string
+}{
+	{statistics.ErrorCategoryAuth, []string{"unauthorized", "forbidden", "api key", "apikey", "authenticat", "permission"}},
+	{statistics.ErrorCategoryQuota, []string{"quota", "rate limit", "too many requests", "limit exceeded"}},
+	{statistics.ErrorCategoryTimeout, []string{"timeout", "timed out", "time limit", "deadline"}},
+	{statistics.ErrorCategoryNoBoxFits, []string{"no box", "not fit", "doesn't fit", "fit in any", "fits in no", "no suitable", "too large", "too big", "exceeds"}},
+	{statistics.ErrorCategoryInvalidItem, []string{"item", "dimension", "weight", "refid", "sku"}},
+}
+
+// analyzePackErrorBody() classifies a Paccurate error response into one of the statistics.ErrorCategory
+// constants, from its status code and the messages of its body. Bodies that aren't JSON are read as text.
+func analyzePackErrorBody(statusCode int, body []byte, stats *statistics.Stats) {
+	switch statusCode {
+	case http.StatusUnauthorized, http.StatusForbidden:
+		stats.ErrorCategory = statistics.ErrorCategoryAuth
+		return
+	case http.StatusTooManyRequests:
+		stats.ErrorCategory = statistics.ErrorCategoryQuota
+		return
+	case http.StatusRequestTimeout, http.StatusGatewayTimeout:
+		stats.ErrorCategory = statistics.ErrorCategoryTimeout
+		return
+	}
+
+	message := strings.ToLower(errorMessageText(body))
+	for _, entry := range packErrorPhrases {
+		for _, phrase := range entry.phrases {
+			if strings.Contains(message, phrase) {
+				stats.ErrorCategory = entry.category
+				return
+			}
+		}
+	}
+	if statusCode >= 500 {
+		stats.ErrorCategory = statistics.ErrorCategoryService
+	} else {
+		stats.ErrorCategory = statistics.ErrorCategoryInvalidRequest
+	}
+}
+
+// errorMessageText() returns the text of every string in a JSON error body, whatever its layout, or the
+// body itself if it isn't JSON
+func errorMessageText(body []byte) string {
+	var payload any
+	if json.Unmarshal(body, &payload) != nil {
+		return string(body)
+	}
+	var text strings.Builder
+	var collect func(v any)
+	collect = func(v any) {
+		switch v := v.(type) {
+		case string:
+			text.WriteString(v)
+			text.WriteString("\n")
+		case []any:
+			for _, elem := range v {
+				collect(elem)
+			}
+		case map[string]any:
+			for _, elem := range v {
+				collect(elem)
+			}
+		}
+	}
+	collect(payload)
+	return text.String()
+}
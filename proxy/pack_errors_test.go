@@ -0,0 +1,37 @@
+package main
+
+import (
+	"pacproxy/shared/statistics"
+	"testing"
+)
+
+func TestAnalyzePackErrorBody(t *testing.T) {
+	tests := []struct {
+		name       string
+		statusCode int
+		body       string
+		want       string
+	}{
+		{"unauthorized status", 401, `{"message":"item too large"}`, statistics.ErrorCategoryAuth},
+		{"forbidden status", 403, ``, statistics.ErrorCategoryAuth},
+		{"too many requests", 429, ``, statistics.ErrorCategoryQuota},
+		{"gateway timeout", 504, ``, statistics.ErrorCategoryTimeout},
+		{"api key message", 400, `{"error":"Invalid API key"}`, statistics.ErrorCategoryAuth},
+		{"quota message", 400, `{"message":"Monthly quota exceeded"}`, statistics.ErrorCategoryQuota},
+		{"time limit message", 500, `{"message":"pack time limit reached"}`, statistics.ErrorCategoryTimeout},
+		{"no box before item", 400, `{"message":"item 3 does not fit in any box"}`, statistics.ErrorCategoryNoBoxFits},
+		{"invalid item", 400, `{"message":"item dimensions must be positive"}`, statistics.ErrorCategoryInvalidItem},
+		{"nested messages", 422, `{"errors":[{"field":"itemSets[0]","detail":{"msg":"Weight is required"}}]}`, statistics.ErrorCategoryInvalidItem},
+		{"text body", 400, `No suitable box`, statistics.ErrorCategoryNoBoxFits},
+		{"other client error", 400, `{"message":"malformed JSON","code":17}`, statistics.ErrorCategoryInvalidRequest},
+		{"other server error", 502, `<html>Bad Gateway</html>`, statistics.ErrorCategoryService},
+		{"empty server error", 500, ``, statistics.ErrorCategoryService},
+	}
+	for _, test := range tests {
+		stats := statistics.NewStats()
+		analyzePackErrorBody(test.statusCode, []byte(test.body), stats)
+		if stats.ErrorCategory != test.want {
+			t.Errorf("%s: category %q, want %q", test.name, stats.ErrorCategory, test.want)
+		}
+	}
+}
@@ -3,18 +3,18 @@ package main
 import (
 	"encoding/json"
 	"fmt"
-	"hash/fnv"
 	"pacproxy/shared/config"
+	"pacproxy/shared/kafkautils"
 	"pacproxy/shared/statistics"
-	"time"
 
 	"github.com/IBM/sarama"
 )
 
-// initProducer() opens a connection with the Kafka producer
-func initProducer(timeout time.Duration) (*sarama.AsyncProducer, error) {
-	kafkaConfig := config.GetDefaultKafkaConfig()
+// initProducer() opens a connection with the Kafka producer. Messages are partitioned on their
+// keystem, so each keystem's messages are consumed in order by a single aggregator.
+func initProducer(kafkaConfig config.KafkaConfig) (*sarama.AsyncProducer, error) {
 	saramaConfig := config.GetSaramaConfig()
+	saramaConfig.Producer.Partitioner = kafkautils.NewKeystemPartitioner(kafkaConfig.Partitioner)
 
 	producer, err := sarama.NewAsyncProducer(kafkaConfig.Brokers, saramaConfig)
 	if err != nil {
@@ -24,10 +24,11 @@ func initProducer(timeout time.Duration) (*sarama.AsyncProducer, error) {
 }
 
 // sendMessage() sends a kafka message holding an encoded object
-// producer: kafka producer
+// supervisor: delivery supervisor wrapping the kafka producer
+// topic: kafka topic the message will be written to
 // v: object to be encoded
 // messageType: the type of message (stats message or delete request)
-func sendMessage(producer *sarama.AsyncProducer, v any, messageType string) error {
+func sendMessage(supervisor *deliverySupervisor, topic string, v any, messageType string) error {
 
 	var usedKeyStem string
 	if messageType == config.MessageTypeStats {
@@ -38,40 +39,31 @@ func sendMessage(producer *sarama.AsyncProducer, v any, messageType string) erro
 		usedKeyStem = request.UsedKeystem
 	}
 
-	producerMessage, err := buildProducerMessage(v, hash(usedKeyStem), messageType)
+	producerMessage, err := buildProducerMessage(v, topic, usedKeyStem, messageType)
 	if err != nil {
+		kafkaEnqueueFailures.Inc(messageType)
 		return fmt.Errorf("Error occurred while building message: %s", err)
 	}
-	(*producer).Input() <- producerMessage
+	supervisor.Send(producerMessage)
 	return nil
 }
 
 // buildProducerMessage() encodes a message from an object.
 // v: object to be encoded
-// partition: kafka partition the message will be written to
+// topic: kafka topic the message will be written to
+// keystem: key of the message, choosing the kafka partition it will be written to
 // messageType: the type of message (stats message or delete request)
-func buildProducerMessage(v any, partition int32, messageType string) (*sarama.ProducerMessage, error) {
-	config := config.GetDefaultKafkaConfig()
+func buildProducerMessage(v any, topic string, keystem string, messageType string) (*sarama.ProducerMessage, error) {
 	messageBody, err := json.Marshal(v)
 	if err != nil {
 		return nil, err
 	}
 
 	message := &sarama.ProducerMessage{
-		Topic:     config.Topic,
-		Value:     sarama.StringEncoder(messageBody),
-		Partition: partition,
-		Headers:   []sarama.RecordHeader{sarama.RecordHeader{Key: []byte("type"), Value: []byte(messageType)}},
+		Topic:   topic,
+		Key:     sarama.StringEncoder(keystem),
+		Value:   sarama.StringEncoder(messageBody),
+		Headers: []sarama.RecordHeader{sarama.RecordHeader{Key: []byte("type"), Value: []byte(messageType)}},
 	}
 	return message, nil
 }
-
-// hash() returns a hash of a string.
-// This is used to assign partition numbers based on keystem.
-func hash(s string) int32 {
-	h := fnv.New32a()
-	h.Write([]byte(s))
-	return int32(h.Sum32())
-}
-
-// Todo write process to resend unacknowledged messages
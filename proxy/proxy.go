@@ -3,20 +3,29 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
+	"maps"
 	"net/http"
+	"os"
+	"slices"
 	"strconv"
+	"strings"
 	"time"
 
 	"log/slog"
 	"pacproxy/shared/config"
+	"pacproxy/shared/kafkautils"
 	"pacproxy/shared/mongoutils"
 	"pacproxy/shared/statistics"
 
 	"github.com/gin-gonic/gin"
 	"github.com/go-playground/validator/v10"
+	"go.mongodb.org/mongo-driver/v2/mongo"
 )
 
 type PackRequest struct {
@@ -410,22 +419,70 @@ type InformationResponse struct {
 	Message string
 }
 
-const (
-	pacUrl string = "https://api.paccurate.io/"
-)
+// One page of archived pack events
+type EventsResponse struct {
+	Events     []*mongoutils.PackEvent `json:"events"`
+	NextCursor string                  `json:"nextCursor,omitempty"` // cursor of the next page, if there may be one
+}
+
+// One page of a keystem listing
+type KeystemsResponse struct {
+	Keystems []*statistics.KeyStats `json:"keystems"`
+	Total    int64                  `json:"total"` // keystems matching the filters, across all pages
+	Offset   int64                  `json:"offset"`
+	Limit    int64                  `json:"limit"`
+}
+
+// APIKeyRequest creates an API key
+type APIKeyRequest struct {
+	Name     string   `json:"name" binding:"required"`
+	Role     string   `json:"role" binding:"required"`
+	Keystems []string `json:"keystems"` // keystems the key can read, or every keystem if empty
+}
+
+// CreatedAPIKeyResponse holds a new API key, which can't be fetched again
+type CreatedAPIKeyResponse struct {
+	mongoutils.APIKey
+	Key string `json:"key"`
+}
+
+// UpstreamErrorResponse answers a request whose upstream couldn't be reached
+type UpstreamErrorResponse struct {
+	Message    string
+	ErrorClass string
+	Retries    int
+}
 
 func main() {
 
+	cfg, err := config.Load(os.Args[1:])
+	if err != nil {
+		slog.Error(fmt.Errorf("invalid configuration: %s", err).Error())
+		os.Exit(2)
+	}
+	slog.Info("effective configuration:\n" + cfg.Redacted())
+
 	router := gin.Default()
 
-	producer, err := initProducer(60 * time.Second)
+	err = kafkautils.EnsureTopic(cfg.Kafka)
+	if err != nil {
+		slog.Error(fmt.Errorf("couldn't provision the kafka topic: %s", err).Error())
+		return
+	}
+	producer, err := initProducer(cfg.Kafka)
 	if err != nil {
 		slog.Error(fmt.Errorf("couldn't open a connection to kafka: %s", err).Error())
 		return
 	}
-	defer (*producer).Close()
+	supervisor, err := startDeliverySupervisor(producer, cfg.Delivery)
+	if err != nil {
+		slog.Error(err.Error())
+		(*producer).Close()
+		return
+	}
+	defer supervisor.Close()
 
-	mongoClient, err := mongoutils.InitMongoSession()
+	mongoClient, err := mongoutils.InitMongoSession(cfg.Mongo)
 	if err != nil {
 		slog.Error(fmt.Errorf("couldn't open a mongodb connection: %s", err).Error())
 		return
@@ -435,41 +492,313 @@ func main() {
 			panic(err)
 		}
 	}()
+	err = mongoutils.RunMigrations(mongoClient)
+	if err != nil {
+		slog.Error(fmt.Errorf("couldn't migrate the database: %s", err).Error())
+		return
+	}
 
-	// Get aggregate data for one single keystem or from all as a AggregatedKeyStats object.
-	router.GET("/api/keydata/:keystem", func(c *gin.Context) {
-		keystem := c.Param("keystem")
-		var err error
-		if keystem == "all" {
-			akStats, err := mongoutils.GetAggregatedKeyStats(mongoClient)
-			if err == nil {
-				c.JSON(200, akStats)
+	cache, err := newCache(cfg.Cache)
+	if err != nil {
+		slog.Error(fmt.Errorf("couldn't create the response cache: %s", err).Error())
+		return
+	}
+	if cache != nil {
+		defer cache.Close()
+	}
+
+	// Expose metrics in the Prometheus text format
+	router.GET("/metrics", gin.WrapH(metricsRegistry))
+
+	auth, err := newAuthenticator(mongoClient, cfg.Auth)
+	if err != nil {
+		slog.Error(fmt.Errorf("couldn't set up authentication: %s", err).Error())
+		return
+	}
+	readers := router.Group("/api", auth.require(roleReader))
+	admins := router.Group("/api", auth.require(roleAdmin))
+
+	// List the statistics of keystems one page at a time, sorted and filtered by their fields
+	readers.GET("/keystems", func(c *gin.Context) {
+		query, err := parseKeyStatsQuery(c)
+		if err != nil {
+			c.JSON(400, ErrorResponse{err.Error()})
+			return
+		}
+		query.Keystems = keystemScope(c)
+		keyStats, total, err := mongoutils.ListKeyStats(c.Request.Context(), mongoClient, query)
+		if err != nil {
+			c.JSON(500, ErrorResponse{fmt.Errorf("error encountered while listing keystems: %s", err).Error()})
+			return
+		}
+		c.JSON(200, KeystemsResponse{Keystems: keyStats, Total: total, Offset: query.Offset, Limit: query.Limit})
+	})
+
+	// Find archived pack events, latest first, one page at a time
+	readers.GET("/events", func(c *gin.Context) {
+		query, err := parseEventQuery(c)
+		if err != nil {
+			c.JSON(400, ErrorResponse{err.Error()})
+			return
+		}
+		if keystem := c.Query("keystem"); keystem != "" {
+			if !canAccessKeystem(c, keystem) {
+				c.JSON(403, ErrorResponse{fmt.Sprintf("API key can't read keystem %s", keystem)})
 				return
 			}
+			query.Keystems = []string{keystem}
 		} else {
-			keyStats, err := mongoutils.GetKeyStats(mongoClient, []string{keystem})
-			if err == nil {
-				c.JSON(200, keyStats[keystem])
+			query.Keystems = keystemScope(c)
+		}
+		events, err := mongoutils.ListPackEvents(c.Request.Context(), mongoClient, query)
+		if err != nil {
+			c.JSON(500, ErrorResponse{fmt.Errorf("error encountered while fetching events: %s", err).Error()})
+			return
+		}
+		response := EventsResponse{Events: events}
+		if int64(len(events)) == query.Limit {
+			response.NextCursor = events[len(events)-1].Cursor()
+		}
+		c.JSON(200, response)
+	})
+
+	// Export the stats of every keystem, or of each of their buckets in a time range, as CSV or NDJSON
+	readers.GET("/export/keydata", func(c *gin.Context) {
+		format := exportFormat(c)
+		if format == "" {
+			c.JSON(406, ErrorResponse{"format must be csv or ndjson"})
+			return
+		}
+		query := mongoutils.ExportQuery{Keystems: keystemScope(c)}
+		if list := c.Query("keystems"); list != "" {
+			query.Keystems = parseKeystemList(list)
+			for _, keystem := range query.Keystems {
+				if !canAccessKeystem(c, keystem) {
+					c.JSON(403, ErrorResponse{fmt.Sprintf("API key can't read keystem %s", keystem)})
+					return
+				}
+			}
+		}
+		timeRange, err := parseTimeRange(c)
+		if err != nil {
+			c.JSON(400, ErrorResponse{err.Error()})
+			return
+		}
+		if timeRange != nil {
+			query.Granularity, query.From, query.To = timeRange.granularity, timeRange.from, timeRange.to
+		}
+		err = writeExport(c, mongoClient, &query, format)
+		if err != nil {
+			slog.Error(fmt.Errorf("error occurred exporting stats: %s", err).Error())
+		}
+	})
+
+	// Compare the stats of several keystems, over their lifetime or a time range
+	readers.GET("/keydata/compare", func(c *gin.Context) {
+		keystems := parseKeystemList(c.Query("keystems"))
+		if len(keystems) < 2 || len(keystems) > maxComparedKeystems {
+			c.JSON(400, ErrorResponse{fmt.Sprintf("keystems must list between 2 and %d keystems", maxComparedKeystems)})
+			return
+		}
+		for _, keystem := range keystems {
+			if !canAccessKeystem(c, keystem) {
+				c.JSON(403, ErrorResponse{fmt.Sprintf("API key can't read keystem %s", keystem)})
 				return
 			}
 		}
+		timeRange, err := parseTimeRange(c)
+		if err != nil {
+			c.JSON(400, ErrorResponse{err.Error()})
+			return
+		}
+		keyStats, err := getComparedKeyStats(mongoClient, keystems, timeRange)
 		if err != nil {
 			c.JSON(500, ErrorResponse{fmt.Errorf("error encountered while fetching stats: %s", err).Error()})
+			return
 		}
+		c.JSON(200, statistics.Compare(keyStats))
 	})
 
-	// Delete aggregated data for one keystem
-	router.DELETE("/api/keydata/:keystem", func(c *gin.Context) {
+	// Get aggregate data for one single keystem or from all as a AggregatedKeyStats object.
+	// If a time range is requested, a series of time-bucketed summaries is returned instead.
+	readers.GET("/keydata/:keystem", func(c *gin.Context) {
 		keystem := c.Param("keystem")
-		deleteRequest := statistics.DeleteRequest{keystem}
-		sendMessage(producer, &deleteRequest, config.MessageTypeDelete)
+		if !canAccessKeystem(c, keystem) {
+			c.JSON(403, ErrorResponse{fmt.Sprintf("API key can't read keystem %s", keystem)})
+			return
+		}
+		timeRange, err := parseTimeRange(c)
+		if err != nil {
+			c.JSON(400, ErrorResponse{err.Error()})
+			return
+		}
+		var result any
+		if timeRange != nil && keystem == "all" {
+			result, err = mongoutils.GetAggregatedKeyStatsSeries(mongoClient, timeRange.granularity, timeRange.from, timeRange.to)
+		} else if timeRange != nil {
+			result, err = mongoutils.GetKeyStatsSeries(mongoClient, []string{keystem}, timeRange.granularity, timeRange.from, timeRange.to)
+		} else if keystem == "all" {
+			result, err = mongoutils.GetAggregatedKeyStats(mongoClient)
+		} else {
+			var keyStats map[string]*statistics.KeyStats
+			keyStats, err = mongoutils.GetKeyStats(mongoClient, []string{keystem})
+			result = keyStats[keystem]
+		}
+		if err != nil {
+			c.JSON(500, ErrorResponse{fmt.Errorf("error encountered while fetching stats: %s", err).Error()})
+			return
+		}
+		c.JSON(200, result)
+	})
+
+	// Fetch the usage of pack request options for one keystem, or across all keystems with "all", along with
+	// the volume utilization of each option's values. A single option can be picked with the option parameter.
+	readers.GET("/keydata/:keystem/options", func(c *gin.Context) {
+		keystem := c.Param("keystem")
+		if !canAccessKeystem(c, keystem) {
+			c.JSON(403, ErrorResponse{fmt.Sprintf("API key can't read keystem %s", keystem)})
+			return
+		}
+		timeRange, err := parseTimeRange(c)
+		if err != nil {
+			c.JSON(400, ErrorResponse{err.Error()})
+			return
+		}
+		usage, err := getOptionUsage(mongoClient, keystem, timeRange)
+		if err != nil {
+			c.JSON(500, ErrorResponse{fmt.Errorf("error encountered while fetching stats: %s", err).Error()})
+			return
+		}
+		option := c.Query("option")
+		if option == "" {
+			c.JSON(200, usage)
+			return
+		}
+		outcomes, found := usage.OptionMaps()[option]
+		if !found {
+			c.JSON(400, ErrorResponse{fmt.Sprintf("invalid option %s", option)})
+			return
+		}
+		c.JSON(200, outcomes)
+	})
+
+	// Delete aggregated data for one keystem, or only that of a time range. The delete job returned
+	// reports when an aggregator has applied the request.
+	admins.DELETE("/keydata/:keystem", func(c *gin.Context) {
+		keystem := c.Param("keystem")
+		from, to, err := parseDeleteRange(c)
+		if err != nil {
+			c.JSON(400, ErrorResponse{err.Error()})
+			return
+		}
+		job := mongoutils.DeletionJob{
+			ID:          newDeletionID(),
+			UsedKeystem: keystem,
+			From:        from,
+			To:          to,
+			Status:      mongoutils.DeletionPending,
+			RequestedAt: time.Now().UTC(),
+		}
+		err = mongoutils.CreateDeletion(c.Request.Context(), mongoClient, &job)
+		if err != nil {
+			err = fmt.Errorf("error occurred creating delete job: %s", err)
+			slog.Error(err.Error())
+			c.JSON(500, ErrorResponse{err.Error()})
+			return
+		}
+		deleteRequest := statistics.DeleteRequest{ID: job.ID, UsedKeystem: keystem, From: from, To: to}
+		err = sendMessage(supervisor, cfg.Kafka.Topic, &deleteRequest, config.MessageTypeDelete)
+		if err != nil {
+			slog.Error(err.Error())
+			job.Status = mongoutils.DeletionFailed
+			if err := mongoutils.SetDeletionStatus(c.Request.Context(), mongoClient, job.ID, job.Status); err != nil {
+				slog.Error(fmt.Errorf("error occurred updating delete job %s: %s", job.ID, err).Error())
+			}
+			c.JSON(500, ErrorResponse{fmt.Sprintf("delete request on keystem %s couldn't be sent", keystem)})
+			return
+		}
+		c.JSON(202, job)
+	})
 
-		c.JSON(200, InformationResponse{fmt.Sprintf("delete request sent on keystem %s", keystem)})
+	// Fetch the status of a delete job
+	admins.GET("/deletions/:id", func(c *gin.Context) {
+		id := c.Param("id")
+		job, err := mongoutils.GetDeletion(c.Request.Context(), mongoClient, id)
+		if err != nil {
+			c.JSON(500, ErrorResponse{fmt.Errorf("error encountered while fetching delete job: %s", err).Error()})
+			return
+		} else if job == nil {
+			c.JSON(404, ErrorResponse{fmt.Sprintf("no delete job with ID %s", id)})
+			return
+		}
+		c.JSON(200, job)
 	})
 
-	// Forward a POST request to the Paccurate API
+	// Create an API key. The key itself is only returned here, since only its hash is stored.
+	admins.POST("/keys", func(c *gin.Context) {
+		var request APIKeyRequest
+		err := c.ShouldBindJSON(&request)
+		if err != nil || (request.Role != roleReader && request.Role != roleAdmin) {
+			c.JSON(400, ErrorResponse{fmt.Sprintf("a name and a role (%s or %s) are required", roleReader, roleAdmin)})
+			return
+		}
+		key, id := newAPIKey()
+		apiKey := mongoutils.APIKey{
+			KeyHash:   apiKeyHash(key),
+			ID:        id,
+			Name:      request.Name,
+			Role:      request.Role,
+			Keystems:  request.Keystems,
+			CreatedAt: time.Now().UTC(),
+		}
+		if apiKey.Keystems == nil {
+			apiKey.Keystems = []string{}
+		}
+		err = mongoutils.CreateAPIKey(c.Request.Context(), mongoClient, &apiKey)
+		if err != nil {
+			err = fmt.Errorf("error occurred creating API key: %s", err)
+			slog.Error(err.Error())
+			c.JSON(500, ErrorResponse{err.Error()})
+			return
+		}
+		c.JSON(201, CreatedAPIKeyResponse{APIKey: apiKey, Key: key})
+	})
+
+	// List API keys, without the keys themselves
+	admins.GET("/keys", func(c *gin.Context) {
+		apiKeys, err := mongoutils.ListAPIKeys(c.Request.Context(), mongoClient)
+		if err != nil {
+			c.JSON(500, ErrorResponse{fmt.Errorf("error encountered while fetching API keys: %s", err).Error()})
+			return
+		}
+		c.JSON(200, apiKeys)
+	})
+
+	// Revoke an API key
+	admins.DELETE("/keys/:id", func(c *gin.Context) {
+		id := c.Param("id")
+		hash, err := mongoutils.DeleteAPIKey(c.Request.Context(), mongoClient, id)
+		if err != nil {
+			c.JSON(500, ErrorResponse{fmt.Errorf("error encountered while revoking API key: %s", err).Error()})
+			return
+		} else if hash == "" {
+			c.JSON(404, ErrorResponse{fmt.Sprintf("no API key with ID %s", id)})
+			return
+		}
+		auth.forget(hash)
+		c.JSON(200, InformationResponse{fmt.Sprintf("API key %s revoked", id)})
+	})
+
+	upstream := newUpstreamClient(cfg.Upstream)
+	resolver := newKeystemResolver(mongoClient)
+	var limiter *rateLimiter
+	if cfg.Proxy.RateLimit > 0 {
+		limiter = newRateLimiter(cfg.Proxy.RateLimit, cfg.Proxy.RateBurst)
+	}
+
+	// Forward a pack request to the Paccurate API
 	// This returns a statistical summary of that individual pack request
-	router.POST("/", func(c *gin.Context) {
+	handlePackRequest := func(c *gin.Context, r *route) {
 		body, err := io.ReadAll(c.Request.Body)
 		if err != nil {
 			err = fmt.Errorf("error occurred reading response body: %s", err)
@@ -497,73 +826,531 @@ func main() {
 			return
 		}
 
+		// Attribute the request to a keystem before forwarding it
+		authorization := c.Request.Header.Get("Authorization")
+		keystem, fromCredentials := resolver.resolve(c.Request)
+		if keystem == "" {
+			keystem = statistics.UnknownKeystem
+		}
+		// Callers can claim any X-Keystem, so only learned keystems get their own rate limit and metrics
+		// labels. Every other caller shares those of the unknown keystem.
+		trustedKeystem := statistics.UnknownKeystem
+		if fromCredentials {
+			trustedKeystem = keystem
+		}
+		if limiter != nil && !limiter.allow(trustedKeystem) {
+			rateLimitedRequests.Inc(trustedKeystem)
+			c.JSON(429, ErrorResponse{fmt.Sprintf("rate limit exceeded for keystem %s", trustedKeystem)})
+			return
+		}
+
 		stats := statistics.NewStats()
+		stats.Options = requestOptions(&packRequest)
+		sendStats := func() {
+			stats.RequestID, stats.OrderID = packRequest.RequestID, packRequest.OrderID
+			// Packs that failed have no keystem from Paccurate, so they're attributed to the resolved one
+			metricsKeystem := stats.UsedKeystem
+			if stats.UsedKeystem == "" {
+				stats.UsedKeystem = keystem
+				metricsKeystem = trustedKeystem
+			}
+			if stats.EventID == "" {
+				stats.EventID = requestEventID(stats.UsedKeystem, packRequest.OrderID, packRequest.RequestID)
+			}
+			recordRequestMetrics(stats, metricsKeystem)
+			err := sendMessage(supervisor, cfg.Kafka.Topic, stats, config.MessageTypeStats)
+			if err != nil {
+				slog.Error(err.Error())
+			}
+		}
+
+		// Check the cache for requests that will always produce the same pack
+		var cacheKey string
+		if cache != nil && isCacheable(&packRequest) {
+			// Callers sharing a keystem get the same packs from Paccurate, so they can share cached responses
+			identity := authorization
+			if fromCredentials {
+				identity = "keystem:" + keystem
+			}
+			cacheKey, err = requestFingerprint(body, identity)
+			if err != nil {
+				slog.Error(fmt.Errorf("error occurred fingerprinting request: %s", err).Error())
+			} else {
+				cached, found, err := cache.Get(c.Request.Context(), cacheKey)
+				if err != nil {
+					slog.Error(fmt.Errorf("error occurred reading from the cache: %s", err).Error())
+				} else if found {
+					stats.CacheHit = true
+					stats.TimeStamp = time.Now().UTC().Format(time.RFC3339Nano)
+					stats.StatusCode = strconv.Itoa(cached.StatusCode)
+					err = analyzePackResponseBody(cached.Body, stats)
+					if err != nil {
+						err = fmt.Errorf("error occurred analyzing cached response body: %s", err)
+						slog.Error(err.Error())
+						c.JSON(500, ErrorResponse{err.Error()})
+						return
+					}
+					// A cache hit isn't the cached pack, so it mustn't be dropped as a duplicate of it
+					stats.EventID = newEventID()
+				}
+			}
+		}
 
-		// TODO check if request is for a random pack. If not, check redis cache
 		// If this request wasn't found in the cache, then we forward it to Paccurate
 		if !stats.CacheHit {
-			proxyReq, err := createProxyRequest(c.Request.Header, body)
+			proxyReq, err := createProxyRequest(r, c.Request, bytes.NewReader(body))
 			if err != nil {
 				err = fmt.Errorf("error occurred creating proxy request: %s", err)
 				slog.Error(err.Error())
 				c.JSON(500, ErrorResponse{err.Error()})
 				return
 			}
-			client := http.Client{}
+			// Packs have no side effects, so pack requests are always safe to retry
 			timeStart := time.Now()
-			resp, err := client.Do(proxyReq)
+			resp, outcome, err := upstream.do(proxyReq, upstream.packTimeout(packRequest.Timeout), true)
 			latency := time.Since(timeStart)
-			stats.TimeStamp = timeStart.String()
+			stats.TimeStamp = timeStart.UTC().Format(time.RFC3339Nano)
 			stats.Latency = float64(latency)
+			stats.Retries = outcome.retries
+			stats.CircuitOpen = outcome.circuitOpen
 			if err != nil {
 				stats.RequestError = true
+				stats.ErrorClass = classifyUpstreamError(err)
 				err = fmt.Errorf("error occurred forwarding request to Paccurate: %s", err)
 				slog.Error(err.Error())
-				c.JSON(resp.StatusCode, ErrorResponse{err.Error()})
+				sendStats()
+				c.JSON(upstreamErrorStatus(stats.ErrorClass), UpstreamErrorResponse{err.Error(), stats.ErrorClass, stats.Retries})
 				return
 			}
 			if resp != nil {
+				defer resp.Body.Close()
 				stats.StatusCode = strconv.Itoa(resp.StatusCode)
 				if resp.StatusCode >= 400 {
 					stats.ErrorResponse = true
 				}
 				body, err := io.ReadAll(resp.Body)
 				if err != nil {
-					slog.Error(err.Error())
+					// The response was cut short, which is as much a transport failure as getting none
+					stats.RequestError = true
+					stats.ErrorClass = classifyUpstreamError(err)
+					upstreamErrors.Inc(r.upstream.Host, stats.ErrorClass)
 					err = fmt.Errorf("error occurred reading response body: %s", err)
 					slog.Error(err.Error())
-					c.JSON(500, ErrorResponse{err.Error()})
+					sendStats()
+					c.JSON(upstreamErrorStatus(stats.ErrorClass), UpstreamErrorResponse{err.Error(), stats.ErrorClass, stats.Retries})
 					return
 				}
-				err = analyzePackResponseBody(body, stats)
-				if err != nil {
-					err = fmt.Errorf("error occurred analyzing response body: %s", err)
-					slog.Error(err.Error())
-					c.JSON(500, ErrorResponse{err.Error()})
-					return
+				if stats.ErrorResponse {
+					analyzePackErrorBody(resp.StatusCode, body, stats)
+				} else {
+					err = analyzePackResponseBody(body, stats)
+					if err != nil {
+						err = fmt.Errorf("error occurred analyzing response body: %s", err)
+						slog.Error(err.Error())
+						c.JSON(500, ErrorResponse{err.Error()})
+						return
+					}
+					resolver.learn(authorization, stats.UsedKeystem)
+				}
+				// Only successful packs are cached
+				if cacheKey != "" && !stats.ErrorResponse {
+					err = cache.Set(c.Request.Context(), cacheKey, &CachedResponse{StatusCode: resp.StatusCode, Body: body})
+					if err != nil {
+						slog.Error(fmt.Errorf("error occurred writing to the cache: %s", err).Error())
+					}
 				}
 			}
 		}
-		err = sendMessage(producer, stats, config.MessageTypeStats)
-		if err != nil {
-			slog.Error(err.Error())
-		}
+		sendStats()
 		c.JSON(200, stats)
+	}
+
+	// Forward every other request to the first matching route
+	routes, err := newRouteTable(cfg.Proxy.Routes, cfg.Proxy.PaccurateURL)
+	if err != nil {
+		slog.Error(err.Error())
+		return
+	}
+	requireForwardingKey := auth.require(roleReader)
+	router.HandleMethodNotAllowed = true
+	router.NoMethod(func(c *gin.Context) {
+		c.JSON(405, ErrorResponse{fmt.Sprintf("method %s not allowed on %s", c.Request.Method, c.Request.URL.Path)})
+	})
+	router.NoRoute(func(c *gin.Context) {
+		if isLocalPath(c.Request.URL.Path) {
+			c.JSON(404, ErrorResponse{fmt.Sprintf("no endpoint for %s %s", c.Request.Method, c.Request.URL.Path)})
+			return
+		}
+		if cfg.Auth.Forwarding {
+			requireForwardingKey(c)
+			if c.IsAborted() {
+				return
+			}
+		}
+		r := routes.match(c.Request.Method, c.Request.URL.Path)
+		if r == nil {
+			c.JSON(404, ErrorResponse{fmt.Sprintf("no route for %s %s", c.Request.Method, c.Request.URL.Path)})
+		} else if r.Stats {
+			handlePackRequest(c, r)
+		} else {
+			forwardRequest(c, r, upstream)
+		}
 	})
 
-	router.Run()
+	router.Run(cfg.Proxy.ListenAddr)
+}
+
+// getOptionUsage() returns the option usage of a keystem, or of all keystems with "all". Over a time range,
+// the usage of every bucket in the range is added up.
+func getOptionUsage(mongoClient *mongo.Client, keystem string, timeRange *timeRange) (*statistics.OptionUsage, error) {
+	usage := statistics.NewOptionUsage()
+	if timeRange != nil && keystem == "all" {
+		series, err := mongoutils.GetAggregatedKeyStatsSeries(mongoClient, timeRange.granularity, timeRange.from, timeRange.to)
+		if err != nil {
+			return nil, err
+		}
+		for _, bucket := range series {
+			usage.Merge(&bucket.Options)
+		}
+	} else if timeRange != nil {
+		series, err := mongoutils.GetKeyStatsSeries(mongoClient, []string{keystem}, timeRange.granularity, timeRange.from, timeRange.to)
+		if err != nil {
+			return nil, err
+		}
+		for _, bucket := range series {
+			usage.Merge(&bucket.Options)
+		}
+	} else if keystem == "all" {
+		akStats, err := mongoutils.GetAggregatedKeyStats(mongoClient)
+		if err != nil {
+			return nil, err
+		}
+		usage.Merge(&akStats.Options)
+	} else {
+		keyStats, err := mongoutils.GetKeyStats(mongoClient, []string{keystem})
+		if err != nil {
+			return nil, err
+		}
+		if found, ok := keyStats[keystem]; ok {
+			usage.Merge(&found.Options)
+		}
+	}
+	return usage, nil
+}
+
+// requestOptions() returns the options of a pack request recorded with its stats
+func requestOptions(packRequest *PackRequest) statistics.RequestOptions {
+	options := statistics.RequestOptions{
+		BoxTypeChoiceGoal: packRequest.BoxTypeChoiceGoal,
+		PlacementStyle:    packRequest.PlacementStyle,
+		ItemSort:          packRequest.ItemSort,
+		CohortPacking:     packRequest.CohortPacking,
+		ItemSets:          len(packRequest.ItemSets),
+		BoxTypeSets:       len(packRequest.BoxTypeSets),
+	}
+	for _, rule := range packRequest.Rules {
+		options.RuleOperations = append(options.RuleOperations, rule.Operation)
+	}
+	return options
+}
+
+const (
+	defaultEventLimit int64 = 50
+	maxEventLimit     int64 = 500
+)
+
+// parseEventQuery() reads the from, to, statusCode, orderId, error, minLatency, cursor and limit query
+// parameters of an event search. to defaults to now, and from to one day before to. minLatency is a
+// duration, such as 2s.
+func parseEventQuery(c *gin.Context) (*mongoutils.EventQuery, error) {
+	query := mongoutils.EventQuery{
+		To:         time.Now().UTC(),
+		StatusCode: c.Query("statusCode"),
+		OrderID:    c.Query("orderId"),
+		Limit:      defaultEventLimit,
+	}
+	var err error
+	if to := c.Query("to"); to != "" {
+		if query.To, err = parseTimeParam(to); err != nil {
+			return nil, fmt.Errorf("invalid to: %s", err)
+		}
+	}
+	query.From = query.To.Add(-defaultRangeLength)
+	if from := c.Query("from"); from != "" {
+		if query.From, err = parseTimeParam(from); err != nil {
+			return nil, fmt.Errorf("invalid from: %s", err)
+		}
+	}
+	if !query.From.Before(query.To) {
+		return nil, fmt.Errorf("from must be before to")
+	}
+	if errorParam := c.Query("error"); errorParam != "" {
+		isError, err := strconv.ParseBool(errorParam)
+		if err != nil {
+			return nil, fmt.Errorf("error must be true or false")
+		}
+		query.Error = &isError
+	}
+	if minLatency := c.Query("minLatency"); minLatency != "" {
+		latency, err := time.ParseDuration(minLatency)
+		if err != nil {
+			return nil, fmt.Errorf("invalid minLatency: %s", err)
+		}
+		query.MinLatency = float64(latency)
+	}
+	if cursor := c.Query("cursor"); cursor != "" {
+		if query.After, err = mongoutils.ParseEventCursor(cursor); err != nil {
+			return nil, fmt.Errorf("invalid cursor")
+		}
+	}
+	if limit := c.Query("limit"); limit != "" {
+		if query.Limit, err = strconv.ParseInt(limit, 10, 64); err != nil || query.Limit < 1 || query.Limit > maxEventLimit {
+			return nil, fmt.Errorf("limit must be between 1 and %d", maxEventLimit)
+		}
+	}
+	return &query, nil
+}
+
+// Most keystems compared in one request
+const maxComparedKeystems int = 50
+
+// parseKeystemList() splits a comma separated list of keystems, dropping blanks and duplicates
+func parseKeystemList(list string) []string {
+	var keystems []string
+	for _, keystem := range strings.Split(list, ",") {
+		keystem = strings.TrimSpace(keystem)
+		if keystem != "" && !slices.Contains(keystems, keystem) {
+			keystems = append(keystems, keystem)
+		}
+	}
+	return keystems
+}
+
+// getComparedKeyStats() returns the stats of each keystem over its lifetime, or over a time range by adding
+// up its buckets. Keystems without stats are mapped to nil.
+func getComparedKeyStats(mongoClient *mongo.Client, keystems []string, timeRange *timeRange) (map[string]*statistics.KeyStats, error) {
+	keyStats := make(map[string]*statistics.KeyStats, len(keystems))
+	for _, keystem := range keystems {
+		keyStats[keystem] = nil
+	}
+	if timeRange == nil {
+		found, err := mongoutils.GetKeyStats(mongoClient, keystems)
+		if err != nil {
+			return nil, err
+		}
+		maps.Copy(keyStats, found)
+		return keyStats, nil
+	}
+	series, err := mongoutils.GetKeyStatsSeries(mongoClient, keystems, timeRange.granularity, timeRange.from, timeRange.to)
+	if err != nil {
+		return nil, err
+	}
+	for _, bucket := range series {
+		if keyStats[bucket.UsedKeystem] == nil {
+			keyStats[bucket.UsedKeystem] = statistics.NewKeyStats(bucket.UsedKeystem)
+		}
+		keyStats[bucket.UsedKeystem].AggregateKeyStats(&bucket.KeyStats)
+	}
+	for _, stats := range keyStats {
+		if stats != nil {
+			stats.ComputePercentiles()
+		}
+	}
+	return keyStats, nil
+}
+
+// Fields keystems can be listed by, named as in the API and as stored. Numeric fields can be filtered on
+// with min and max query parameters, such as minRequests. Each must be in mongoutils.RankingFields, so that
+// listings are index-backed.
+var keystemListFields = map[string]string{
+	"keystem":           "usedKeystem",
+	"requests":          "totalRequests",
+	"totalItems":        "totalItems",
+	"totalVolume":       "totalVolume",
+	"avgItemsPerPack":   "avgItemsPerPack",
+	"utilization":       "avgVolumeUtilization",
+	"weightUtilization": "avgWeightUtilization",
+	"packs":             "packCount",
+	"avgCostPerPack":    "avgCostPerPack",
+	"avgBoxesPerPack":   "avgBoxesPerPack",
+	"leftoverRate":      "leftoverRate",
+	"cacheHits":         "cacheHits",
+	"errorRate":         "errorRate",
+	"avgLatency":        "avgLatency",
+	"maxLatency":        "highestLatency.latency",
+}
+
+const (
+	defaultKeystemSort  string = "requests"
+	defaultKeystemLimit int64  = 20
+	maxKeystemLimit     int64  = 100
+)
+
+// parseKeyStatsQuery() reads the sort, order, offset, limit and min and max query parameters of a keystem
+// listing. Keystems are sorted by descending requests by default.
+func parseKeyStatsQuery(c *gin.Context) (*mongoutils.KeyStatsQuery, error) {
+	order := c.DefaultQuery("order", "desc")
+	if order != "asc" && order != "desc" {
+		return nil, fmt.Errorf("order must be asc or desc")
+	}
+	query := mongoutils.KeyStatsQuery{
+		Min:        make(map[string]float64),
+		Max:        make(map[string]float64),
+		Descending: order == "desc",
+		Limit:      defaultKeystemLimit,
+	}
+	sort := c.DefaultQuery("sort", defaultKeystemSort)
+	field, found := keystemListFields[sort]
+	if !found {
+		return nil, fmt.Errorf("can't sort by %s", sort)
+	}
+	query.SortField = field
+	var err error
+	if offset := c.Query("offset"); offset != "" {
+		if query.Offset, err = strconv.ParseInt(offset, 10, 64); err != nil || query.Offset < 0 {
+			return nil, fmt.Errorf("invalid offset %s", offset)
+		}
+	}
+	if limit := c.Query("limit"); limit != "" {
+		if query.Limit, err = strconv.ParseInt(limit, 10, 64); err != nil || query.Limit < 1 || query.Limit > maxKeystemLimit {
+			return nil, fmt.Errorf("limit must be between 1 and %d", maxKeystemLimit)
+		}
+	}
+	for name, values := range c.Request.URL.Query() {
+		bounds := query.Min
+		field, found := strings.CutPrefix(name, "min")
+		if !found {
+			bounds = query.Max
+			field, found = strings.CutPrefix(name, "max")
+		}
+		if !found || field == "" {
+			continue
+		}
+		storedField, found := keystemListFields[strings.ToLower(field[:1])+field[1:]]
+		if !found || storedField == "usedKeystem" {
+			return nil, fmt.Errorf("can't filter on %s", name)
+		}
+		if bounds[storedField], err = strconv.ParseFloat(values[0], 64); err != nil {
+			return nil, fmt.Errorf("invalid %s %s", name, values[0])
+		}
+	}
+	err = query.Validate()
+	if err != nil {
+		return nil, err
+	}
+	return &query, nil
+}
+
+// timeRange is a window of time-bucketed statistics requested through query parameters
+type timeRange struct {
+	from        time.Time
+	to          time.Time
+	granularity string
+}
+
+const (
+	defaultGranularity string        = statistics.GranularityHour
+	defaultRangeLength time.Duration = 24 * time.Hour
+	maxRangeBuckets    int           = 10080 // a week of minutes
+)
+
+// parseTimeRange() reads the from, to and granularity query parameters. nil is returned if none of them
+// are set. Times are RFC 3339 or dates (2006-01-02). to defaults to now, and from to one day before to.
+func parseTimeRange(c *gin.Context) (*timeRange, error) {
+	fromParam, toParam, granularity := c.Query("from"), c.Query("to"), c.Query("granularity")
+	if fromParam == "" && toParam == "" && granularity == "" {
+		return nil, nil
+	}
+	if granularity == "" {
+		granularity = defaultGranularity
+	}
+	length, err := statistics.BucketLength(granularity)
+	if err != nil {
+		return nil, err
+	}
+	tr := timeRange{granularity: granularity, to: time.Now().UTC()}
+	if toParam != "" {
+		if tr.to, err = parseTimeParam(toParam); err != nil {
+			return nil, fmt.Errorf("invalid to: %s", err)
+		}
+	}
+	tr.from = tr.to.Add(-defaultRangeLength)
+	if fromParam != "" {
+		if tr.from, err = parseTimeParam(fromParam); err != nil {
+			return nil, fmt.Errorf("invalid from: %s", err)
+		}
+	}
+	if !tr.from.Before(tr.to) {
+		return nil, fmt.Errorf("from must be before to")
+	}
+	if tr.to.Sub(tr.from)/length > time.Duration(maxRangeBuckets) {
+		return nil, fmt.Errorf("time range spans more than %d buckets, use a coarser granularity", maxRangeBuckets)
+	}
+	// Include the bucket that from falls into
+	tr.from, _ = statistics.BucketStart(tr.from, granularity)
+	return &tr, nil
+}
+
+// parseDeleteRange() parses the optional from and to query parameters of a delete request. Both are nil if
+// neither is set, and to defaults to now if only from is.
+func parseDeleteRange(c *gin.Context) (*time.Time, *time.Time, error) {
+	fromParam, toParam := c.Query("from"), c.Query("to")
+	if fromParam == "" && toParam == "" {
+		return nil, nil, nil
+	} else if fromParam == "" {
+		return nil, nil, fmt.Errorf("from is required to delete a time range")
+	}
+	from, err := parseTimeParam(fromParam)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid from: %s", err)
+	}
+	to := time.Now()
+	if toParam != "" {
+		if to, err = parseTimeParam(toParam); err != nil {
+			return nil, nil, fmt.Errorf("invalid to: %s", err)
+		}
+	}
+	from, to = from.UTC(), to.UTC()
+	if !from.Before(to) {
+		return nil, nil, fmt.Errorf("from must be before to")
+	}
+	return &from, &to, nil
+}
+
+// newDeletionID() returns a random ID for a delete job
+func newDeletionID() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+func parseTimeParam(param string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339Nano, param); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.DateOnly, param)
 }
 
 // createProxyRequest() creates a new request by recycling the initial request.
-// The new request is sent to Paccurate.
-func createProxyRequest(header http.Header, body []byte) (*http.Request, error) {
-	proxyReq, err := http.NewRequest("POST", pacUrl, bytes.NewBuffer(body))
+// The new request is sent to the route's upstream with the same method, path, query string and headers.
+// Pack requests always ask for uncompressed JSON, since their responses are analyzed: without an
+// Accept-Encoding of its own, the transport decompresses the response whatever the client accepts.
+func createProxyRequest(r *route, incoming *http.Request, body io.Reader) (*http.Request, error) {
+	proxyReq, err := http.NewRequestWithContext(incoming.Context(), incoming.Method, r.upstreamURL(incoming.URL).String(), body)
 	if err != nil {
 		return nil, err
 	}
-	proxyReq.Header.Set("Authorization", header["Authorization"][0])
-	proxyReq.Header.Set("accept", "application/json")
-	proxyReq.Header.Set("Content-Type", "application/json")
+	if proxyReq.ContentLength == 0 && body != http.NoBody {
+		proxyReq.ContentLength = incoming.ContentLength
+	}
+	proxyReq.Header = incoming.Header.Clone()
+	removeHopByHopHeaders(proxyReq.Header)
+	proxyReq.Header.Del(apiKeyHeader) // the proxy's own credential
+	if r.Stats {
+		proxyReq.Header.Del("Accept-Encoding")
+		proxyReq.Header.Set("accept", "application/json")
+		proxyReq.Header.Set("Content-Type", "application/json")
+	}
 	return proxyReq, nil
 }
 
@@ -577,10 +1364,21 @@ func analyzePackResponseBody(body []byte, stats *statistics.Stats) error {
 	}
 
 	stats.UsedKeystem = packResponse.UsedKeystem
+	stats.EventID = packResponse.PackUUID
+	if stats.EventID == "" && packResponse.RequestID != "" {
+		stats.EventID = requestEventID(packResponse.UsedKeystem, packResponse.OrderID, packResponse.RequestID)
+	}
 	stats.TotalItems = packResponse.LenItems
 	stats.TotalVolume = packResponse.TotalVolume
 	stats.VolumeUtilization = packResponse.TotalVolumeUtilization
+	stats.TotalCost = packResponse.TotalCost
+	stats.TotalWeight = packResponse.TotalWeight
+	stats.Boxes = packResponse.LenBoxes
+	stats.Leftovers = packResponse.LenLeftovers
+	// Paccurate reports times in seconds, while latencies are in nanoseconds
+	stats.PackTime = (packResponse.PackTime + packResponse.RenderTime) * float64(time.Second)
 
+	var sumWeightUtilization float64
 	for _, box := range packResponse.Boxes {
 		refId := strconv.Itoa(box.Box.BoxType.RefID)
 		_, keyExists := stats.BoxTypes[refId]
@@ -588,6 +1386,36 @@ func analyzePackResponseBody(body []byte, stats *statistics.Stats) error {
 			stats.BoxTypes[refId] = 0
 		}
 		stats.BoxTypes[refId]++
+		sumWeightUtilization += box.Box.WeightUtilization
+		name := box.Box.Name
+		if name == "" {
+			name = box.Box.BoxType.Name
+		}
+		stats.BoxTypeStats.AddBox(refId, name, box.Box.LenItems, box.Box.VolumeUtilization, box.Box.WeightUtilization, box.Box.Price)
+		if box.Box.DimensionalWeightUsed {
+			stats.DimWeightBoxes++
+		}
+	}
+	if len(packResponse.Boxes) > 0 {
+		stats.WeightUtilization = sumWeightUtilization / float64(len(packResponse.Boxes))
 	}
 	return nil
 }
+
+// requestEventID() derives an event ID from a request ID, for packs without a UUID, so that resending a
+// request is dropped as a duplicate. The keystem and order ID keep apart callers reusing request IDs. A
+// random ID is returned if there's no request ID.
+func requestEventID(keystem string, orderID string, requestID string) string {
+	if requestID == "" {
+		return newEventID()
+	}
+	sum := sha256.Sum256([]byte(strconv.Quote(keystem) + strconv.Quote(orderID) + strconv.Quote(requestID)))
+	return hex.EncodeToString(sum[:16])
+}
+
+// newEventID() returns a random event ID
+func newEventID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
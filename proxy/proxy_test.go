@@ -0,0 +1,160 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"pacproxy/shared/config"
+	"pacproxy/shared/mongoutils"
+	"pacproxy/shared/statistics"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestRequestEventID(t *testing.T) {
+	id := requestEventID("keystem", "order-1", "request-1")
+	tests := []struct {
+		name      string
+		keystem   string
+		orderID   string
+		requestID string
+		same      bool
+	}{
+		{"resend", "keystem", "order-1", "request-1", true},
+		{"other request", "keystem", "order-1", "request-2", false},
+		{"other order", "keystem", "order-2", "request-1", false},
+		{"other keystem", "other", "order-1", "request-1", false},
+		{"shifted fields", "keystem", "order-1request-1", "", false},
+	}
+	for _, test := range tests {
+		got := requestEventID(test.keystem, test.orderID, test.requestID)
+		if (got == id) != test.same {
+			t.Errorf("%s: requestEventID() = %s, compared to %s", test.name, got, id)
+		}
+	}
+	if requestEventID("keystem", "", "") == requestEventID("keystem", "", "") {
+		t.Error("requests without an ID got the same event ID")
+	}
+}
+
+// A request sent twice gets the same event ID, whenever it's sent
+func TestResentPackEventID(t *testing.T) {
+	body := []byte(`{"usedKeystem":"keystem","requestId":"request-1","orderId":"order-1"}`)
+	first, second := statistics.NewStats(), statistics.NewStats()
+	first.TimeStamp, second.TimeStamp = "2025-03-25T05:47:17Z", "2025-03-25T05:49:02Z"
+	for _, stats := range []*statistics.Stats{first, second} {
+		if err := analyzePackResponseBody(body, stats); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if first.EventID == "" || first.EventID != second.EventID {
+		t.Errorf("event IDs %q and %q differ", first.EventID, second.EventID)
+	}
+}
+
+// A client accepting gzip still gets a pack response the proxy can analyze
+func TestPackRequestAcceptingGzip(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Type") != "application/json" || r.Header.Get("Accept") != "application/json" {
+			t.Errorf("pack request sent with Content-Type %q and Accept %q", r.Header.Get("Content-Type"), r.Header.Get("Accept"))
+		}
+		body := `{"usedKeystem":"keystem","lenItems":3}`
+		if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			w.Write([]byte(body))
+			return
+		}
+		w.Header().Set("Content-Encoding", "gzip")
+		gz := gzip.NewWriter(w)
+		gz.Write([]byte(body))
+		gz.Close()
+	}))
+	defer server.Close()
+	routes, err := newRouteTable([]config.RouteConfig{{Path: "/", Stats: true}, {Path: "/*"}}, server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	incoming := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{}`))
+	incoming.Header.Set("Accept-Encoding", "gzip, deflate")
+	incoming.Header.Set("Accept", "*/*")
+	incoming.Header.Set("Content-Type", "text/plain")
+	proxyReq, err := createProxyRequest(routes.match(http.MethodPost, "/"), incoming, strings.NewReader(`{}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, _, err := newUpstreamClient(testUpstreamConfig()).do(proxyReq, time.Second, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats := statistics.NewStats()
+	if err = analyzePackResponseBody(body, stats); err != nil {
+		t.Fatalf("couldn't analyze the response: %s", err)
+	}
+	if stats.UsedKeystem != "keystem" || stats.TotalItems != 3 {
+		t.Errorf("analyzed %+v", stats)
+	}
+
+	// Other requests are forwarded with the client's headers, and their responses copied back as is
+	incoming = httptest.NewRequest(http.MethodGet, "/boxes", nil)
+	incoming.Header.Set("Accept-Encoding", "gzip")
+	proxyReq, err = createProxyRequest(routes.match(http.MethodGet, "/boxes"), incoming, http.NoBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if proxyReq.Header.Get("Accept-Encoding") != "gzip" {
+		t.Error("forwarded request lost its Accept-Encoding")
+	}
+}
+
+func TestParseKeyStatsQuery(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	parse := func(rawQuery string) (*mongoutils.KeyStatsQuery, error) {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest(http.MethodGet, "/api/keystems?"+rawQuery, nil)
+		return parseKeyStatsQuery(c)
+	}
+	// Every listed field can be sorted and filtered on through an index
+	for name, field := range keystemListFields {
+		query, err := parse("sort=" + name)
+		if err != nil || query.SortField != field {
+			t.Errorf("sort=%s: got %v, %v", name, query, err)
+		}
+		if field == "usedKeystem" {
+			continue
+		}
+		param := "min" + strings.ToUpper(name[:1]) + name[1:]
+		if query, err = parse(param + "=1"); err != nil || query.Min[field] != 1 {
+			t.Errorf("%s=1: got %v, %v", param, query, err)
+		}
+	}
+
+	query, err := parse("")
+	if err != nil || query.SortField != "totalRequests" || !query.Descending || query.Limit != defaultKeystemLimit {
+		t.Errorf("default query = %+v, %v", query, err)
+	}
+	for _, rawQuery := range []string{
+		"sort=dimWeightRate",
+		"sort=totalRequests",
+		"sort=highestLatency.latency",
+		"minKeystem=a",
+		"maxDimWeightRate=1",
+		"order=up",
+		"limit=0",
+		"limit=101",
+		"offset=-1",
+		"minRequests=many",
+	} {
+		if query, err := parse(rawQuery); err == nil {
+			t.Errorf("%s was accepted as %+v", rawQuery, query)
+		}
+	}
+}
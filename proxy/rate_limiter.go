@@ -0,0 +1,57 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Buckets kept before idle ones are dropped. A bucket that has refilled is the same as a new one.
+const maxRateBuckets int = 10000
+
+// rateLimiter allows each keystem rate requests per second, with bursts of up to burst requests,
+// through one token bucket per keystem
+type rateLimiter struct {
+	rate    float64
+	burst   float64
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	return &rateLimiter{rate: rate, burst: float64(burst), buckets: make(map[string]*tokenBucket)}
+}
+
+// allow() reports whether a keystem can send a request now, taking a token from its bucket if so
+func (l *rateLimiter) allow(keystem string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	bucket, found := l.buckets[keystem]
+	if !found {
+		if len(l.buckets) >= maxRateBuckets {
+			l.dropFullBuckets(now)
+		}
+		bucket = &tokenBucket{tokens: l.burst, updated: now}
+		l.buckets[keystem] = bucket
+	}
+	bucket.tokens = min(l.burst, bucket.tokens+now.Sub(bucket.updated).Seconds()*l.rate)
+	bucket.updated = now
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
+
+func (l *rateLimiter) dropFullBuckets(now time.Time) {
+	for keystem, bucket := range l.buckets {
+		if bucket.tokens+now.Sub(bucket.updated).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, keystem)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterBurst(t *testing.T) {
+	l := newRateLimiter(0.001, 3)
+	for i := 0; i < 3; i++ {
+		if !l.allow("keystem") {
+			t.Errorf("request %d of a burst of 3 was refused", i+1)
+		}
+	}
+	if l.allow("keystem") {
+		t.Error("request past the burst was allowed")
+	}
+	// Each keystem has its own bucket
+	if !l.allow("other") {
+		t.Error("another keystem was limited")
+	}
+}
+
+func TestRateLimiterRefill(t *testing.T) {
+	l := newRateLimiter(10, 2)
+	l.allow("keystem")
+	l.allow("keystem")
+	if l.allow("keystem") {
+		t.Fatal("empty bucket allowed a request")
+	}
+
+	// 10 requests per second refill a token every 100ms, up to the burst
+	tests := []struct {
+		elapsed time.Duration
+		allowed int
+	}{
+		{50 * time.Millisecond, 0},
+		{150 * time.Millisecond, 1},
+		{time.Hour, 2},
+	}
+	for _, test := range tests {
+		l.buckets["keystem"].tokens = 0
+		l.buckets["keystem"].updated = time.Now().Add(-test.elapsed)
+		allowed := 0
+		for l.allow("keystem") {
+			allowed++
+		}
+		if allowed != test.allowed {
+			t.Errorf("%s after emptying: %d requests allowed, want %d", test.elapsed, allowed, test.allowed)
+		}
+	}
+}
+
+func TestRateLimiterDropsFullBuckets(t *testing.T) {
+	l := newRateLimiter(10, 2)
+	for i := 0; i < maxRateBuckets; i++ {
+		l.allow(fmt.Sprintf("keystem-%d", i))
+	}
+	// Only keystem-0 hasn't refilled once the limit is reached
+	for i := 0; i < maxRateBuckets; i++ {
+		l.buckets[fmt.Sprintf("keystem-%d", i)].updated = time.Now().Add(-time.Second)
+	}
+	l.buckets["keystem-0"].tokens, l.buckets["keystem-0"].updated = 0, time.Now()
+	l.allow("new")
+	if len(l.buckets) != 2 || l.buckets["keystem-0"] == nil || l.buckets["new"] == nil {
+		t.Errorf("%d buckets kept, want the new one and the one still refilling", len(l.buckets))
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"pacproxy/shared/config"
+	"strconv"
+	"time"
+)
+
+const (
+	redisKeyPrefix    string        = "pacproxy:pack:"
+	redisTimeout      time.Duration = 2 * time.Second
+	redisMaxIdleConns int           = 16
+)
+
+// redisCache stores responses on a server speaking the Redis protocol (RESP).
+// Connections are pooled and re-dialed after any error.
+type redisCache struct {
+	addr     string
+	password string
+	db       int
+	ttl      time.Duration
+	idle     chan *redisConn
+}
+
+type redisConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// redisError is an error reply sent by the server
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+func newRedisCache(cacheConfig config.CacheConfig) *redisCache {
+	return &redisCache{
+		addr:     cacheConfig.RedisAddr,
+		password: cacheConfig.RedisPassword,
+		db:       cacheConfig.RedisDB,
+		ttl:      cacheConfig.TTL,
+		idle:     make(chan *redisConn, redisMaxIdleConns),
+	}
+}
+
+func (c *redisCache) Get(ctx context.Context, key string) (*CachedResponse, bool, error) {
+	reply, err := c.do(ctx, "GET", redisKeyPrefix+key)
+	if err != nil {
+		return nil, false, err
+	}
+	if reply == nil {
+		return nil, false, nil
+	}
+	value, ok := reply.([]byte)
+	if !ok {
+		return nil, false, fmt.Errorf("redis: unexpected reply type %T to GET", reply)
+	}
+	var resp CachedResponse
+	err = json.Unmarshal(value, &resp)
+	if err != nil {
+		return nil, false, err
+	}
+	return &resp, true, nil
+}
+
+func (c *redisCache) Set(ctx context.Context, key string, resp *CachedResponse) error {
+	value, err := json.Marshal(resp)
+	if err != nil {
+		return err
+	}
+	_, err = c.do(ctx, c.setArgs(key, value)...)
+	return err
+}
+
+// setArgs() returns the SET command storing a value. The ttl is sent in milliseconds, rounded up to 1
+// since Redis rejects PX 0.
+func (c *redisCache) setArgs(key string, value []byte) []string {
+	args := []string{"SET", redisKeyPrefix + key, string(value)}
+	if c.ttl > 0 {
+		args = append(args, "PX", strconv.FormatInt(max(c.ttl.Milliseconds(), 1), 10))
+	}
+	return args
+}
+
+func (c *redisCache) Close() error {
+	for {
+		select {
+		case rc := <-c.idle:
+			rc.conn.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+// do() sends a single command and returns its reply
+func (c *redisCache) do(ctx context.Context, args ...string) (any, error) {
+	rc, err := c.getConn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	reply, err := rc.do(ctx, args...)
+	var replyErr redisError
+	if err != nil && !errors.As(err, &replyErr) {
+		// The connection may be left mid-reply, so it can't be reused
+		rc.conn.Close()
+		return nil, err
+	}
+	c.putConn(rc)
+	return reply, err
+}
+
+// getConn() returns an idle connection, or dials a new one
+func (c *redisCache) getConn(ctx context.Context) (*redisConn, error) {
+	select {
+	case rc := <-c.idle:
+		return rc, nil
+	default:
+	}
+	dialer := net.Dialer{Timeout: redisTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", c.addr)
+	if err != nil {
+		return nil, err
+	}
+	rc := &redisConn{conn: conn, reader: bufio.NewReader(conn)}
+	if c.password != "" {
+		if _, err = rc.do(ctx, "AUTH", c.password); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if c.db != 0 {
+		if _, err = rc.do(ctx, "SELECT", strconv.Itoa(c.db)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return rc, nil
+}
+
+// putConn() returns a healthy connection to the pool, closing it if the pool is full
+func (c *redisCache) putConn(rc *redisConn) {
+	select {
+	case c.idle <- rc:
+	default:
+		rc.conn.Close()
+	}
+}
+
+func (rc *redisConn) do(ctx context.Context, args ...string) (any, error) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(redisTimeout)
+	}
+	rc.conn.SetDeadline(deadline)
+
+	// Commands are sent as an array of bulk strings
+	w := bufio.NewWriter(rc.conn)
+	fmt.Fprintf(w, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(w, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if err := w.Flush(); err != nil {
+		return nil, err
+	}
+	return rc.readReply()
+}
+
+// readReply() parses one RESP reply. Nil bulk strings and arrays are returned as nil. Error replies are
+// returned as a redisError, and leave the connection at the start of the next reply.
+func (rc *redisConn) readReply() (any, error) {
+	line, err := rc.readLine()
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 {
+		return nil, fmt.Errorf("redis: empty reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		size, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if size < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, size+2) // payload followed by CRLF
+		if _, err = io.ReadFull(rc.reader, buf); err != nil {
+			return nil, err
+		}
+		return buf[:size], nil
+	case '*':
+		size, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if size < 0 {
+			return nil, nil
+		}
+		// Every element is read even after an error reply, so that the connection can be reused
+		elems := make([]any, size)
+		var elemErr error
+		for i := range elems {
+			elems[i], err = rc.readReply()
+			var replyErr redisError
+			if errors.As(err, &replyErr) {
+				elemErr = cmp.Or(elemErr, err)
+			} else if err != nil {
+				return nil, err
+			}
+		}
+		if elemErr != nil {
+			return nil, elemErr
+		}
+		return elems, nil
+	}
+	return nil, fmt.Errorf("redis: unexpected reply %q", line)
+}
+
+// readLine() reads a CRLF-terminated line without the terminator
+func (rc *redisConn) readLine() (string, error) {
+	line, err := rc.reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return "", fmt.Errorf("redis: malformed line %q", line)
+	}
+	return line[:len(line)-2], nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadReply(t *testing.T) {
+	tests := []struct {
+		reply   string
+		want    any
+		wantErr bool
+	}{
+		{"+OK\r\n", "OK", false},
+		{":42\r\n", int64(42), false},
+		{"$5\r\nhello\r\n", []byte("hello"), false},
+		{"$0\r\n\r\n", []byte{}, false},
+		{"$-1\r\n", nil, false},
+		{"*-1\r\n", nil, false},
+		{"*2\r\n$1\r\na\r\n:1\r\n", []any{[]byte("a"), int64(1)}, false},
+		{"-ERR wrong type\r\n", nil, true},
+		{"+OK\n", nil, true},
+		{"?\r\n", nil, true},
+		{"$5\r\nhel", nil, true},
+	}
+	for _, test := range tests {
+		rc := &redisConn{reader: bufio.NewReader(strings.NewReader(test.reply))}
+		got, err := rc.readReply()
+		if (err != nil) != test.wantErr {
+			t.Errorf("readReply(%q) error = %v, want error %v", test.reply, err, test.wantErr)
+			continue
+		}
+		if !test.wantErr && !reflect.DeepEqual(got, test.want) {
+			t.Errorf("readReply(%q) = %#v, want %#v", test.reply, got, test.want)
+		}
+	}
+
+	rc := &redisConn{reader: bufio.NewReader(strings.NewReader("-ERR wrong type\r\n"))}
+	var replyErr redisError
+	if _, err := rc.readReply(); !errors.As(err, &replyErr) || string(replyErr) != "ERR wrong type" {
+		t.Errorf("error reply returned %v, want a redisError", err)
+	}
+
+	// An error inside an array is returned once the whole array is read, leaving the next reply intact
+	rc = &redisConn{reader: bufio.NewReader(strings.NewReader("*3\r\n-ERR first\r\n*2\r\n-ERR nested\r\n$1\r\na\r\n:1\r\n+OK\r\n"))}
+	if _, err := rc.readReply(); !errors.As(err, &replyErr) || string(replyErr) != "ERR first" {
+		t.Errorf("array with error replies returned %v, want the first error", err)
+	}
+	if reply, err := rc.readReply(); reply != "OK" || err != nil {
+		t.Errorf("reply after an array with errors = %v, %v, want OK", reply, err)
+	}
+
+	// Malformed elements aren't reported as error replies, so the connection is dropped
+	rc = &redisConn{reader: bufio.NewReader(strings.NewReader("*2\r\n?\r\n-ERR second\r\n"))}
+	if _, err := rc.readReply(); err == nil || errors.As(err, &replyErr) {
+		t.Errorf("malformed array returned %v, want a protocol error", err)
+	}
+}
+
+func TestRedisSetArgs(t *testing.T) {
+	tests := []struct {
+		ttl  time.Duration
+		want []string
+	}{
+		{0, []string{"SET", redisKeyPrefix + "key", "value"}},
+		{time.Microsecond, []string{"SET", redisKeyPrefix + "key", "value", "PX", "1"}},
+		{999 * time.Microsecond, []string{"SET", redisKeyPrefix + "key", "value", "PX", "1"}},
+		{1500 * time.Microsecond, []string{"SET", redisKeyPrefix + "key", "value", "PX", "1"}},
+		{24 * time.Hour, []string{"SET", redisKeyPrefix + "key", "value", "PX", "86400000"}},
+	}
+	for _, test := range tests {
+		c := &redisCache{ttl: test.ttl}
+		if got := c.setArgs("key", []byte("value")); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("ttl %s: setArgs() = %q, want %q", test.ttl, got, test.want)
+		}
+	}
+}
+
+// Commands are sent as arrays of bulk strings
+func TestRedisConnDo(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	received := make(chan string, 1)
+	go func() {
+		buf := make([]byte, 64)
+		n, _ := server.Read(buf)
+		received <- string(buf[:n])
+		server.Write([]byte("$3\r\nbar\r\n"))
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	rc := &redisConn{conn: client, reader: bufio.NewReader(client)}
+	reply, err := rc.do(ctx, "GET", "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if command := <-received; command != "*2\r\n$3\r\nGET\r\n$3\r\nfoo\r\n" {
+		t.Errorf("sent %q", command)
+	}
+	if string(reply.([]byte)) != "bar" {
+		t.Errorf("reply = %q, want bar", reply)
+	}
+}
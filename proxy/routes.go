@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"pacproxy/shared/config"
+	"slices"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Hop-by-hop headers concern a single connection, so they aren't forwarded
+var hopByHopHeaders = []string{
+	"Connection", "Keep-Alive", "Proxy-Authenticate", "Proxy-Authorization",
+	"Te", "Trailer", "Transfer-Encoding", "Upgrade",
+}
+
+// Paths served by the proxy itself. Requests to them that match no endpoint are answered locally rather than
+// forwarded, since they may carry the proxy's own credentials.
+var localPaths = []string{"/api", "/metrics"}
+
+// route is a configured route, with its upstream resolved
+type route struct {
+	config.RouteConfig
+	upstream *url.URL
+}
+
+// routeTable forwards requests to the first route matching their method and path
+type routeTable []*route
+
+// newRouteTable() resolves the upstream of each route. Routes without one go to defaultUpstream.
+func newRouteTable(routes []config.RouteConfig, defaultUpstream string) (routeTable, error) {
+	table := make(routeTable, 0, len(routes))
+	for _, routeConfig := range routes {
+		upstream := routeConfig.Upstream
+		if upstream == "" {
+			upstream = defaultUpstream
+		}
+		upstreamURL, err := url.Parse(upstream)
+		if err != nil {
+			return nil, fmt.Errorf("invalid upstream for route %s: %s", routeConfig.Path, err)
+		}
+		table = append(table, &route{RouteConfig: routeConfig, upstream: upstreamURL})
+	}
+	return table, nil
+}
+
+// match() returns the first route matching a method and path, or nil if none do
+func (t routeTable) match(method string, path string) *route {
+	for _, r := range t {
+		if len(r.Methods) > 0 && !slices.Contains(r.Methods, method) {
+			continue
+		}
+		if prefix, isPrefix := strings.CutSuffix(r.Path, "*"); isPrefix {
+			if strings.HasPrefix(path, prefix) {
+				return r
+			}
+		} else if path == r.Path {
+			return r
+		}
+	}
+	return nil
+}
+
+// isLocalPath() reports whether a path is, or is under, one of the paths served by the proxy itself
+func isLocalPath(path string) bool {
+	for _, localPath := range localPaths {
+		if path == localPath || strings.HasPrefix(path, localPath+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// upstreamURL() returns the URL a request is forwarded to: the route's upstream, followed by the
+// request's path and query string
+func (r *route) upstreamURL(requestURL *url.URL) *url.URL {
+	u := *r.upstream
+	u.Path = strings.TrimSuffix(u.Path, "/") + requestURL.Path
+	u.RawPath = ""
+	u.RawQuery = requestURL.RawQuery
+	return &u
+}
+
+// forwardRequest() forwards a request to the route's upstream as is, and copies back the response.
+// Only requests with idempotent methods are retried.
+func forwardRequest(c *gin.Context, r *route, upstream *upstreamClient) {
+	proxyReq, err := createProxyRequest(r, c.Request, c.Request.Body)
+	if err != nil {
+		err = fmt.Errorf("error occurred creating proxy request: %s", err)
+		slog.Error(err.Error())
+		c.JSON(500, ErrorResponse{err.Error()})
+		return
+	}
+	resp, outcome, err := upstream.do(proxyReq, upstream.config.Timeout, isIdempotentMethod(proxyReq.Method))
+	if err != nil {
+		errorClass := classifyUpstreamError(err)
+		err = fmt.Errorf("error occurred forwarding request to %s: %s", r.upstream.Host, err)
+		slog.Error(err.Error())
+		c.JSON(upstreamErrorStatus(errorClass), UpstreamErrorResponse{err.Error(), errorClass, outcome.retries})
+		return
+	}
+	defer resp.Body.Close()
+
+	header := c.Writer.Header()
+	for key, values := range resp.Header {
+		header[key] = values
+	}
+	removeHopByHopHeaders(header)
+	c.Status(resp.StatusCode)
+	_, err = io.Copy(c.Writer, resp.Body)
+	if err != nil {
+		slog.Error(fmt.Errorf("error occurred copying response from %s: %s", r.upstream.Host, err).Error())
+	}
+}
+
+func removeHopByHopHeaders(header http.Header) {
+	for _, connectionHeader := range header.Values("Connection") {
+		for _, name := range strings.Split(connectionHeader, ",") {
+			header.Del(strings.TrimSpace(name))
+		}
+	}
+	for _, name := range hopByHopHeaders {
+		header.Del(name)
+	}
+}
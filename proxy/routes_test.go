@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net/url"
+	"pacproxy/shared/config"
+	"testing"
+)
+
+func TestRouteTableMatch(t *testing.T) {
+	routes, err := newRouteTable([]config.RouteConfig{
+		{Path: "/", Methods: []string{"POST"}, Stats: true},
+		{Path: "/v1/*", Upstream: "https://v1.example.com/base/"},
+		{Path: "/health", Methods: []string{"GET", "HEAD"}},
+		{Path: "/*"},
+	}, "https://api.paccurate.io/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		method string
+		path   string
+		want   int // index of the matching route, -1 for none
+	}{
+		{"POST", "/", 0},
+		{"GET", "/", 3},
+		{"GET", "/v1/pack", 1},
+		{"DELETE", "/v1/", 1},
+		{"GET", "/v1", 3},
+		{"HEAD", "/health", 2},
+		{"POST", "/health", 3},
+		{"GET", "/health/deep", 3},
+	}
+	for _, test := range tests {
+		got := routes.match(test.method, test.path)
+		if (test.want < 0 && got != nil) || (test.want >= 0 && got != routes[test.want]) {
+			t.Errorf("match(%s, %s) = %+v, want route %d", test.method, test.path, got, test.want)
+		}
+	}
+
+	exact, err := newRouteTable([]config.RouteConfig{{Path: "/", Methods: []string{"POST"}}}, "https://api.paccurate.io/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := exact.match("GET", "/"); r != nil {
+		t.Errorf("match(GET, /) = %+v, want no route", r)
+	}
+
+	requestURL, _ := url.Parse("http://localhost:8080/v1/pack?debug=1")
+	if got := routes[1].upstreamURL(requestURL).String(); got != "https://v1.example.com/base/v1/pack?debug=1" {
+		t.Errorf("upstreamURL() = %s", got)
+	}
+	if got := routes[3].upstreamURL(requestURL).String(); got != "https://api.paccurate.io/v1/pack?debug=1" {
+		t.Errorf("upstreamURL() = %s", got)
+	}
+}
+
+func TestIsLocalPath(t *testing.T) {
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{"/api", true},
+		{"/api/", true},
+		{"/api/unknown", true},
+		{"/api/keydata/keystem", true},
+		{"/metrics", true},
+		{"/metrics/extra", true},
+		{"/apiary", false},
+		{"/", false},
+		{"/v1/pack", false},
+	}
+	for _, test := range tests {
+		if got := isLocalPath(test.path); got != test.want {
+			t.Errorf("isLocalPath(%q) = %v, want %v", test.path, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"pacproxy/shared/config"
+	"pacproxy/shared/statistics"
+	"sync"
+	"time"
+)
+
+var errCircuitOpen = errors.New("circuit breaker is open")
+
+// upstreamClient sends requests to upstreams with a deadline, retries failures that are safe to retry
+// and stops calling an upstream that keeps failing, through one circuit breaker per upstream host
+type upstreamClient struct {
+	config   config.UpstreamConfig
+	client   *http.Client
+	mu       sync.Mutex
+	breakers map[string]*circuitBreaker
+}
+
+// upstreamOutcome describes how a request went through the upstream client
+type upstreamOutcome struct {
+	retries     int
+	circuitOpen bool // the request wasn't sent, since the upstream's circuit breaker was open
+}
+
+func newUpstreamClient(upstreamConfig config.UpstreamConfig) *upstreamClient {
+	return &upstreamClient{
+		config:   upstreamConfig,
+		client:   &http.Client{},
+		breakers: make(map[string]*circuitBreaker),
+	}
+}
+
+// packTimeout() returns the deadline of a pack request asking Paccurate for the given timeout in
+// milliseconds. Requests that don't ask for one get the configured timeout.
+func (u *upstreamClient) packTimeout(requested float64) time.Duration {
+	if requested <= 0 {
+		return u.config.Timeout
+	}
+	timeout := time.Duration(requested*float64(time.Millisecond)) + u.config.TimeoutGrace
+	return min(timeout, u.config.MaxTimeout)
+}
+
+// do() sends a request, giving up once the timeout has elapsed. If retrySafe is true, transport errors and
+// 502, 503 or 504 responses are retried with jittered exponential backoff, as long as the request's body can
+// be sent again. The last response is returned, even if it's an error response. Its body must be closed.
+func (u *upstreamClient) do(req *http.Request, timeout time.Duration, retrySafe bool) (*http.Response, upstreamOutcome, error) {
+	var outcome upstreamOutcome
+	breaker := u.breaker(req.URL.Host)
+	if !breaker.allow() {
+		outcome.circuitOpen = true
+		upstreamShortCircuits.Inc(req.URL.Host)
+		return nil, outcome, errCircuitOpen
+	}
+	retrySafe = retrySafe && (req.Body == nil || req.Body == http.NoBody || req.GetBody != nil)
+
+	ctx, cancel := context.WithTimeout(req.Context(), timeout)
+	for attempt := 0; ; attempt++ {
+		attemptReq, err := rewindRequest(ctx, req, attempt)
+		if err != nil {
+			cancel()
+			return nil, outcome, err
+		}
+		resp, err := u.client.Do(attemptReq)
+		failed := err != nil || isRetryableStatus(resp.StatusCode)
+		// The caller going away says nothing about the upstream's health
+		if req.Context().Err() == nil {
+			breaker.record(!failed)
+		}
+		if !failed || !retrySafe || attempt >= u.config.MaxRetries || !breaker.allow() {
+			if err != nil {
+				cancel()
+				upstreamErrors.Inc(req.URL.Host, classifyUpstreamError(err))
+				return nil, outcome, err
+			}
+			resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+			return resp, outcome, nil
+		}
+		if resp != nil {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+
+		// Wait a random time up to the backoff, which doubles on each attempt
+		backoff := time.Duration(rand.Int64N(int64(u.config.RetryBackoff<<attempt) + 1))
+		select {
+		case <-ctx.Done():
+			cancel()
+			upstreamErrors.Inc(req.URL.Host, classifyUpstreamError(ctx.Err()))
+			return nil, outcome, ctx.Err()
+		case <-time.After(backoff):
+		}
+		outcome.retries++
+		upstreamRetries.Inc(req.URL.Host)
+	}
+}
+
+// breaker() returns the circuit breaker of an upstream host
+func (u *upstreamClient) breaker(host string) *circuitBreaker {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	b, found := u.breakers[host]
+	if !found {
+		b = &circuitBreaker{threshold: u.config.BreakerThreshold, cooldown: u.config.BreakerCooldown}
+		u.breakers[host] = b
+	}
+	return b
+}
+
+// rewindRequest() returns a copy of a request for an attempt, with its body read again after the first one
+func rewindRequest(ctx context.Context, req *http.Request, attempt int) (*http.Request, error) {
+	attemptReq := req.Clone(ctx)
+	if attempt > 0 && req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		attemptReq.Body = body
+	}
+	return attemptReq, nil
+}
+
+// classifyUpstreamError() returns the class of an error that kept a request from getting a response
+// from an upstream, one of the statistics.ErrorClass constants
+func classifyUpstreamError(err error) string {
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	var opErr *net.OpError
+	var recordHeaderErr tls.RecordHeaderError
+	var alertErr tls.AlertError
+	var verificationErr *tls.CertificateVerificationError
+	var unknownAuthorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var invalidCertErr x509.CertificateInvalidError
+	switch {
+	case errors.Is(err, errCircuitOpen):
+		return statistics.ErrorClassCircuitOpen
+	case errors.As(err, &dnsErr):
+		return statistics.ErrorClassDNS
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return statistics.ErrorClassTimeout
+	case errors.As(err, &recordHeaderErr), errors.As(err, &alertErr), errors.As(err, &verificationErr),
+		errors.As(err, &unknownAuthorityErr), errors.As(err, &hostnameErr), errors.As(err, &invalidCertErr):
+		return statistics.ErrorClassTLS
+	case errors.As(err, &opErr) && opErr.Op == "dial":
+		return statistics.ErrorClassConnect
+	}
+	return statistics.ErrorClassOther
+}
+
+// upstreamErrorStatus() returns the status code answering a request whose upstream couldn't be reached:
+// 504 if it timed out, 503 if its circuit breaker was open, and 502 otherwise
+func upstreamErrorStatus(errorClass string) int {
+	switch errorClass {
+	case statistics.ErrorClassTimeout:
+		return http.StatusGatewayTimeout
+	case statistics.ErrorClassCircuitOpen:
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusBadGateway
+}
+
+func isRetryableStatus(statusCode int) bool {
+	return statusCode == http.StatusBadGateway || statusCode == http.StatusServiceUnavailable || statusCode == http.StatusGatewayTimeout
+}
+
+// isIdempotentMethod() reports whether a request with this method can be sent twice without side effects
+func isIdempotentMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// cancelOnClose releases a request's deadline once its response body is closed
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
+
+const (
+	breakerClosed int = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+// circuitBreaker opens after threshold consecutive failures, and rejects requests until cooldown has
+// elapsed. It then lets one request through: the breaker closes if it succeeds, and opens again if not.
+type circuitBreaker struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	state     int
+	failures  int
+	changed   time.Time // when the breaker last opened or let a request through while half open
+}
+
+// allow() reports whether a request can be sent
+func (b *circuitBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == breakerClosed {
+		return true
+	}
+	// While half open, another request is let through if the previous one never reported back
+	if time.Since(b.changed) < b.cooldown {
+		return false
+	}
+	b.state = breakerHalfOpen
+	b.changed = time.Now()
+	return true
+}
+
+// record() reports the outcome of a request
+func (b *circuitBreaker) record(success bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if success {
+		b.state = breakerClosed
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.state == breakerHalfOpen || b.failures >= b.threshold {
+		b.state = breakerOpen
+		b.changed = time.Now()
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"pacproxy/shared/config"
+	"pacproxy/shared/statistics"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func testUpstreamConfig() config.UpstreamConfig {
+	return config.UpstreamConfig{
+		Timeout:          time.Second,
+		TimeoutGrace:     time.Second,
+		MaxTimeout:       5 * time.Second,
+		MaxRetries:       2,
+		RetryBackoff:     time.Millisecond,
+		BreakerThreshold: 3,
+		BreakerCooldown:  time.Hour,
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	b := &circuitBreaker{threshold: 2, cooldown: time.Hour}
+	b.record(false)
+	if !b.allow() {
+		t.Fatal("breaker opened before reaching its threshold")
+	}
+	b.record(true)
+	b.record(false)
+	if !b.allow() {
+		t.Fatal("a success didn't reset the consecutive failures")
+	}
+	b.record(false)
+	if b.allow() {
+		t.Fatal("breaker didn't open after threshold consecutive failures")
+	}
+
+	// Once the cooldown has elapsed, a single request is let through
+	b.changed = time.Now().Add(-b.cooldown)
+	if !b.allow() {
+		t.Fatal("breaker didn't let a request through after its cooldown")
+	}
+	if b.allow() {
+		t.Fatal("half open breaker let a second request through")
+	}
+	b.record(false)
+	if b.state != breakerOpen || b.allow() {
+		t.Fatal("a failure while half open didn't open the breaker again")
+	}
+
+	b.changed = time.Now().Add(-b.cooldown)
+	b.allow()
+	b.record(true)
+	if b.state != breakerClosed || !b.allow() {
+		t.Fatal("a success while half open didn't close the breaker")
+	}
+
+	// A half open request that never reports back doesn't keep the breaker shut
+	b.state, b.changed = breakerHalfOpen, time.Now().Add(-b.cooldown)
+	if !b.allow() {
+		t.Error("breaker stayed shut after a half open request was lost")
+	}
+}
+
+func TestPackTimeout(t *testing.T) {
+	u := newUpstreamClient(testUpstreamConfig())
+	tests := []struct {
+		requested float64
+		want      time.Duration
+	}{
+		{0, time.Second},
+		{-1, time.Second},
+		{500, 1500 * time.Millisecond},
+		{10000, 5 * time.Second},
+	}
+	for _, test := range tests {
+		if got := u.packTimeout(test.requested); got != test.want {
+			t.Errorf("packTimeout(%v) = %s, want %s", test.requested, got, test.want)
+		}
+	}
+}
+
+func TestUpstreamRetries(t *testing.T) {
+	tests := []struct {
+		name        string
+		statuses    []int
+		method      string
+		retrySafe   bool
+		wantStatus  int
+		wantRetries int
+	}{
+		{"success", []int{200}, http.MethodGet, true, 200, 0},
+		{"recovers", []int{503, 502, 200}, http.MethodGet, true, 200, 2},
+		{"out of retries", []int{504, 504, 504, 200}, http.MethodGet, true, 504, 2},
+		{"client error", []int{400, 200}, http.MethodGet, true, 400, 0},
+		{"not retry safe", []int{503, 200}, http.MethodPost, false, 503, 0},
+		{"body replayed", []int{503, 200}, http.MethodPost, true, 200, 1},
+	}
+	for _, test := range tests {
+		var calls atomic.Int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			call := int(calls.Add(1)) - 1
+			if r.Method == http.MethodPost {
+				body := make([]byte, 4)
+				if n, _ := r.Body.Read(body); string(body[:n]) != "pack" {
+					t.Errorf("%s: attempt %d sent body %q", test.name, call, body[:n])
+				}
+			}
+			w.WriteHeader(test.statuses[min(call, len(test.statuses)-1)])
+		}))
+		u := newUpstreamClient(testUpstreamConfig())
+		u.config.BreakerThreshold = 10
+		req, _ := http.NewRequest(test.method, server.URL, strings.NewReader("pack"))
+		resp, outcome, err := u.do(req, time.Second, test.retrySafe)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+		} else {
+			resp.Body.Close()
+			if resp.StatusCode != test.wantStatus || outcome.retries != test.wantRetries {
+				t.Errorf("%s: got %d after %d retries, want %d after %d", test.name, resp.StatusCode, outcome.retries, test.wantStatus, test.wantRetries)
+			}
+		}
+		server.Close()
+	}
+}
+
+func TestUpstreamBreakerShortCircuits(t *testing.T) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+	u := newUpstreamClient(testUpstreamConfig())
+
+	// Retries stop once the breaker opens, so the threshold bounds the calls
+	req, _ := http.NewRequest(http.MethodGet, server.URL, nil)
+	resp, outcome, err := u.do(req, time.Second, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if calls.Load() != 3 || outcome.retries != 2 {
+		t.Errorf("made %d calls with %d retries, want 3 with 2", calls.Load(), outcome.retries)
+	}
+	u.config.MaxRetries = 10
+	resp, outcome, err = u.do(req, time.Second, true)
+	if !errors.Is(err, errCircuitOpen) || !outcome.circuitOpen || resp != nil {
+		t.Errorf("request to an open breaker returned %v", err)
+	}
+	if calls.Load() != 3 {
+		t.Errorf("open breaker let a request through")
+	}
+
+	// Breakers are kept per host
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer other.Close()
+	req, _ = http.NewRequest(http.MethodGet, other.URL, nil)
+	resp, _, err = u.do(req, time.Second, true)
+	if err != nil {
+		t.Fatalf("another host was short circuited: %s", err)
+	}
+	resp.Body.Close()
+}
+
+// A caller giving up doesn't count against the upstream
+func TestUpstreamCallerCanceled(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+	u := newUpstreamClient(testUpstreamConfig())
+	u.config.BreakerThreshold = 1
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL, nil)
+	if _, _, err := u.do(req, time.Second, true); err == nil {
+		t.Fatal("canceled request succeeded")
+	}
+	if !u.breaker(req.URL.Host).allow() {
+		t.Error("a canceled request opened the breaker")
+	}
+}
+
+func TestClassifyUpstreamError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{errCircuitOpen, statistics.ErrorClassCircuitOpen},
+		{&net.DNSError{Err: "no such host", Name: "paccurate.invalid"}, statistics.ErrorClassDNS},
+		{fmt.Errorf("request: %w", context.DeadlineExceeded), statistics.ErrorClassTimeout},
+		{&net.OpError{Op: "dial", Err: errors.New("connection refused")}, statistics.ErrorClassConnect},
+		{&net.OpError{Op: "read", Err: errors.New("connection reset")}, statistics.ErrorClassOther},
+		{errors.New("unexpected EOF"), statistics.ErrorClassOther},
+	}
+	for _, test := range tests {
+		if got := classifyUpstreamError(test.err); got != test.want {
+			t.Errorf("classifyUpstreamError(%v) = %s, want %s", test.err, got, test.want)
+		}
+	}
+	if upstreamErrorStatus(statistics.ErrorClassTimeout) != http.StatusGatewayTimeout ||
+		upstreamErrorStatus(statistics.ErrorClassCircuitOpen) != http.StatusServiceUnavailable ||
+		upstreamErrorStatus(statistics.ErrorClassDNS) != http.StatusBadGateway {
+		t.Error("upstreamErrorStatus() returned the wrong status")
+	}
+}
@@ -11,23 +11,234 @@ const (
 	MessageTypeStats  string = "stats"
 )
 
+const (
+	PartitionerFNV1a   string = "fnv1a"
+	PartitionerMurmur2 string = "murmur2"
+)
+
+const (
+	CacheBackendNone  string = "none"
+	CacheBackendLRU   string = "lru"
+	CacheBackendRedis string = "redis"
+)
+
+// Config is the configuration shared by the proxy and the aggregator. See Load().
+type Config struct {
+	Mongo      MongoConfig      `yaml:"mongo"`
+	Kafka      KafkaConfig      `yaml:"kafka"`
+	Proxy      ProxyConfig      `yaml:"proxy"`
+	Upstream   UpstreamConfig   `yaml:"upstream"`
+	Auth       AuthConfig       `yaml:"auth"`
+	Cache      CacheConfig      `yaml:"cache"`
+	Delivery   DeliveryConfig   `yaml:"delivery"`
+	Aggregator AggregatorConfig `yaml:"aggregator"`
+}
+
+type MongoConfig struct {
+	URI                   string        `yaml:"uri" secret:"true"`
+	Database              string        `yaml:"database"`
+	StatsCollection       string        `yaml:"statsCollection"`
+	BucketsCollection     string        `yaml:"bucketsCollection"`
+	SummaryCollection     string        `yaml:"summaryCollection"`
+	OffsetsCollection     string        `yaml:"offsetsCollection"`
+	DedupeCollection      string        `yaml:"dedupeCollection"`      // event IDs of recently consumed stats messages
+	MigrationsCollection  string        `yaml:"migrationsCollection"`  // applied schema migrations, and the lock held while applying them
+	CredentialsCollection string        `yaml:"credentialsCollection"` // keystem learned for each caller credential
+	APIKeysCollection     string        `yaml:"apiKeysCollection"`     // hashed API keys of the stats API
+	DeletionsCollection   string        `yaml:"deletionsCollection"`   // delete jobs and whether they were applied
+	EventsCollection      string        `yaml:"eventsCollection"`      // time-series archive of raw pack events
+	Timeout               time.Duration `yaml:"timeout"`
+}
+
 type KafkaConfig struct {
-	Brokers []string
-	Topic   string
+	Brokers           []string `yaml:"brokers"`
+	Topic             string   `yaml:"topic"`
+	ConsumerGroupID   string   `yaml:"consumerGroupId"`
+	Partitioner       string   `yaml:"partitioner"`       // hash of the keystem choosing a message's partition: PartitionerFNV1a or PartitionerMurmur2
+	CreateTopic       bool     `yaml:"createTopic"`       // create the topic at startup if it doesn't exist
+	Partitions        int32    `yaml:"partitions"`        // partitions of a created topic
+	ReplicationFactor int16    `yaml:"replicationFactor"` // replicas of each partition of a created topic
+}
+
+// ProxyConfig configures the proxy's HTTP server and its upstream
+type ProxyConfig struct {
+	ListenAddr   string        `yaml:"listenAddr"`
+	PaccurateURL string        `yaml:"paccurateUrl"`
+	Routes       []RouteConfig `yaml:"routes"`    // requests not served by the proxy itself go to the first matching route
+	RateLimit    float64       `yaml:"rateLimit"` // pack requests per second allowed for each keystem, or 0 for no limit
+	RateBurst    int           `yaml:"rateBurst"` // pack requests a keystem can send at once, above its rate
+}
+
+// RouteConfig forwards requests matching a path and method to an upstream, keeping their method, path
+// and query string
+type RouteConfig struct {
+	Path     string   `yaml:"path"`     // exact path, or a prefix if it ends with *, as in /v1/*
+	Methods  []string `yaml:"methods"`  // every method matches if empty
+	Upstream string   `yaml:"upstream"` // defaults to proxy.paccurateUrl
+	Stats    bool     `yaml:"stats"`    // requests are pack requests, which are cached and whose stats are sent to the aggregators
+}
+
+// UpstreamConfig configures how the proxy calls its upstreams
+type UpstreamConfig struct {
+	Timeout          time.Duration `yaml:"timeout"`          // deadline of requests that don't set their own
+	TimeoutGrace     time.Duration `yaml:"timeoutGrace"`     // added to a pack request's own timeout, for the network and queueing
+	MaxTimeout       time.Duration `yaml:"maxTimeout"`       // longest deadline a pack request can ask for
+	MaxRetries       int           `yaml:"maxRetries"`       // resend attempts after a transport error or a 502, 503 or 504
+	RetryBackoff     time.Duration `yaml:"retryBackoff"`     // maximum backoff before the first resend, doubled on each attempt
+	BreakerThreshold int           `yaml:"breakerThreshold"` // consecutive failures opening an upstream's circuit breaker
+	BreakerCooldown  time.Duration `yaml:"breakerCooldown"`  // how long an open circuit breaker rejects requests before letting one through
+}
+
+// AuthConfig configures the API keys required by the stats API
+type AuthConfig struct {
+	Enabled           bool          `yaml:"enabled"`                         // require an API key on /api endpoints
+	Forwarding        bool          `yaml:"forwarding"`                      // also require one on requests forwarded to upstreams
+	BootstrapAdminKey string        `yaml:"bootstrapAdminKey" secret:"true"` // admin key accepted without being stored, to create the first keys
+	KeyCacheTTL       time.Duration `yaml:"keyCacheTtl"`                     // how long a looked up key is trusted before it's looked up again
+}
+
+// CacheConfig configures the proxy's response cache
+type CacheConfig struct {
+	Backend       string        `yaml:"backend"`  // one of CacheBackendNone, CacheBackendLRU or CacheBackendRedis
+	Capacity      int           `yaml:"capacity"` // maximum number of entries held by the in-process LRU
+	TTL           time.Duration `yaml:"ttl"`      // how long a cached response stays valid
+	RedisAddr     string        `yaml:"redisAddr"`
+	RedisPassword string        `yaml:"redisPassword" secret:"true"`
+	RedisDB       int           `yaml:"redisDb"`
+}
+
+// DeliveryConfig configures how the proxy retries stats messages that Kafka didn't acknowledge
+type DeliveryConfig struct {
+	MaxRetries     int           `yaml:"maxRetries"`     // resend attempts before a message is written to the journal
+	RetryBackoff   time.Duration `yaml:"retryBackoff"`   // backoff before the first resend, doubled on each attempt
+	JournalPath    string        `yaml:"journalPath"`    // file holding messages that couldn't be delivered
+	ReplayInterval time.Duration `yaml:"replayInterval"` // how often journaled messages are resent
+}
+
+// AggregatorConfig configures how the aggregator writes to the database
+type AggregatorConfig struct {
+	DBWriteInterval time.Duration `yaml:"dbWriteInterval"` // minimum time between two writes of aggregated stats
+	MetricsAddr     string        `yaml:"metricsAddr"`     // address serving /metrics
+	DedupeWindow    int           `yaml:"dedupeWindow"`    // messages per partition whose event IDs are remembered to drop duplicates. 0 disables deduplication.
+	EventRetention  time.Duration `yaml:"eventRetention"`  // how long raw pack events are archived. 0 disables the archive.
+	EventBatchSize  int           `yaml:"eventBatchSize"`  // most pack events inserted in one batch
+}
+
+// Default() returns the configuration used when nothing is overridden
+func Default() *Config {
+	return &Config{
+		Mongo:      GetDefaultMongoConfig(),
+		Kafka:      GetDefaultKafkaConfig(),
+		Proxy:      GetDefaultProxyConfig(),
+		Upstream:   GetDefaultUpstreamConfig(),
+		Auth:       GetDefaultAuthConfig(),
+		Cache:      GetDefaultCacheConfig(),
+		Delivery:   GetDefaultDeliveryConfig(),
+		Aggregator: GetDefaultAggregatorConfig(),
+	}
+}
+
+func GetDefaultMongoConfig() MongoConfig {
+	return MongoConfig{
+		URI:                   "mongodb://localhost:27017",
+		Database:              "gator",
+		StatsCollection:       "statistics",
+		BucketsCollection:     "statisticsBuckets",
+		SummaryCollection:     "statisticsSummary",
+		OffsetsCollection:     "offsets",
+		DedupeCollection:      "dedupeWindow",
+		MigrationsCollection:  "migrations",
+		CredentialsCollection: "keystemCredentials",
+		APIKeysCollection:     "apiKeys",
+		DeletionsCollection:   "deletions",
+		EventsCollection:      "packEvents",
+		Timeout:               60 * time.Second,
+	}
 }
 
 func GetDefaultKafkaConfig() KafkaConfig {
 	return KafkaConfig{
-		Brokers: []string{"localhost:9092"},
-		Topic:   "statistics",
+		Brokers:           []string{"localhost:9092"},
+		Topic:             "statistics",
+		ConsumerGroupID:   "aggregators",
+		Partitioner:       PartitionerFNV1a,
+		CreateTopic:       true,
+		Partitions:        6,
+		ReplicationFactor: 1,
+	}
+}
+
+func GetDefaultProxyConfig() ProxyConfig {
+	return ProxyConfig{
+		ListenAddr:   ":8080",
+		PaccurateURL: "https://api.paccurate.io/",
+		Routes: []RouteConfig{
+			{Path: "/", Methods: []string{"POST"}, Stats: true},
+			{Path: "/*"},
+		},
+		RateLimit: 0,
+		RateBurst: 20,
+	}
+}
+
+func GetDefaultUpstreamConfig() UpstreamConfig {
+	return UpstreamConfig{
+		Timeout:          30 * time.Second,
+		TimeoutGrace:     2 * time.Second,
+		MaxTimeout:       2 * time.Minute,
+		MaxRetries:       2,
+		RetryBackoff:     200 * time.Millisecond,
+		BreakerThreshold: 5,
+		BreakerCooldown:  30 * time.Second,
+	}
+}
+
+func GetDefaultAuthConfig() AuthConfig {
+	return AuthConfig{
+		Enabled:     true,
+		Forwarding:  false,
+		KeyCacheTTL: 30 * time.Second,
+	}
+}
+
+func GetDefaultCacheConfig() CacheConfig {
+	return CacheConfig{
+		Backend:   CacheBackendLRU,
+		Capacity:  10000,
+		TTL:       24 * time.Hour,
+		RedisAddr: "localhost:6379",
+	}
+}
+
+func GetDefaultDeliveryConfig() DeliveryConfig {
+	return DeliveryConfig{
+		MaxRetries:     5,
+		RetryBackoff:   500 * time.Millisecond,
+		JournalPath:    "pacproxy-journal.jsonl",
+		ReplayInterval: 30 * time.Second,
+	}
+}
+
+func GetDefaultAggregatorConfig() AggregatorConfig {
+	return AggregatorConfig{
+		DBWriteInterval: 5 * time.Second,
+		MetricsAddr:     ":9100",
+		DedupeWindow:    100000,
+		EventRetention:  7 * 24 * time.Hour,
+		EventBatchSize:  1000,
 	}
 }
 
 func GetSaramaConfig() *sarama.Config {
 	config := sarama.NewConfig()
-	config.Producer.RequiredAcks = sarama.WaitForLocal
-	config.Producer.Return.Successes = false
-	config.Producer.Return.Errors = false
+	// The idempotent producer lets the broker discard duplicates caused by its own retries
+	config.Producer.Idempotent = true
+	config.Producer.RequiredAcks = sarama.WaitForAll
+	config.Producer.Retry.Max = 5
+	config.Net.MaxOpenRequests = 1
+	// Successes and errors are drained by the proxy's delivery supervisor
+	config.Producer.Return.Successes = true
+	config.Producer.Return.Errors = true
 	config.Consumer.Offsets.AutoCommit.Enable = true
 	config.Consumer.Offsets.AutoCommit.Interval = 1 * time.Second
 	config.Consumer.Group.Rebalance.GroupStrategies = []sarama.BalanceStrategy{sarama.NewBalanceStrategySticky()}
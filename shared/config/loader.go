@@ -0,0 +1,281 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	envPrefix      string = "PACPROXY_"
+	configFileEnv  string = envPrefix + "CONFIG"
+	configFileFlag string = "config"
+	redacted       string = "REDACTED"
+)
+
+// setting is one configurable value, named by its dotted yaml path (e.g. mongo.uri)
+type setting struct {
+	name   string
+	value  reflect.Value
+	secret bool
+}
+
+// Load() builds the configuration from, in increasing order of precedence: defaults, a YAML or JSON
+// config file, environment variables and command line flags. The file is named by the -config flag or
+// PACPROXY_CONFIG. Every setting can be overridden by a flag named after its path in the file, such as
+// -mongo.uri, or by an environment variable like PACPROXY_MONGO_URI. Lists are comma separated.
+func Load(args []string) (*Config, error) {
+	cfg := Default()
+	settings := cfg.settings()
+
+	flags := flag.NewFlagSet("pacproxy", flag.ContinueOnError)
+	configFile := flags.String(configFileFlag, os.Getenv(configFileEnv), "YAML or JSON config file")
+	flagValues := make(map[string]*string)
+	settingsByName := make(map[string]setting)
+	for _, s := range settings {
+		flagValues[s.name] = flags.String(s.name, "", "overrides "+s.name)
+		settingsByName[s.name] = s
+	}
+	err := flags.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+
+	if *configFile != "" {
+		err = cfg.loadFile(*configFile)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't load config file %s: %s", *configFile, err)
+		}
+	}
+	for _, s := range settings {
+		if raw, ok := os.LookupEnv(envName(s.name)); ok {
+			if err = setValue(s.value, raw); err != nil {
+				return nil, fmt.Errorf("invalid %s: %s", envName(s.name), err)
+			}
+		}
+	}
+	// Only flags that were actually passed override the other sources
+	flags.Visit(func(f *flag.Flag) {
+		s, ok := settingsByName[f.Name]
+		if !ok || err != nil {
+			return
+		}
+		if setErr := setValue(s.value, *flagValues[f.Name]); setErr != nil {
+			err = fmt.Errorf("invalid -%s: %s", f.Name, setErr)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = cfg.Validate()
+	if err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// Validate() checks that the configuration can be used
+func (cfg *Config) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+	check(cfg.Mongo.URI != "", "mongo.uri is required")
+	check(cfg.Mongo.Database != "", "mongo.database is required")
+	check(cfg.Mongo.StatsCollection != "" && cfg.Mongo.BucketsCollection != "" && cfg.Mongo.SummaryCollection != "" && cfg.Mongo.OffsetsCollection != "" && cfg.Mongo.DedupeCollection != "" && cfg.Mongo.MigrationsCollection != "" && cfg.Mongo.CredentialsCollection != "" && cfg.Mongo.APIKeysCollection != "" && cfg.Mongo.DeletionsCollection != "" && cfg.Mongo.EventsCollection != "", "mongo collection names are required")
+	check(cfg.Mongo.Timeout > 0, "mongo.timeout must be positive")
+	check(len(cfg.Kafka.Brokers) > 0, "kafka.brokers is required")
+	check(cfg.Kafka.Topic != "", "kafka.topic is required")
+	check(cfg.Kafka.ConsumerGroupID != "", "kafka.consumerGroupId is required")
+	check(cfg.Kafka.Partitioner == PartitionerFNV1a || cfg.Kafka.Partitioner == PartitionerMurmur2,
+		"kafka.partitioner must be one of %s or %s", PartitionerFNV1a, PartitionerMurmur2)
+	check(cfg.Kafka.Partitions > 0, "kafka.partitions must be positive")
+	check(cfg.Kafka.ReplicationFactor > 0, "kafka.replicationFactor must be positive")
+	check(cfg.Proxy.ListenAddr != "", "proxy.listenAddr is required")
+	check(isAbsoluteURL(cfg.Proxy.PaccurateURL), "proxy.paccurateUrl must be an absolute URL")
+	check(len(cfg.Proxy.Routes) > 0, "proxy.routes is required")
+	for i, route := range cfg.Proxy.Routes {
+		check(strings.HasPrefix(route.Path, "/"), "proxy.routes[%d].path must start with /", i)
+		check(route.Upstream == "" || isAbsoluteURL(route.Upstream), "proxy.routes[%d].upstream must be an absolute URL", i)
+		for _, method := range route.Methods {
+			check(method != "" && method == strings.ToUpper(method), "proxy.routes[%d].methods must be upper case", i)
+		}
+	}
+	check(cfg.Proxy.RateLimit >= 0, "proxy.rateLimit can't be negative")
+	check(cfg.Proxy.RateLimit == 0 || cfg.Proxy.RateBurst > 0, "proxy.rateBurst must be positive when proxy.rateLimit is set")
+	check(cfg.Upstream.Timeout > 0, "upstream.timeout must be positive")
+	check(cfg.Upstream.TimeoutGrace >= 0, "upstream.timeoutGrace can't be negative")
+	check(cfg.Upstream.MaxTimeout >= cfg.Upstream.Timeout, "upstream.maxTimeout can't be shorter than upstream.timeout")
+	check(cfg.Upstream.MaxRetries >= 0, "upstream.maxRetries can't be negative")
+	check(cfg.Upstream.RetryBackoff > 0, "upstream.retryBackoff must be positive")
+	check(cfg.Upstream.BreakerThreshold > 0, "upstream.breakerThreshold must be positive")
+	check(cfg.Upstream.BreakerCooldown > 0, "upstream.breakerCooldown must be positive")
+	check(cfg.Auth.KeyCacheTTL >= 0, "auth.keyCacheTtl can't be negative")
+	check(cfg.Auth.Enabled || !cfg.Auth.Forwarding, "auth.forwarding requires auth.enabled")
+	switch cfg.Cache.Backend {
+	case CacheBackendNone, CacheBackendLRU:
+	case CacheBackendRedis:
+		check(cfg.Cache.RedisAddr != "", "cache.redisAddr is required by the redis backend")
+	default:
+		errs = append(errs, fmt.Errorf("cache.backend must be one of %s, %s or %s", CacheBackendNone, CacheBackendLRU, CacheBackendRedis))
+	}
+	check(cfg.Cache.Capacity >= 0, "cache.capacity can't be negative")
+	check(cfg.Cache.TTL >= 0, "cache.ttl can't be negative")
+	check(cfg.Delivery.MaxRetries >= 0, "delivery.maxRetries can't be negative")
+	check(cfg.Delivery.RetryBackoff > 0, "delivery.retryBackoff must be positive")
+	check(cfg.Delivery.JournalPath != "", "delivery.journalPath is required")
+	check(cfg.Delivery.ReplayInterval > 0, "delivery.replayInterval must be positive")
+	check(cfg.Aggregator.DBWriteInterval >= 0, "aggregator.dbWriteInterval can't be negative")
+	check(cfg.Aggregator.MetricsAddr != "", "aggregator.metricsAddr is required")
+	check(cfg.Aggregator.DedupeWindow >= 0, "aggregator.dedupeWindow can't be negative")
+	check(cfg.Aggregator.EventRetention == 0 || cfg.Aggregator.EventRetention >= time.Second, "aggregator.eventRetention must be 0 or at least 1s")
+	check(cfg.Aggregator.EventBatchSize >= 1, "aggregator.eventBatchSize must be at least 1")
+	return errors.Join(errs...)
+}
+
+func isAbsoluteURL(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && u.Scheme != "" && u.Host != ""
+}
+
+// Redacted() returns the configuration as YAML, with secrets removed
+func (cfg *Config) Redacted() string {
+	redactedCfg := *cfg
+	for _, s := range redactedCfg.settings() {
+		if !s.secret || s.value.String() == "" {
+			continue
+		}
+		if u, err := url.Parse(s.value.String()); err == nil && u.User != nil {
+			// Keep URIs readable, only hiding their credentials
+			u.User = url.UserPassword(redacted, redacted)
+			s.value.SetString(u.String())
+		} else {
+			s.value.SetString(redacted)
+		}
+	}
+	out, err := yaml.Marshal(&redactedCfg)
+	if err != nil {
+		return err.Error()
+	}
+	return string(out)
+}
+
+// loadFile() applies a YAML config file. JSON files are parsed too, since JSON is a subset of YAML.
+func (cfg *Config) loadFile(path string) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	decoder := yaml.NewDecoder(bytes.NewReader(content))
+	decoder.KnownFields(true)
+	err = decoder.Decode(cfg)
+	if errors.Is(err, io.EOF) {
+		return nil // empty file
+	}
+	return err
+}
+
+// settings() lists every configurable value, with pointers into cfg
+func (cfg *Config) settings() []setting {
+	var settings []setting
+	collectSettings(reflect.ValueOf(cfg).Elem(), "", &settings)
+	return settings
+}
+
+func collectSettings(v reflect.Value, prefix string, settings *[]setting) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := strings.Split(field.Tag.Get("yaml"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+		if prefix != "" {
+			name = prefix + "." + name
+		}
+		if field.Type.Kind() == reflect.Struct {
+			collectSettings(v.Field(i), name, settings)
+			continue
+		}
+		if field.Type.Kind() == reflect.Slice && field.Type.Elem().Kind() == reflect.Struct {
+			continue // lists of structs, such as proxy.routes, can only be set in the config file
+		}
+		*settings = append(*settings, setting{name: name, value: v.Field(i), secret: field.Tag.Get("secret") == "true"})
+	}
+}
+
+// envName() returns the environment variable overriding a setting, e.g. PACPROXY_MONGO_URI for mongo.uri
+func envName(name string) string {
+	var b strings.Builder
+	b.WriteString(envPrefix)
+	for i, r := range name {
+		switch {
+		case r == '.':
+			b.WriteRune('_')
+		case r >= 'A' && r <= 'Z':
+			if i > 0 && name[i-1] != '.' {
+				b.WriteRune('_')
+			}
+			b.WriteRune(r)
+		default:
+			b.WriteString(strings.ToUpper(string(r)))
+		}
+	}
+	return b.String()
+}
+
+// setValue() parses raw into a setting according to its type
+func setValue(v reflect.Value, raw string) error {
+	switch {
+	case v.Type() == reflect.TypeOf(time.Duration(0)):
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(d))
+	case v.Kind() == reflect.String:
+		v.SetString(raw)
+	case v.Kind() == reflect.Int || v.Kind() == reflect.Int32 || v.Kind() == reflect.Int16:
+		n, err := strconv.ParseInt(raw, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case v.Kind() == reflect.Float64:
+		f, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+	case v.Kind() == reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.String:
+		var items []string
+		for _, item := range strings.Split(raw, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		v.Set(reflect.ValueOf(items))
+	default:
+		return fmt.Errorf("unsupported setting type %s", v.Type())
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package config
+
+import (
+	"os"
+	"regexp"
+	"testing"
+)
+
+func TestSecretEnvNames(t *testing.T) {
+	want := map[string]string{
+		"mongo.uri":              "PACPROXY_MONGO_URI",
+		"auth.bootstrapAdminKey": "PACPROXY_AUTH_BOOTSTRAP_ADMIN_KEY",
+		"cache.redisPassword":    "PACPROXY_CACHE_REDIS_PASSWORD",
+	}
+	secrets := 0
+	for _, s := range Default().settings() {
+		if !s.secret {
+			continue
+		}
+		secrets++
+		expected, ok := want[s.name]
+		if !ok {
+			t.Errorf("secret setting %s has no expected environment variable", s.name)
+			continue
+		}
+		if got := envName(s.name); got != expected {
+			t.Errorf("envName(%q) = %s, want %s", s.name, got, expected)
+		}
+	}
+	if secrets != len(want) {
+		t.Errorf("found %d secret settings, want %d", secrets, len(want))
+	}
+
+	t.Setenv("PACPROXY_AUTH_BOOTSTRAP_ADMIN_KEY", "bootstrap")
+	cfg, err := Load(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Auth.BootstrapAdminKey != "bootstrap" {
+		t.Errorf("auth.bootstrapAdminKey = %q, want it set from the environment", cfg.Auth.BootstrapAdminKey)
+	}
+}
+
+// Environment variables named in the docs must be read by Load()
+func TestDocumentedEnvNames(t *testing.T) {
+	known := map[string]bool{configFileEnv: true}
+	for _, s := range Default().settings() {
+		known[envName(s.name)] = true
+	}
+	for _, file := range []string{"../../README.md", "../../docker-compose.yml"} {
+		content, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range regexp.MustCompile(`PACPROXY_[A-Z0-9_]+`).FindAllString(string(content), -1) {
+			if !known[name] {
+				t.Errorf("%s names %s, which isn't read by Load()", file, name)
+			}
+		}
+	}
+}
+
+func TestEnvName(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"mongo.uri", "PACPROXY_MONGO_URI"},
+		{"kafka.consumerGroupId", "PACPROXY_KAFKA_CONSUMER_GROUP_ID"},
+		{"proxy.paccurateUrl", "PACPROXY_PROXY_PACCURATE_URL"},
+		{"auth.keyCacheTtl", "PACPROXY_AUTH_KEY_CACHE_TTL"},
+		{"aggregator.dbWriteInterval", "PACPROXY_AGGREGATOR_DB_WRITE_INTERVAL"},
+		{"upstream.maxRetries", "PACPROXY_UPSTREAM_MAX_RETRIES"},
+	}
+	for _, test := range tests {
+		if got := envName(test.name); got != test.want {
+			t.Errorf("envName(%q) = %s, want %s", test.name, got, test.want)
+		}
+	}
+}
+
+// Flags override environment variables, which override the config file
+func TestLoadPrecedence(t *testing.T) {
+	file := t.TempDir() + "/pacproxy.yaml"
+	err := os.WriteFile(file, []byte("proxy:\n  listenAddr: file:1\nmongo:\n  database: file\nkafka:\n  topic: file\n"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(configFileEnv, file)
+	t.Setenv("PACPROXY_PROXY_LISTEN_ADDR", "env:1")
+	t.Setenv("PACPROXY_MONGO_DATABASE", "env")
+	cfg, err := Load([]string{"-proxy.listenAddr", "flag:1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Proxy.ListenAddr != "flag:1" {
+		t.Errorf("proxy.listenAddr = %s, want it from the flag", cfg.Proxy.ListenAddr)
+	}
+	if cfg.Mongo.Database != "env" {
+		t.Errorf("mongo.database = %s, want it from the environment", cfg.Mongo.Database)
+	}
+	if cfg.Kafka.Topic != "file" {
+		t.Errorf("kafka.topic = %s, want it from the file", cfg.Kafka.Topic)
+	}
+
+	t.Setenv("PACPROXY_UPSTREAM_MAX_RETRIES", "many")
+	if _, err = Load(nil); err == nil {
+		t.Error("an invalid environment variable was accepted")
+	}
+}
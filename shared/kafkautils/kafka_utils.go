@@ -0,0 +1,129 @@
+package kafkautils
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"pacproxy/shared/config"
+
+	"github.com/IBM/sarama"
+)
+
+// keystemPartitioner sends every message keyed on a keystem to the same partition, so that the stats
+// and delete requests of a keystem are consumed in the order they were produced
+type keystemPartitioner struct {
+	hash func(key []byte) uint32
+}
+
+// NewKeystemPartitioner() returns a partitioner hashing message keys with the given algorithm, one of
+// config.PartitionerFNV1a or config.PartitionerMurmur2. murmur2 matches the default partitioner of
+// Kafka's Java clients.
+func NewKeystemPartitioner(algorithm string) sarama.PartitionerConstructor {
+	hash := fnv1a
+	if algorithm == config.PartitionerMurmur2 {
+		hash = murmur2
+	}
+	return func(topic string) sarama.Partitioner {
+		return &keystemPartitioner{hash: hash}
+	}
+}
+
+// Partition() chooses a partition from the key's hash and the topic's partition count, read by the
+// producer from the topic's metadata. Messages without a key go to the partition of the empty keystem.
+func (p *keystemPartitioner) Partition(message *sarama.ProducerMessage, numPartitions int32) (int32, error) {
+	if numPartitions <= 0 {
+		return -1, fmt.Errorf("topic %s has no partitions", message.Topic)
+	}
+	var key []byte
+	if message.Key != nil {
+		var err error
+		key, err = message.Key.Encode()
+		if err != nil {
+			return -1, err
+		}
+	}
+	// Clear the sign bit, as Kafka's Java clients do
+	return int32((p.hash(key) & 0x7fffffff) % uint32(numPartitions)), nil
+}
+
+// RequiresConsistency() is true, so that a keystem's partition is used even while it's unavailable
+func (p *keystemPartitioner) RequiresConsistency() bool {
+	return true
+}
+
+func fnv1a(key []byte) uint32 {
+	h := fnv.New32a()
+	h.Write(key)
+	return h.Sum32()
+}
+
+// murmur2() is the 32-bit MurmurHash2 variant used by Kafka's Java clients
+func murmur2(key []byte) uint32 {
+	const (
+		seed uint32 = 0x9747b28c
+		m    uint32 = 0x5bd1e995
+		r           = 24
+	)
+	length := len(key)
+	h := seed ^ uint32(length)
+	for i := 0; i+4 <= length; i += 4 {
+		k := binary.LittleEndian.Uint32(key[i:])
+		k *= m
+		k ^= k >> r
+		k *= m
+		h *= m
+		h ^= k
+	}
+	tail := key[length&^3:]
+	switch len(tail) {
+	case 3:
+		h ^= uint32(tail[2]) << 16
+		fallthrough
+	case 2:
+		h ^= uint32(tail[1]) << 8
+		fallthrough
+	case 1:
+		h ^= uint32(tail[0])
+		h *= m
+	}
+	h ^= h >> 13
+	h *= m
+	h ^= h >> 15
+	return h
+}
+
+// EnsureTopic() creates the configured topic if it doesn't exist and topic creation is enabled. Partitions
+// are never added to an existing topic, since that would move keystems to other partitions.
+func EnsureTopic(kafkaConfig config.KafkaConfig) error {
+	if !kafkaConfig.CreateTopic {
+		return nil
+	}
+	admin, err := sarama.NewClusterAdmin(kafkaConfig.Brokers, config.GetSaramaConfig())
+	if err != nil {
+		return err
+	}
+	defer admin.Close()
+
+	topics, err := admin.ListTopics()
+	if err != nil {
+		return err
+	}
+	if detail, found := topics[kafkaConfig.Topic]; found {
+		if detail.NumPartitions != kafkaConfig.Partitions {
+			slog.Warn(fmt.Sprintf("topic %s has %d partitions rather than the configured %d, and is used as is",
+				kafkaConfig.Topic, detail.NumPartitions, kafkaConfig.Partitions))
+		}
+		return nil
+	}
+	detail := &sarama.TopicDetail{NumPartitions: kafkaConfig.Partitions, ReplicationFactor: kafkaConfig.ReplicationFactor}
+	err = admin.CreateTopic(kafkaConfig.Topic, detail, false)
+	if errors.Is(err, sarama.ErrTopicAlreadyExists) {
+		return nil // created by another instance in the meantime
+	} else if err != nil {
+		return err
+	}
+	slog.Info(fmt.Sprintf("created topic %s with %d partitions", kafkaConfig.Topic, kafkaConfig.Partitions))
+	return nil
+}
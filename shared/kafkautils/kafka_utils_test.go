@@ -0,0 +1,100 @@
+package kafkautils
+
+import (
+	"fmt"
+	"pacproxy/shared/config"
+	"testing"
+
+	"github.com/IBM/sarama"
+)
+
+// Reference hashes from the tests of Kafka's Utils.murmur2()
+func TestMurmur2(t *testing.T) {
+	tests := []struct {
+		key  string
+		want int32
+	}{
+		{"21", -973932308},
+		{"foobar", -790332482},
+		{"a-little-bit-long-string", -985981536},
+		{"a-little-bit-longer-string", -1486304829},
+		{"lkjh234lh9fiuh90y23oiuhsafujhadof229phr9h19h89h8", -58897971},
+		{"abc", 479470107},
+	}
+	for _, test := range tests {
+		if got := int32(murmur2([]byte(test.key))); got != test.want {
+			t.Errorf("murmur2(%q) = %d, want %d", test.key, got, test.want)
+		}
+	}
+}
+
+// Reference hashes of the FNV-1a specification
+func TestFNV1a(t *testing.T) {
+	tests := []struct {
+		key  string
+		want uint32
+	}{
+		{"", 0x811c9dc5},
+		{"a", 0xe40c292c},
+		{"foobar", 0xbf9cf968},
+	}
+	for _, test := range tests {
+		if got := fnv1a([]byte(test.key)); got != test.want {
+			t.Errorf("fnv1a(%q) = %#x, want %#x", test.key, got, test.want)
+		}
+	}
+}
+
+func TestKeystemPartitioner(t *testing.T) {
+	// murmur2 partitions match those Kafka's Java clients pick with toPositive(murmur2(key)) % partitions
+	tests := []struct {
+		algorithm string
+		key       string
+		want      int32
+	}{
+		{config.PartitionerMurmur2, "21", 0},
+		{config.PartitionerMurmur2, "foobar", 6},
+		{config.PartitionerMurmur2, "abc", 3},
+		{config.PartitionerFNV1a, "foobar", 8},
+		{config.PartitionerFNV1a, "", int32((0x811c9dc5 & 0x7fffffff) % 12)},
+		{"", "foobar", 8}, // fnv1a is the default
+	}
+	for _, test := range tests {
+		partitioner := NewKeystemPartitioner(test.algorithm)("stats")
+		got, err := partitioner.Partition(&sarama.ProducerMessage{Topic: "stats", Key: sarama.StringEncoder(test.key)}, 12)
+		if err != nil || got != test.want {
+			t.Errorf("%s partition of %q = %d, %v, want %d", test.algorithm, test.key, got, err, test.want)
+		}
+	}
+
+	// Every message of a keystem goes to the same partition, whichever partitioner instance picks it
+	for _, algorithm := range []string{config.PartitionerFNV1a, config.PartitionerMurmur2} {
+		partitions := make(map[int32]bool)
+		for i := range 100 {
+			keystem := fmt.Sprintf("keystem-%d", i)
+			first, _ := NewKeystemPartitioner(algorithm)("stats").Partition(&sarama.ProducerMessage{Key: sarama.StringEncoder(keystem)}, 12)
+			second, _ := NewKeystemPartitioner(algorithm)("stats").Partition(&sarama.ProducerMessage{Key: sarama.ByteEncoder(keystem)}, 12)
+			if first != second || first < 0 || first >= 12 {
+				t.Errorf("%s sent keystem %s to partitions %d and %d", algorithm, keystem, first, second)
+			}
+			partitions[first] = true
+		}
+		if len(partitions) < 6 {
+			t.Errorf("%s spread 100 keystems over only %d of 12 partitions", algorithm, len(partitions))
+		}
+	}
+
+	// Messages without a key go to the partition of the empty keystem
+	partitioner := NewKeystemPartitioner(config.PartitionerFNV1a)("stats")
+	unkeyed, _ := partitioner.Partition(&sarama.ProducerMessage{}, 12)
+	empty, _ := partitioner.Partition(&sarama.ProducerMessage{Key: sarama.StringEncoder("")}, 12)
+	if unkeyed != empty {
+		t.Errorf("unkeyed message sent to partition %d, and the empty keystem to %d", unkeyed, empty)
+	}
+	if _, err := partitioner.Partition(&sarama.ProducerMessage{Topic: "stats"}, 0); err == nil {
+		t.Error("a topic without partitions was accepted")
+	}
+	if !partitioner.RequiresConsistency() {
+		t.Error("the partitioner doesn't require consistency")
+	}
+}
@@ -0,0 +1,89 @@
+package metrics
+
+import (
+	"math"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWriteText(t *testing.T) {
+	r := NewRegistry()
+	requests := r.NewCounterVec("pacproxy_requests_total", "Pack requests.\nBy route", "route", "status")
+	inFlight := r.NewGaugeVec("pacproxy_in_flight", `Requests in "flight"`)
+	latency := r.NewHistogramVec("pacproxy_latency_seconds", "Latency", []float64{1, 0.1, 0.5}, "route")
+	r.NewCounterVec("pacproxy_unused_total", "Never incremented")
+
+	requests.Inc("/pack", "200")
+	requests.Add(2, "/pack", "200")
+	requests.Add(-1, "/pack", "200") // counters never decrease
+	requests.Inc(`/a"b\c`+"\n", "500")
+	inFlight.Set(3)
+	inFlight.Add(-1)
+	for _, v := range []float64{0.05, 0.1, 0.3, 0.5, 0.7, 2} {
+		latency.Observe(v, "/pack")
+	}
+
+	var b strings.Builder
+	if err := r.WriteText(&b); err != nil {
+		t.Fatal(err)
+	}
+	// Histogram buckets are cumulative and include observations equal to their upper bound
+	want := `# HELP pacproxy_requests_total Pack requests.\nBy route
+# TYPE pacproxy_requests_total counter
+pacproxy_requests_total{route="/a\"b\\c\n",status="500"} 1
+pacproxy_requests_total{route="/pack",status="200"} 3
+# HELP pacproxy_in_flight Requests in "flight"
+# TYPE pacproxy_in_flight gauge
+pacproxy_in_flight 2
+# HELP pacproxy_latency_seconds Latency
+# TYPE pacproxy_latency_seconds histogram
+pacproxy_latency_seconds_bucket{route="/pack",le="0.1"} 2
+pacproxy_latency_seconds_bucket{route="/pack",le="0.5"} 4
+pacproxy_latency_seconds_bucket{route="/pack",le="1"} 5
+pacproxy_latency_seconds_bucket{route="/pack",le="+Inf"} 6
+pacproxy_latency_seconds_sum{route="/pack"} 3.65
+pacproxy_latency_seconds_count{route="/pack"} 6
+# HELP pacproxy_unused_total Never incremented
+# TYPE pacproxy_unused_total counter
+`
+	if b.String() != want {
+		t.Errorf("WriteText() wrote\n%s\nwant\n%s", b.String(), want)
+	}
+
+	recorder := httptest.NewRecorder()
+	r.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	if recorder.Header().Get("Content-Type") != contentType || recorder.Body.String() != want {
+		t.Errorf("ServeHTTP() served %s: %s", recorder.Header().Get("Content-Type"), recorder.Body)
+	}
+}
+
+func TestLabelCount(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("a counter accepted the wrong number of label values")
+		}
+	}()
+	NewRegistry().NewCounterVec("pacproxy_requests_total", "Pack requests", "route").Inc()
+}
+
+func TestFormatValue(t *testing.T) {
+	tests := []struct {
+		v    float64
+		want string
+	}{
+		{0, "0"},
+		{1.5, "1.5"},
+		{-2, "-2"},
+		{0.005, "0.005"},
+		{1e21, "1e+21"},
+		{math.Inf(1), "+Inf"},
+		{math.Inf(-1), "-Inf"},
+		{math.NaN(), "NaN"},
+	}
+	for _, test := range tests {
+		if got := formatValue(test.v); got != test.want {
+			t.Errorf("formatValue(%v) = %s, want %s", test.v, got, test.want)
+		}
+	}
+}
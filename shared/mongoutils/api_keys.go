@@ -0,0 +1,70 @@
+package mongoutils
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+// API key of the stats API. Only a hash of the key is stored, and keys are managed through their ID.
+type APIKey struct {
+	KeyHash   string    `json:"-" bson:"_id"`
+	ID        string    `json:"id" bson:"id"`
+	Name      string    `json:"name" bson:"name"`
+	Role      string    `json:"role" bson:"role"`
+	Keystems  []string  `json:"keystems" bson:"keystems"` // keystems the key can read, or every keystem if empty
+	CreatedAt time.Time `json:"createdAt" bson:"createdAt"`
+}
+
+// CreateAPIKey() stores a new API key
+func CreateAPIKey(ctx context.Context, client *mongo.Client, apiKey *APIKey) error {
+	_, err := client.Database(dbName).Collection(apiKeysCollection).InsertOne(ctx, apiKey)
+	return err
+}
+
+// GetAPIKey() returns the API key with the given hash, or nil if there's none
+func GetAPIKey(ctx context.Context, client *mongo.Client, keyHash string) (*APIKey, error) {
+	var apiKey APIKey
+	err := client.Database(dbName).Collection(apiKeysCollection).FindOne(ctx, bson.M{"_id": keyHash}).Decode(&apiKey)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &apiKey, nil
+}
+
+// CountAPIKeys() returns the number of stored API keys
+func CountAPIKeys(ctx context.Context, client *mongo.Client) (int64, error) {
+	return client.Database(dbName).Collection(apiKeysCollection).CountDocuments(ctx, bson.M{})
+}
+
+// ListAPIKeys() returns every API key, oldest first
+func ListAPIKeys(ctx context.Context, client *mongo.Client) ([]*APIKey, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "createdAt", Value: 1}})
+	cursor, err := client.Database(dbName).Collection(apiKeysCollection).Find(ctx, bson.M{}, opts)
+	if err != nil {
+		return nil, err
+	}
+	apiKeys := []*APIKey{}
+	err = cursor.All(ctx, &apiKeys)
+	if err != nil {
+		return nil, err
+	}
+	return apiKeys, nil
+}
+
+// DeleteAPIKey() revokes the API key with the given ID, returning its hash, or "" if there's none
+func DeleteAPIKey(ctx context.Context, client *mongo.Client, id string) (string, error) {
+	var apiKey APIKey
+	err := client.Database(dbName).Collection(apiKeysCollection).FindOneAndDelete(ctx, bson.M{"id": id}).Decode(&apiKey)
+	if err == mongo.ErrNoDocuments {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	return apiKey.KeyHash, nil
+}
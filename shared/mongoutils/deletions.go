@@ -0,0 +1,97 @@
+package mongoutils
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+)
+
+// Statuses of a delete job
+const (
+	DeletionPending string = "pending" // sent to the aggregators
+	DeletionApplied string = "applied" // written to the database by an aggregator
+	DeletionFailed  string = "failed"  // couldn't be sent to the aggregators, or nothing could be deleted
+)
+
+// Delete job, created by the proxy when a delete is requested and marked applied by the aggregator
+// consuming the request
+type DeletionJob struct {
+	ID          string     `json:"id" bson:"_id"`
+	UsedKeystem string     `json:"usedKeystem" bson:"usedKeystem"`
+	From        *time.Time `json:"from,omitempty" bson:"from,omitempty"`
+	To          *time.Time `json:"to,omitempty" bson:"to,omitempty"`
+	Status      string     `json:"status" bson:"status"`
+	Reason      string     `json:"reason,omitempty" bson:"reason,omitempty"` // why the job failed
+	RequestedAt time.Time  `json:"requestedAt" bson:"requestedAt"`
+	AppliedAt   *time.Time `json:"appliedAt,omitempty" bson:"appliedAt,omitempty"`
+	Partition   *int32     `json:"partition,omitempty" bson:"partition,omitempty"` // Kafka partition and offset the request was consumed at
+	Offset      *int64     `json:"offset,omitempty" bson:"offset,omitempty"`
+}
+
+// Delete request consumed by an aggregator, to be marked applied once written, or failed if FailureReason is set
+type AppliedDeletion struct {
+	ID            string
+	Partition     int32
+	Offset        int64
+	FailureReason string
+}
+
+// CreateDeletion() stores a new delete job
+func CreateDeletion(ctx context.Context, client *mongo.Client, job *DeletionJob) error {
+	_, err := client.Database(dbName).Collection(deletionsCollection).InsertOne(ctx, job)
+	return err
+}
+
+// GetDeletion() returns the delete job with the given ID, or nil if there's none
+func GetDeletion(ctx context.Context, client *mongo.Client, id string) (*DeletionJob, error) {
+	var job DeletionJob
+	err := client.Database(dbName).Collection(deletionsCollection).FindOne(ctx, bson.M{"_id": id}).Decode(&job)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// SetDeletionStatus() sets the status of a delete job
+func SetDeletionStatus(ctx context.Context, client *mongo.Client, id string, status string) error {
+	_, err := client.Database(dbName).Collection(deletionsCollection).UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": bson.M{"status": status}})
+	return err
+}
+
+// MarkDeletionsApplied() records that delete jobs were applied, or failed, at the offsets their requests were
+// consumed at. Jobs already marked applied keep their first record.
+func MarkDeletionsApplied(ctx context.Context, client *mongo.Client, deletions []AppliedDeletion) (bool, error) {
+	if len(deletions) == 0 {
+		return true, nil
+	}
+	now := time.Now().UTC()
+	models := make([]mongo.WriteModel, 0, len(deletions))
+	for _, deletion := range deletions {
+		filter := bson.M{"_id": deletion.ID, "status": bson.M{"$ne": DeletionApplied}}
+		models = append(models, mongo.NewUpdateOneModel().SetFilter(filter).SetUpdate(deletionAppliedUpdate(deletion, now)))
+	}
+	result, err := client.Database(dbName).Collection(deletionsCollection).BulkWrite(ctx, models)
+	if err != nil {
+		return false, err
+	}
+	return result.Acknowledged, nil
+}
+
+// deletionAppliedUpdate() builds the update marking a delete job applied, or failed if it has a failure reason
+func deletionAppliedUpdate(deletion AppliedDeletion, now time.Time) bson.M {
+	set := bson.M{
+		"status":    DeletionApplied,
+		"appliedAt": now,
+		"partition": deletion.Partition,
+		"offset":    deletion.Offset,
+	}
+	if deletion.FailureReason != "" {
+		set["status"] = DeletionFailed
+		set["reason"] = deletion.FailureReason
+	}
+	return bson.M{"$set": set}
+}
@@ -0,0 +1,119 @@
+package mongoutils
+
+import (
+	"pacproxy/shared/statistics"
+	"slices"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+func at(hour int, minute int) time.Time {
+	return time.Date(2025, 3, 25, hour, minute, 0, 0, time.UTC)
+}
+
+func TestRangeGranularities(t *testing.T) {
+	minute, hour, day := statistics.GranularityMinute, statistics.GranularityHour, statistics.GranularityDay
+	tests := []struct {
+		name string
+		from time.Time
+		to   time.Time
+		want []string
+	}{
+		{"minutes", at(10, 3), at(10, 7), []string{minute}},
+		{"starts on an hour", at(10, 0), at(11, 30), []string{minute}},
+		{"ends on an hour", at(10, 30), at(12, 0), []string{minute}},
+		{"hours", at(10, 0), at(12, 0), []string{minute, hour}},
+		{"hours from midnight", at(0, 0), at(12, 0), []string{minute, hour}},
+		{"days", at(0, 0), at(0, 0).AddDate(0, 0, 2), []string{minute, hour, day}},
+	}
+	for _, test := range tests {
+		if got := rangeGranularities(test.from, test.to); !slices.Equal(got, test.want) {
+			t.Errorf("%s: rangeGranularities() = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func testBucket(granularity string, start time.Time, requests int) *statistics.KeyStatsBucket {
+	bucket, _ := statistics.NewKeyStatsBucket("keystem", granularity, start)
+	bucket.TotalRequests = requests
+	bucket.StatusCodes["200"] = requests
+	return bucket
+}
+
+func TestSumRangeBuckets(t *testing.T) {
+	minute, hour, day := statistics.GranularityMinute, statistics.GranularityHour, statistics.GranularityDay
+	// Minute buckets from 10:30 to 12:00: the 10:00 hour and the day are only partly in the range
+	found := []*statistics.KeyStatsBucket{
+		testBucket(minute, at(10, 30), 1),
+		testBucket(minute, at(10, 59), 2),
+		testBucket(minute, at(11, 0), 4),
+		testBucket(minute, at(11, 59), 8),
+	}
+	removed, partial := sumRangeBuckets("keystem", found, []string{hour, day}, at(10, 30), at(12, 0))
+	if removed.TotalRequests != 15 || removed.StatusCodes["200"] != 15 {
+		t.Errorf("removed %d requests, want 15", removed.TotalRequests)
+	}
+	want := map[bucketID]int{
+		{hour, at(10, 0)}: 3,
+		{day, at(0, 0)}:   15,
+	}
+	if len(partial) != len(want) {
+		t.Errorf("%d partly covered buckets, want %d: %v", len(partial), len(want), partial)
+	}
+	for id, requests := range want {
+		if partial[id] == nil || partial[id].TotalRequests != requests {
+			t.Errorf("%s bucket at %s: %v, want %d requests subtracted", id.granularity, id.start, partial[id], requests)
+		}
+	}
+
+	// Hour buckets from midnight to noon: only the day is partly covered
+	found = []*statistics.KeyStatsBucket{testBucket(hour, at(0, 0), 5), testBucket(hour, at(11, 0), 6)}
+	removed, partial = sumRangeBuckets("keystem", found, []string{day}, at(0, 0), at(12, 0))
+	if removed.TotalRequests != 11 || len(partial) != 1 || partial[bucketID{day, at(0, 0)}].TotalRequests != 11 {
+		t.Errorf("removed %d requests with partly covered buckets %v", removed.TotalRequests, partial)
+	}
+
+	// A whole day leaves no partly covered bucket
+	_, partial = sumRangeBuckets("keystem", found, []string{day}, at(0, 0), at(0, 0).AddDate(0, 0, 1))
+	if len(partial) != 0 {
+		t.Errorf("a whole day partly covers %v", partial)
+	}
+}
+
+func TestContainedBuckets(t *testing.T) {
+	from, to := at(0, 0), at(0, 0).AddDate(0, 0, 1)
+	want := map[string]time.Time{
+		statistics.GranularityMinute: at(23, 59),
+		statistics.GranularityHour:   at(23, 0),
+		statistics.GranularityDay:    at(0, 0),
+	}
+	contained := containedBuckets(from, to)
+	if len(contained) != len(want) {
+		t.Fatalf("%d conditions, want one per granularity", len(contained))
+	}
+	for _, condition := range contained {
+		condition := condition.(bson.M)
+		start := condition["start"].(bson.M)
+		if start["$gte"] != from || start["$lte"] != want[condition["granularity"].(string)] {
+			t.Errorf("%s buckets matched from %v to %v", condition["granularity"], start["$gte"], start["$lte"])
+		}
+	}
+}
+
+func TestDeletionAppliedUpdate(t *testing.T) {
+	now := at(12, 0)
+	set := deletionAppliedUpdate(AppliedDeletion{ID: "job", Partition: 2, Offset: 41}, now)["$set"].(bson.M)
+	if set["status"] != DeletionApplied || set["appliedAt"] != now || set["partition"] != int32(2) || set["offset"] != int64(41) {
+		t.Errorf("applied deletion update sets %v", set)
+	}
+	if _, found := set["reason"]; found {
+		t.Error("applied deletion has a failure reason")
+	}
+
+	set = deletionAppliedUpdate(AppliedDeletion{ID: "job", FailureReason: rangeWithoutStats}, now)["$set"].(bson.M)
+	if set["status"] != DeletionFailed || set["reason"] != rangeWithoutStats {
+		t.Errorf("failed deletion update sets %v", set)
+	}
+}
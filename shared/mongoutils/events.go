@@ -0,0 +1,265 @@
+package mongoutils
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"pacproxy/shared/statistics"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+// Raw statistics of one pack request, archived in a time-series collection
+type PackEvent struct {
+	ID                bson.ObjectID `json:"id" bson:"_id,omitempty"`
+	TimeStamp         time.Time     `json:"timeStamp" bson:"timeStamp"`
+	UsedKeystem       string        `json:"usedKeystem" bson:"usedKeystem"`
+	EventID           string        `json:"eventId" bson:"eventId"`
+	RequestID         string        `json:"requestId,omitempty" bson:"requestId,omitempty"`
+	OrderID           string        `json:"orderId,omitempty" bson:"orderId,omitempty"`
+	StatusCode        string        `json:"statusCode" bson:"statusCode"`
+	Error             bool          `json:"error" bson:"error"` // the request failed or got an error response
+	ErrorClass        string        `json:"errorClass,omitempty" bson:"errorClass,omitempty"`
+	ErrorCategory     string        `json:"errorCategory,omitempty" bson:"errorCategory,omitempty"`
+	CacheHit          bool          `json:"cacheHit" bson:"cacheHit"`
+	Latency           float64       `json:"latency" bson:"latency"`
+	Retries           int           `json:"retries" bson:"retries"`
+	TotalItems        int           `json:"totalItems" bson:"totalItems"`
+	TotalVolume       float64       `json:"totalVolume" bson:"totalVolume"`
+	VolumeUtilization float64       `json:"volumeUtilization" bson:"volumeUtilization"`
+	Boxes             int           `json:"boxes" bson:"boxes"`
+	Leftovers         int           `json:"leftovers" bson:"leftovers"`
+	TotalCost         int           `json:"totalCost" bson:"totalCost"`
+	PackTime          float64       `json:"packTime" bson:"packTime"`
+	Partition         int32         `json:"partition" bson:"partition"` // Kafka partition and offset the stats were consumed at
+	Offset            int64         `json:"offset" bson:"offset"`
+}
+
+// NewPackEvent() returns the event archived for a stats message
+func NewPackEvent(stats *statistics.Stats, partition int32, offset int64) (*PackEvent, error) {
+	timeStamp, err := statistics.ParseTimeStamp(stats.TimeStamp)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't parse timestamp %q: %s", stats.TimeStamp, err)
+	}
+	return &PackEvent{
+		TimeStamp:         timeStamp.UTC(),
+		UsedKeystem:       stats.UsedKeystem,
+		EventID:           stats.EventID,
+		RequestID:         stats.RequestID,
+		OrderID:           stats.OrderID,
+		StatusCode:        stats.StatusCode,
+		Error:             stats.RequestError || stats.ErrorResponse,
+		ErrorClass:        stats.ErrorClass,
+		ErrorCategory:     stats.ErrorCategory,
+		CacheHit:          stats.CacheHit,
+		Latency:           stats.Latency,
+		Retries:           stats.Retries,
+		TotalItems:        stats.TotalItems,
+		TotalVolume:       stats.TotalVolume,
+		VolumeUtilization: stats.VolumeUtilization,
+		Boxes:             stats.Boxes,
+		Leftovers:         stats.Leftovers,
+		TotalCost:         stats.TotalCost,
+		PackTime:          stats.PackTime,
+		Partition:         partition,
+		Offset:            offset,
+	}, nil
+}
+
+// EnsureEventsCollection() creates the time-series collection of pack events if it doesn't exist, and
+// sets how long events are kept, which can change between restarts
+func EnsureEventsCollection(ctx context.Context, client *mongo.Client, retention time.Duration) error {
+	db := client.Database(dbName)
+	names, err := db.ListCollectionNames(ctx, bson.M{"name": eventsCollection})
+	if err != nil {
+		return err
+	}
+	expireAfter := int64(retention / time.Second)
+	if len(names) > 0 {
+		return db.RunCommand(ctx, bson.D{{Key: "collMod", Value: eventsCollection}, {Key: "expireAfterSeconds", Value: expireAfter}}).Err()
+	}
+	timeSeries := options.TimeSeries().SetTimeField("timeStamp").SetMetaField("usedKeystem").SetGranularity("seconds")
+	err = db.CreateCollection(ctx, eventsCollection, options.CreateCollection().SetTimeSeriesOptions(timeSeries).SetExpireAfterSeconds(expireAfter))
+	if err != nil {
+		return err
+	}
+	_, err = db.Collection(eventsCollection).Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "usedKeystem", Value: 1}, {Key: "timeStamp", Value: -1}}},
+		{Keys: bson.D{{Key: "orderId", Value: 1}}},
+	})
+	return err
+}
+
+// InsertPackEvents() archives pack events, batchSize at a time. Time-series collections can't be written in
+// transactions, so events are written after the stats they belong to. If the write fails, the events that
+// weren't archived are returned with the error: those rejected by the database, or every event of the batch
+// whose outcome is unknown and of the batches after it.
+func InsertPackEvents(ctx context.Context, client *mongo.Client, events []*PackEvent, batchSize int) ([]*PackEvent, error) {
+	collection := client.Database(dbName).Collection(eventsCollection)
+	for start := 0; start < len(events); start += batchSize {
+		batch := events[start:min(start+batchSize, len(events))]
+		_, err := collection.InsertMany(ctx, batch, options.InsertMany().SetOrdered(false))
+		if err == nil {
+			continue
+		}
+		var writeErr mongo.BulkWriteException
+		if !errors.As(err, &writeErr) || writeErr.WriteConcernError != nil || len(writeErr.WriteErrors) == 0 {
+			return events[start:], err
+		}
+		// The write was unordered, so only the documents with write errors are missing
+		var unarchived []*PackEvent
+		for _, docErr := range writeErr.WriteErrors {
+			unarchived = append(unarchived, batch[docErr.Index])
+		}
+		return append(unarchived, events[start+len(batch):]...), err
+	}
+	return nil, nil
+}
+
+// UnarchivedPackEvents() returns the events that aren't in the archive yet, so that a write whose outcome is
+// unknown can be retried without archiving events twice. Time-series collections can't have unique indexes,
+// so events are told apart by the Kafka partition and offset they were consumed at.
+func UnarchivedPackEvents(ctx context.Context, client *mongo.Client, events []*PackEvent) ([]*PackEvent, error) {
+	if len(events) == 0 {
+		return nil, nil
+	}
+	type position struct {
+		partition int32
+		offset    int64
+	}
+	offsets := make(map[int32]bson.A)
+	from, to := events[0].TimeStamp, events[0].TimeStamp
+	for _, event := range events {
+		offsets[event.Partition] = append(offsets[event.Partition], event.Offset)
+		from, to = minTime(from, event.TimeStamp), maxTime(to, event.TimeStamp)
+	}
+	positions := bson.A{}
+	for partition, partitionOffsets := range offsets {
+		positions = append(positions, bson.M{"partition": partition, "offset": bson.M{"$in": partitionOffsets}})
+	}
+	filter := bson.M{"timeStamp": bson.M{"$gte": from, "$lte": to}, "$or": positions}
+	opts := options.Find().SetProjection(bson.M{"partition": 1, "offset": 1})
+	cursor, err := client.Database(dbName).Collection(eventsCollection).Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	var archived []PackEvent
+	err = cursor.All(ctx, &archived)
+	if err != nil {
+		return nil, err
+	}
+	found := make(map[position]bool, len(archived))
+	for _, event := range archived {
+		found[position{event.Partition, event.Offset}] = true
+	}
+	var unarchived []*PackEvent
+	for _, event := range events {
+		if !found[position{event.Partition, event.Offset}] {
+			unarchived = append(unarchived, event)
+		}
+	}
+	return unarchived, nil
+}
+
+func minTime(a time.Time, b time.Time) time.Time {
+	if b.Before(a) {
+		return b
+	}
+	return a
+}
+
+func maxTime(a time.Time, b time.Time) time.Time {
+	if b.After(a) {
+		return b
+	}
+	return a
+}
+
+// Query of archived pack events. Zero values don't filter.
+type EventQuery struct {
+	Keystems   []string // keystems to query, or nil for every keystem
+	From       time.Time
+	To         time.Time
+	StatusCode string
+	OrderID    string
+	Error      *bool
+	MinLatency float64
+	After      *EventCursor // position of the last event of the previous page
+	Limit      int64
+}
+
+// Position of an event in the order events are listed, latest first
+type EventCursor struct {
+	TimeStamp time.Time
+	ID        bson.ObjectID
+}
+
+// Cursor() returns the opaque cursor of the page following an event
+func (event *PackEvent) Cursor() string {
+	position := strconv.FormatInt(event.TimeStamp.UnixNano(), 10) + ":" + event.ID.Hex()
+	return base64.RawURLEncoding.EncodeToString([]byte(position))
+}
+
+// ParseEventCursor() parses a cursor returned by Cursor()
+func ParseEventCursor(cursor string) (*EventCursor, error) {
+	position, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, err
+	}
+	nanos, id, found := strings.Cut(string(position), ":")
+	if !found {
+		return nil, fmt.Errorf("malformed cursor")
+	}
+	unixNano, err := strconv.ParseInt(nanos, 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	objectID, err := bson.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, err
+	}
+	return &EventCursor{TimeStamp: time.Unix(0, unixNano).UTC(), ID: objectID}, nil
+}
+
+// ListPackEvents() returns one page of the archived pack events matching a query, latest first
+func ListPackEvents(ctx context.Context, client *mongo.Client, query *EventQuery) ([]*PackEvent, error) {
+	filter := bson.M{"timeStamp": bson.M{"$gte": query.From, "$lt": query.To}}
+	if query.Keystems != nil {
+		filter["usedKeystem"] = bson.M{"$in": query.Keystems}
+	}
+	if query.StatusCode != "" {
+		filter["statusCode"] = query.StatusCode
+	}
+	if query.OrderID != "" {
+		filter["orderId"] = query.OrderID
+	}
+	if query.Error != nil {
+		filter["error"] = *query.Error
+	}
+	if query.MinLatency > 0 {
+		filter["latency"] = bson.M{"$gte": query.MinLatency}
+	}
+	if query.After != nil {
+		filter["$or"] = bson.A{
+			bson.M{"timeStamp": bson.M{"$lt": query.After.TimeStamp}},
+			bson.M{"timeStamp": query.After.TimeStamp, "_id": bson.M{"$lt": query.After.ID}},
+		}
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "timeStamp", Value: -1}, {Key: "_id", Value: -1}}).SetLimit(query.Limit)
+	cursor, err := client.Database(dbName).Collection(eventsCollection).Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	events := []*PackEvent{}
+	err = cursor.All(ctx, &events)
+	if err != nil {
+		return nil, err
+	}
+	return events, nil
+}
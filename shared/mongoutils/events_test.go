@@ -0,0 +1,54 @@
+package mongoutils
+
+import (
+	"encoding/base64"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+func TestEventCursor(t *testing.T) {
+	id := bson.NewObjectID()
+	timeStamps := []time.Time{
+		time.Date(2025, 3, 25, 5, 47, 17, 123456789, time.UTC),
+		time.Date(2025, 3, 25, 7, 47, 17, 0, time.FixedZone("", 2*60*60)),
+		time.Unix(0, 0),
+	}
+	for _, timeStamp := range timeStamps {
+		event := PackEvent{ID: id, TimeStamp: timeStamp}
+		cursor, err := ParseEventCursor(event.Cursor())
+		if err != nil {
+			t.Fatalf("ParseEventCursor() of the cursor of an event at %s: %s", timeStamp, err)
+		}
+		if !cursor.TimeStamp.Equal(timeStamp) || cursor.TimeStamp.Location() != time.UTC || cursor.ID != id {
+			t.Errorf("cursor of an event at %s, %s parsed as %s, %s", timeStamp, id.Hex(), cursor.TimeStamp, cursor.ID.Hex())
+		}
+	}
+}
+
+func TestParseMalformedEventCursor(t *testing.T) {
+	encode := func(position string) string {
+		return base64.RawURLEncoding.EncodeToString([]byte(position))
+	}
+	id := bson.NewObjectID().Hex()
+	tests := []struct {
+		name   string
+		cursor string
+	}{
+		{"empty", ""},
+		{"not base64", "not a cursor!"},
+		{"padded base64", base64.URLEncoding.EncodeToString([]byte("1:" + id))},
+		{"no separator", encode("1742881637000000000" + id)},
+		{"timestamp not a number", encode("yesterday:" + id)},
+		{"timestamp overflow", encode("99999999999999999999:" + id)},
+		{"id not hex", encode("1742881637000000000:not-an-object-id-here")},
+		{"short id", encode("1742881637000000000:" + id[:12])},
+		{"no id", encode("1742881637000000000:")},
+	}
+	for _, test := range tests {
+		if cursor, err := ParseEventCursor(test.cursor); err == nil {
+			t.Errorf("%s: ParseEventCursor(%q) = %+v, want an error", test.name, test.cursor, cursor)
+		}
+	}
+}
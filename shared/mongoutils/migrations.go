@@ -0,0 +1,380 @@
+package mongoutils
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"pacproxy/shared/statistics"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+const (
+	migrationLockID    string        = "lock"
+	migrationLockTTL   time.Duration = 10 * time.Minute // a lock older than this was left by an instance that died
+	migrationLockPoll  time.Duration = time.Second
+	migrationBatchSize int           = 500
+)
+
+// A migration evolves the database from one version to the next. Migrations are applied once each,
+// in order of version, so new ones must only ever be appended to the list below.
+type migration struct {
+	version int
+	name    string
+	apply   func(ctx context.Context, db *mongo.Database) error
+}
+
+var migrations = []migration{
+	{version: 1, name: "deduplicate records and create indexes", apply: createIndexes},
+	{version: 2, name: "convert timestamp strings to dates", apply: convertTimeStamps},
+	{version: 3, name: "backfill the sums averages are derived from", apply: backfillSums},
+	{version: 4, name: "materialize the all-keystems summary", apply: buildSummary},
+	{version: 5, name: "create dedupe window indexes", apply: createDedupeIndexes},
+	{version: 6, name: "create API key indexes", apply: createAPIKeyIndexes},
+	{version: 7, name: "derive error rates and create keystem ranking indexes", apply: createRankingIndexes},
+	{version: 8, name: "create the ranking indexes of every field keystems are listed by", apply: createAllRankingIndexes},
+}
+
+// Record of an applied migration in the migrations collection
+type appliedMigration struct {
+	Version   int       `bson:"_id"`
+	Name      string    `bson:"name"`
+	AppliedAt time.Time `bson:"appliedAt"`
+}
+
+// RunMigrations() applies the migrations that haven't been applied to the database yet. Instances
+// starting at the same time take turns holding a lock, so that each migration is applied only once.
+func RunMigrations(client *mongo.Client) error {
+	db := client.Database(dbName)
+	collection := db.Collection(migrationsCollection)
+	owner := migrationLockOwner()
+	err := acquireMigrationLock(context.Background(), collection, owner)
+	if err != nil {
+		return fmt.Errorf("couldn't acquire the migration lock: %s", err)
+	}
+	defer releaseMigrationLock(collection, owner)
+
+	// Give up before the lock expires and another instance starts applying the same migrations
+	ctx, cancel := context.WithTimeout(context.Background(), migrationLockTTL)
+	defer cancel()
+	applied, err := appliedMigrationVersions(ctx, collection)
+	if err != nil {
+		return err
+	}
+	for _, m := range pendingMigrations(migrations, applied) {
+		slog.Info(fmt.Sprintf("applying migration %d: %s", m.version, m.name))
+		err = m.apply(ctx, db)
+		if err != nil {
+			return fmt.Errorf("migration %d (%s) failed: %s", m.version, m.name, err)
+		}
+		_, err = collection.InsertOne(ctx, appliedMigration{Version: m.version, Name: m.name, AppliedAt: time.Now()})
+		if err != nil {
+			return fmt.Errorf("couldn't record migration %d: %s", m.version, err)
+		}
+	}
+	return nil
+}
+
+// pendingMigrations() returns the migrations whose version hasn't been applied, in order of version
+func pendingMigrations(migrations []migration, applied map[int]bool) []migration {
+	var pending []migration
+	for _, m := range migrations {
+		if !applied[m.version] {
+			pending = append(pending, m)
+		}
+	}
+	return pending
+}
+
+// acquireMigrationLock() waits until the migration lock is free or expired, then takes it
+func acquireMigrationLock(ctx context.Context, collection *mongo.Collection, owner string) error {
+	for {
+		filter, update := migrationLockUpdate(owner, time.Now())
+		// If the lock is held, the filter doesn't match and the upsert fails on the lock's _id
+		_, err := collection.UpdateOne(ctx, filter, update, options.UpdateOne().SetUpsert(true))
+		if err == nil {
+			return nil
+		} else if !mongo.IsDuplicateKeyError(err) {
+			return err
+		}
+		slog.Info("waiting for another instance to apply migrations")
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(migrationLockPoll):
+		}
+	}
+}
+
+// migrationLockUpdate() returns the upsert taking the migration lock for owner, which only matches a
+// lock that has expired by now
+func migrationLockUpdate(owner string, now time.Time) (bson.M, bson.M) {
+	filter := bson.M{"_id": migrationLockID, "expiresAt": bson.M{"$lt": now}}
+	update := bson.M{"$set": bson.M{"owner": owner, "expiresAt": now.Add(migrationLockTTL)}}
+	return filter, update
+}
+
+func releaseMigrationLock(collection *mongo.Collection, owner string) {
+	_, err := collection.DeleteOne(context.Background(), bson.M{"_id": migrationLockID, "owner": owner})
+	if err != nil {
+		slog.Error(fmt.Errorf("couldn't release the migration lock: %s", err).Error())
+	}
+}
+
+// migrationLockOwner() identifies this instance as the holder of the migration lock
+func migrationLockOwner() string {
+	hostname, _ := os.Hostname()
+	return fmt.Sprintf("%s-%d-%d", hostname, os.Getpid(), time.Now().UnixNano())
+}
+
+func appliedMigrationVersions(ctx context.Context, collection *mongo.Collection) (map[int]bool, error) {
+	cursor, err := collection.Find(ctx, bson.M{"_id": bson.M{"$ne": migrationLockID}})
+	if err != nil {
+		return nil, err
+	}
+	var records []appliedMigration
+	err = cursor.All(ctx, &records)
+	if err != nil {
+		return nil, err
+	}
+	applied := make(map[int]bool)
+	for _, record := range records {
+		applied[record.Version] = true
+	}
+	return applied, nil
+}
+
+// createIndexes() creates the indexes used by lookups and sorts. Earlier versions could write the same
+// offset or keystem record more than once, so duplicates are removed before creating unique indexes.
+func createIndexes(ctx context.Context, db *mongo.Database) error {
+	err := deduplicate(ctx, db.Collection(offsetsCollection), "$partition", "offset")
+	if err != nil {
+		return err
+	}
+	// Counts only grow, so the duplicate with the most requests is the latest
+	err = deduplicate(ctx, db.Collection(statsCollection), "$usedKeystem", "totalRequests")
+	if err != nil {
+		return err
+	}
+	bucketKey := bson.M{"usedKeystem": "$usedKeystem", "granularity": "$granularity", "start": "$start"}
+	err = deduplicate(ctx, db.Collection(bucketsCollection), bucketKey, "totalRequests")
+	if err != nil {
+		return err
+	}
+
+	indexes := map[string][]mongo.IndexModel{
+		offsetsCollection: {
+			{Keys: bson.D{{Key: "partition", Value: 1}}, Options: options.Index().SetUnique(true)},
+		},
+		statsCollection: {
+			{Keys: bson.D{{Key: "usedKeystem", Value: 1}}, Options: options.Index().SetUnique(true)},
+			{Keys: bson.D{{Key: "avgLatency", Value: -1}}},
+			{Keys: bson.D{{Key: "highestLatency.latency", Value: -1}}},
+		},
+		bucketsCollection: {
+			{Keys: bson.D{{Key: "usedKeystem", Value: 1}, {Key: "granularity", Value: 1}, {Key: "start", Value: 1}}, Options: options.Index().SetUnique(true)},
+			{Keys: bson.D{{Key: "granularity", Value: 1}, {Key: "start", Value: 1}}},
+		},
+	}
+	for collection, models := range indexes {
+		_, err = db.Collection(collection).Indexes().CreateMany(ctx, models)
+		if err != nil {
+			return fmt.Errorf("couldn't create indexes on %s: %s", collection, err)
+		}
+	}
+	return nil
+}
+
+// deduplicate() deletes all but one of the documents sharing a key, keeping the one with the highest
+// value of keepField
+func deduplicate(ctx context.Context, collection *mongo.Collection, key any, keepField string) error {
+	pipeline := mongo.Pipeline{
+		{{Key: "$sort", Value: bson.M{keepField: -1}}},
+		{{Key: "$group", Value: bson.M{"_id": key, "keep": bson.M{"$first": "$_id"}, "ids": bson.M{"$push": "$_id"}, "count": bson.M{"$sum": 1}}}},
+		{{Key: "$match", Value: bson.M{"count": bson.M{"$gt": 1}}}},
+	}
+	cursor, err := collection.Aggregate(ctx, pipeline)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+	for cursor.Next(ctx) {
+		var duplicates struct {
+			Keep bson.RawValue `bson:"keep"`
+			IDs  bson.A        `bson:"ids"`
+		}
+		err = cursor.Decode(&duplicates)
+		if err != nil {
+			return err
+		}
+		_, err = collection.DeleteMany(ctx, bson.M{"_id": bson.M{"$in": duplicates.IDs, "$ne": duplicates.Keep}})
+		if err != nil {
+			return err
+		}
+	}
+	return cursor.Err()
+}
+
+// convertTimeStamps() converts timestamps stored in the format of Go's time.Time.String() to BSON dates
+func convertTimeStamps(ctx context.Context, db *mongo.Database) error {
+	fields := []struct{ collection, field string }{
+		{statsCollection, "highestLatency.timeStamp"},
+		{bucketsCollection, "highestLatency.timeStamp"},
+		{summaryCollection, "maxLatency.timeStamp"},
+	}
+	for _, f := range fields {
+		err := convertTimeStampField(ctx, db.Collection(f.collection), f.field)
+		if err != nil {
+			return fmt.Errorf("couldn't convert %s.%s: %s", f.collection, f.field, err)
+		}
+	}
+	return nil
+}
+
+// convertTimeStampField() converts one timestamp field of every document storing it as a string.
+// Empty or unparsable timestamps become the zero time, as in new records.
+func convertTimeStampField(ctx context.Context, collection *mongo.Collection, field string) error {
+	opts := options.Find().SetProjection(bson.M{field: 1})
+	cursor, err := collection.Find(ctx, bson.M{field: bson.M{"$type": "string"}}, opts)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+	models := make([]mongo.WriteModel, 0, migrationBatchSize)
+	for cursor.Next(ctx) {
+		raw, ok := cursor.Current.Lookup(strings.Split(field, ".")...).StringValueOK()
+		if !ok {
+			continue
+		}
+		timeStamp, err := statistics.ParseTimeStamp(raw)
+		if err != nil {
+			timeStamp = time.Time{}
+		}
+		filter := bson.M{"_id": cursor.Current.Lookup("_id")}
+		models = append(models, mongo.NewUpdateOneModel().SetFilter(filter).SetUpdate(bson.M{"$set": bson.M{field: timeStamp}}))
+		if len(models) == migrationBatchSize {
+			if _, err = collection.BulkWrite(ctx, models); err != nil {
+				return err
+			}
+			models = models[:0]
+		}
+	}
+	if err = cursor.Err(); err != nil {
+		return err
+	}
+	if len(models) > 0 {
+		_, err = collection.BulkWrite(ctx, models)
+	}
+	return err
+}
+
+// backfillSums() sets the sums averages are derived from on documents written before they were stored
+func backfillSums(ctx context.Context, db *mongo.Database) error {
+	for _, collection := range []string{statsCollection, bucketsCollection} {
+		err := backfillMissingSums(ctx, db.Collection(collection), bson.M{})
+		if err != nil {
+			return fmt.Errorf("couldn't backfill %s: %s", collection, err)
+		}
+	}
+	return nil
+}
+
+// backfillMissingSums() derives the sums of the documents matching filter that don't have them yet, from
+// their averages and counts
+func backfillMissingSums(ctx context.Context, collection *mongo.Collection, filter bson.M) error {
+	orZero := func(field string) bson.M {
+		return bson.M{"$ifNull": bson.A{field, 0}}
+	}
+	pipeline := mongo.Pipeline{bson.D{{Key: "$set", Value: bson.M{
+		"sumVolumeUtilization": bson.M{"$multiply": bson.A{orZero("$avgVolumeUtilization"), orZero("$totalRequests")}},
+		"sumLatency": bson.M{"$multiply": bson.A{
+			orZero("$avgLatency"),
+			bson.M{"$subtract": bson.A{orZero("$totalRequests"), orZero("$cacheHits")}},
+		}},
+	}}}}
+	missing := bson.M{"sumLatency": bson.M{"$exists": false}}
+	for key, value := range filter {
+		missing[key] = value
+	}
+	_, err := collection.UpdateMany(ctx, missing, pipeline)
+	return err
+}
+
+// buildSummary() aggregates the statistics of every keystem into the all-keystems summary, which is
+// then kept up to date by ApplySummaryDeltas() and ResetKeyStats()
+func buildSummary(ctx context.Context, db *mongo.Database) error {
+	err := backfillMissingSums(ctx, db.Collection(statsCollection), bson.M{})
+	if err != nil {
+		return err
+	}
+	cursor, err := db.Collection(statsCollection).Find(ctx, bson.M{})
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+	akStats := statistics.NewAggregatedKeyStats()
+	for cursor.Next(ctx) {
+		keyStats := statistics.NewKeyStats("")
+		err = cursor.Decode(keyStats)
+		if err != nil {
+			return err
+		}
+		akStats.AggregateKeyStats(keyStats)
+	}
+	if err = cursor.Err(); err != nil {
+		return err
+	}
+	_, err = db.Collection(summaryCollection).ReplaceOne(ctx, bson.M{"_id": summaryID}, akStats, options.Replace().SetUpsert(true))
+	return err
+}
+
+// createDedupeIndexes() creates the indexes used to look up and prune remembered event IDs
+func createDedupeIndexes(ctx context.Context, db *mongo.Database) error {
+	_, err := db.Collection(dedupeCollection).Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "partition", Value: 1}, {Key: "eventId", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "partition", Value: 1}, {Key: "offset", Value: 1}}},
+	})
+	return err
+}
+
+// createAPIKeyIndexes() indexes API keys on their public ID, which admins use to manage them
+func createAPIKeyIndexes(ctx context.Context, db *mongo.Database) error {
+	_, err := db.Collection(apiKeysCollection).Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "id", Value: 1}}, Options: options.Index().SetUnique(true),
+	})
+	return err
+}
+
+// createRankingIndexes() derives the error rate of existing statistics, and creates the indexes keystems
+// are listed by. Each index ends with the keystem, which breaks ties between pages in either direction.
+func createRankingIndexes(ctx context.Context, db *mongo.Database) error {
+	for _, collection := range []string{statsCollection, bucketsCollection, summaryCollection} {
+		_, err := db.Collection(collection).UpdateMany(ctx, bson.M{"errorRate": bson.M{"$exists": false}}, deriveAveragesPipeline())
+		if err != nil {
+			return fmt.Errorf("couldn't derive the error rates of %s: %s", collection, err)
+		}
+	}
+	var models []mongo.IndexModel
+	for _, field := range []string{"totalRequests", "avgLatency", "errorRate", "avgVolumeUtilization"} {
+		models = append(models, mongo.IndexModel{Keys: bson.D{{Key: field, Value: 1}, {Key: "usedKeystem", Value: 1}}})
+	}
+	_, err := db.Collection(statsCollection).Indexes().CreateMany(ctx, models)
+	return err
+}
+
+// createAllRankingIndexes() creates the ranking indexes of the fields in RankingFields that createRankingIndexes()
+// didn't index. Indexes that already exist are left as they are. Fields added to RankingFields later need a
+// migration of their own, since this one only runs once.
+func createAllRankingIndexes(ctx context.Context, db *mongo.Database) error {
+	var models []mongo.IndexModel
+	for _, field := range RankingFields {
+		models = append(models, mongo.IndexModel{Keys: bson.D{{Key: field, Value: 1}, {Key: "usedKeystem", Value: 1}}})
+	}
+	_, err := db.Collection(statsCollection).Indexes().CreateMany(ctx, models)
+	return err
+}
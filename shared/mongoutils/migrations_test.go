@@ -0,0 +1,62 @@
+package mongoutils
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// Migrations are applied in the order they're listed, and their versions are recorded, so the list
+// must run from version 1 without gaps or reuse
+func TestMigrationVersions(t *testing.T) {
+	for i, m := range migrations {
+		if m.version != i+1 {
+			t.Errorf("migration %q has version %d, want %d", m.name, m.version, i+1)
+		}
+		if m.name == "" || m.apply == nil {
+			t.Errorf("migration %d has no name or function", m.version)
+		}
+	}
+}
+
+func TestPendingMigrations(t *testing.T) {
+	list := []migration{{version: 1}, {version: 2}, {version: 3}, {version: 4}}
+	tests := []struct {
+		name    string
+		applied map[int]bool
+		want    []int
+	}{
+		{"new database", map[int]bool{}, []int{1, 2, 3, 4}},
+		{"partly migrated", map[int]bool{1: true, 2: true}, []int{3, 4}},
+		{"gap left by a failure", map[int]bool{1: true, 3: true}, []int{2, 4}},
+		{"up to date", map[int]bool{1: true, 2: true, 3: true, 4: true}, nil},
+		{"newer than this instance", map[int]bool{1: true, 2: true, 3: true, 4: true, 5: true}, nil},
+	}
+	for _, test := range tests {
+		var got []int
+		for _, m := range pendingMigrations(list, test.applied) {
+			got = append(got, m.version)
+		}
+		if !slices.Equal(got, test.want) {
+			t.Errorf("%s: pending %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestMigrationLockUpdate(t *testing.T) {
+	now := time.Date(2025, 3, 25, 10, 0, 0, 0, time.UTC)
+	filter, update := migrationLockUpdate("owner", now)
+	// The lock is only taken over once it expires, and is otherwise upserted into a duplicate key error
+	if filter["_id"] != migrationLockID || filter["expiresAt"].(bson.M)["$lt"] != now {
+		t.Errorf("lock filter %v", filter)
+	}
+	set := update["$set"].(bson.M)
+	if set["owner"] != "owner" || set["expiresAt"] != now.Add(migrationLockTTL) {
+		t.Errorf("lock update %v", update)
+	}
+	if migrationLockOwner() == migrationLockOwner() {
+		t.Error("two lock owners have the same ID")
+	}
+}
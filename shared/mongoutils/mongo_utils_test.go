@@ -0,0 +1,147 @@
+package mongoutils
+
+import (
+	"pacproxy/shared/statistics"
+	"reflect"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+func TestFieldKey(t *testing.T) {
+	tests := []struct {
+		key  string
+		want string
+	}{
+		{"lowest-cost", "lowest-cost"},
+		{"a.b", "a_b"},
+		{"$set", "_set"},
+		{"a$", "a$"},
+		{"nul\x00key", "nulkey"},
+		{"\x00", "_"},
+		{"", "_"},
+	}
+	for _, test := range tests {
+		if got := FieldKey(test.key); got != test.want {
+			t.Errorf("FieldKey(%q) = %q, want %q", test.key, got, test.want)
+		}
+	}
+}
+
+// Keys chosen by callers mustn't make the update of their keystem impossible to encode
+func TestIncrementUpdateEncodesCallerKeys(t *testing.T) {
+	keyStats := statistics.NewKeyStats("keystem")
+	keyStats.StatusCodes["200"] = 1
+	keyStats.BoxTypes["1\x00"] = 1
+	keyStats.ErrorClasses["$where"] = 1
+	keyStats.Options.RuleOperations["a.b\x00"] = statistics.OptionOutcomes{Requests: 1}
+	if _, err := bson.Marshal(incrementUpdate(keyStats)); err != nil {
+		t.Errorf("update can't be encoded: %s", err)
+	}
+}
+
+func testKeyStats(keystem string, requests int, latency float64) *statistics.KeyStats {
+	keyStats := statistics.NewKeyStats(keystem)
+	keyStats.TotalRequests = requests
+	keyStats.SumLatency = latency * float64(requests)
+	keyStats.StatusCodes["200"] = requests
+	keyStats.StatusCodes["500"] = 0
+	keyStats.BoxTypes["7"] = requests
+	keyStats.BoxTypeStats["7"] = statistics.BoxTypeStats{Name: "small", Count: requests}
+	keyStats.HighestLatency = statistics.MaxLatency{Latency: latency, TimeStamp: time.Date(2025, 3, 25, 0, 0, 0, 0, time.UTC)}
+	return keyStats
+}
+
+func TestIncrementUpdate(t *testing.T) {
+	update := incrementUpdate(testKeyStats("keystem", 3, 5e6))
+	inc := update["$inc"].(bson.M)
+	want := bson.M{
+		"totalRequests":        3,
+		"sumLatency":           1.5e7,
+		"statusCodes.200":      3,
+		"boxTypes.7":           3,
+		"boxTypeStats.7.count": 3,
+	}
+	for field, value := range want {
+		if inc[field] != value {
+			t.Errorf("$inc %s = %v, want %v", field, inc[field], value)
+		}
+	}
+	if _, found := inc["statusCodes.500"]; found {
+		t.Error("a zero count was incremented")
+	}
+	if set := update["$set"].(bson.M); set["boxTypeStats.7.name"] != "small" {
+		t.Errorf("$set = %v, want the box type's name", set)
+	}
+	highest := update["$max"].(bson.M)["highestLatency"].(bson.D)
+	if highest[0].Key != "latency" || highest[0].Value != 5e6 {
+		t.Errorf("$max highestLatency = %v, want latency first", highest)
+	}
+
+	// Subtracting negates every increment, and never lowers the highest latency
+	subtraction := incrementUpdate(negate(testKeyStats("keystem", 3, 5e6)))
+	inc = subtraction["$inc"].(bson.M)
+	if inc["totalRequests"] != -3 || inc["sumLatency"] != -1.5e7 || inc["statusCodes.200"] != -3 || inc["boxTypeStats.7.count"] != -3 {
+		t.Errorf("subtraction increments %v", inc)
+	}
+	if _, found := subtraction["$max"]; found {
+		t.Error("subtraction raises the highest latency")
+	}
+
+	if _, found := incrementUpdate(statistics.NewKeyStats("keystem"))["$max"]; found {
+		t.Error("stats without latencies raise the highest latency")
+	}
+}
+
+func TestSummaryUpdate(t *testing.T) {
+	update := summaryUpdate(map[string]*statistics.KeyStats{
+		"a": testKeyStats("a", 2, 1e6),
+		"b": testKeyStats("b", 5, 9e6),
+		"c": testKeyStats("c", 1, 3e6),
+	})
+	inc := update["$inc"].(bson.M)
+	if inc["totalRequests"] != 8 || inc["statusCodes.200"] != 8 || inc["boxTypeStats.7.count"] != 8 {
+		t.Errorf("summary increments %v, want the totals of every keystem", inc)
+	}
+	maxima := update["$max"].(bson.M)
+	if _, found := maxima["highestLatency"]; found {
+		t.Error("summary raises a keystem's highest latency")
+	}
+	want := bson.D{
+		{Key: "latency", Value: 9e6},
+		{Key: "usedKeystem", Value: "b"},
+		{Key: "timeStamp", Value: time.Date(2025, 3, 25, 0, 0, 0, 0, time.UTC)},
+	}
+	if got := maxima["maxLatency"].(bson.D); !reflect.DeepEqual(got, want) {
+		t.Errorf("$max maxLatency = %v, want %v", got, want)
+	}
+	if _, found := update["highestAvgLatency"]; found {
+		t.Error("summary stores the keystem with the highest average latency")
+	}
+
+	if _, found := summaryUpdate(map[string]*statistics.KeyStats{"a": statistics.NewKeyStats("a")})["$max"]; found {
+		t.Error("deltas without latencies raise the maximum latency")
+	}
+}
+
+func TestKeyStatsQueryValidate(t *testing.T) {
+	tests := []struct {
+		name  string
+		query KeyStatsQuery
+		valid bool
+	}{
+		{"keystem", KeyStatsQuery{SortField: "usedKeystem"}, true},
+		{"ranking field", KeyStatsQuery{SortField: "highestLatency.latency", Min: map[string]float64{"errorRate": 0.1}}, true},
+		{"unindexed sort", KeyStatsQuery{SortField: "dimWeightRate"}, false},
+		{"unknown sort", KeyStatsQuery{SortField: "$where"}, false},
+		{"no sort", KeyStatsQuery{}, false},
+		{"unindexed min", KeyStatsQuery{SortField: "totalRequests", Min: map[string]float64{"avgPackTime": 1}}, false},
+		{"keystem max", KeyStatsQuery{SortField: "totalRequests", Max: map[string]float64{"usedKeystem": 1}}, false},
+	}
+	for _, test := range tests {
+		if err := test.query.Validate(); (err == nil) != test.valid {
+			t.Errorf("%s: Validate() = %v", test.name, err)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package statistics
+
+// Performance of one box type across packs. Averages are derived when read, rather than stored.
+type BoxTypeStats struct {
+	Name                 string  `json:"name" bson:"name"` // name of the box type in the latest pack using it
+	Count                int     `json:"count" bson:"count"`
+	TotalItems           int     `json:"totalItems" bson:"totalItems"`
+	AvgItems             float64 `json:"avgItems" bson:"-"`
+	AvgVolumeUtilization float64 `json:"avgVolumeUtilization" bson:"-"`
+	AvgWeightUtilization float64 `json:"avgWeightUtilization" bson:"-"`
+	TotalPrice           int     `json:"totalPrice" bson:"totalPrice"`
+
+	// Sums the averages are derived from, so that they can be incremented in the database
+	SumVolumeUtilization float64 `json:"-" bson:"sumVolumeUtilization"`
+	SumWeightUtilization float64 `json:"-" bson:"sumWeightUtilization"`
+}
+
+// Performance of each box type, by refId
+type BoxTypeStatsMap map[string]BoxTypeStats
+
+// AddBox() adds one box of a pack
+func (m BoxTypeStatsMap) AddBox(refID string, name string, items int, volumeUtilization float64, weightUtilization float64, price int) {
+	m.add(refID, BoxTypeStats{
+		Name:                 name,
+		Count:                1,
+		TotalItems:           items,
+		TotalPrice:           price,
+		SumVolumeUtilization: volumeUtilization,
+		SumWeightUtilization: weightUtilization,
+	})
+}
+
+// Merge() adds the counts and sums of other
+func (m BoxTypeStatsMap) Merge(other BoxTypeStatsMap) {
+	for refID, boxTypeStats := range other {
+		m.add(refID, boxTypeStats)
+	}
+	m.DeriveAverages()
+}
+
+// Negated() returns the counts and sums negated, so that merging them subtracts these stats. Names are
+// left out, so they aren't overwritten.
+func (m BoxTypeStatsMap) Negated() BoxTypeStatsMap {
+	negated := make(BoxTypeStatsMap, len(m))
+	for refID, boxTypeStats := range m {
+		negated[refID] = BoxTypeStats{
+			Count:                -boxTypeStats.Count,
+			TotalItems:           -boxTypeStats.TotalItems,
+			TotalPrice:           -boxTypeStats.TotalPrice,
+			SumVolumeUtilization: -boxTypeStats.SumVolumeUtilization,
+			SumWeightUtilization: -boxTypeStats.SumWeightUtilization,
+		}
+	}
+	return negated
+}
+
+// DeriveAverages() computes the averages of each box type from the counts and sums they're based on
+func (m BoxTypeStatsMap) DeriveAverages() {
+	for refID, boxTypeStats := range m {
+		boxTypeStats.AvgItems = safeDiv(float64(boxTypeStats.TotalItems), boxTypeStats.Count)
+		boxTypeStats.AvgVolumeUtilization = safeDiv(boxTypeStats.SumVolumeUtilization, boxTypeStats.Count)
+		boxTypeStats.AvgWeightUtilization = safeDiv(boxTypeStats.SumWeightUtilization, boxTypeStats.Count)
+		m[refID] = boxTypeStats
+	}
+}
+
+func (m BoxTypeStatsMap) add(refID string, other BoxTypeStats) {
+	total := m[refID]
+	if other.Name != "" {
+		total.Name = other.Name
+	}
+	total.Count += other.Count
+	total.TotalItems += other.TotalItems
+	total.TotalPrice += other.TotalPrice
+	total.SumVolumeUtilization += other.SumVolumeUtilization
+	total.SumWeightUtilization += other.SumWeightUtilization
+	m[refID] = total
+}
@@ -0,0 +1,59 @@
+package statistics
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestBoxTypeStatsMap(t *testing.T) {
+	first := make(BoxTypeStatsMap)
+	first.AddBox("small", "Small box", 2, 0.5, 0.25, 100)
+	first.AddBox("small", "Small box", 4, 0.75, 0.5, 100)
+	first.AddBox("large", "Large box", 10, 0.875, 0.75, 300)
+	second := make(BoxTypeStatsMap)
+	second.AddBox("small", "Small box v2", 6, 0.25, 0.75, 120)
+
+	merged := make(BoxTypeStatsMap)
+	merged.Merge(first)
+	merged.Merge(second)
+	want := BoxTypeStatsMap{
+		"small": {
+			Name:                 "Small box v2", // the name of the latest pack
+			Count:                3,
+			TotalItems:           12,
+			AvgItems:             4,
+			AvgVolumeUtilization: 0.5,
+			AvgWeightUtilization: 0.5,
+			TotalPrice:           320,
+			SumVolumeUtilization: 1.5,
+			SumWeightUtilization: 1.5,
+		},
+		"large": {
+			Name:                 "Large box",
+			Count:                1,
+			TotalItems:           10,
+			AvgItems:             10,
+			AvgVolumeUtilization: 0.875,
+			AvgWeightUtilization: 0.75,
+			TotalPrice:           300,
+			SumVolumeUtilization: 0.875,
+			SumWeightUtilization: 0.75,
+		},
+	}
+	if !reflect.DeepEqual(merged, want) {
+		t.Errorf("merged %+v, want %+v", merged, want)
+	}
+
+	// Subtracting the second pack keeps the latest name, since negated stats have none
+	merged.Merge(second.Negated())
+	small := merged["small"]
+	if small.Name != "Small box v2" || small.Count != 2 || small.TotalItems != 6 || small.TotalPrice != 200 || small.AvgItems != 3 {
+		t.Errorf("after subtracting, small boxes are %+v", small)
+	}
+
+	// Box types with no boxes left average to zero rather than dividing by zero
+	merged.Merge(first.Negated())
+	if large := merged["large"]; large.Count != 0 || large.AvgItems != 0 || large.AvgVolumeUtilization != 0 {
+		t.Errorf("after subtracting everything, large boxes are %+v", large)
+	}
+}
@@ -0,0 +1,70 @@
+package statistics
+
+import "slices"
+
+// Side by side statistics of several keystems. Deltas are each keystem's metrics minus the mean of the
+// group's, where every keystem weighs the same whatever its number of requests.
+type Comparison struct {
+	Keystems map[string]*KeyStats          `json:"keystems"`
+	Missing  []string                      `json:"missing"` // keystems without statistics, left out of the comparison
+	Merged   *AggregatedKeyStats           `json:"merged"`
+	Mean     map[string]float64            `json:"mean"`
+	Deltas   map[string]map[string]float64 `json:"deltas"` // by keystem, then metric
+}
+
+// Metrics() returns the metrics keystems are compared on, by name
+func (keyStats *KeyStats) Metrics() map[string]float64 {
+	return map[string]float64{
+		"totalRequests":        float64(keyStats.TotalRequests),
+		"totalItems":           float64(keyStats.TotalItems),
+		"totalVolume":          keyStats.TotalVolume,
+		"avgItemsPerPack":      keyStats.AvgItemsPerPack,
+		"avgVolumeUtilization": keyStats.AvgVolumeUtilization,
+		"avgWeightUtilization": keyStats.AvgWeightUtilization,
+		"avgCostPerPack":       keyStats.AvgCostPerPack,
+		"avgBoxesPerPack":      keyStats.AvgBoxesPerPack,
+		"leftoverRate":         keyStats.LeftoverRate,
+		"dimWeightRate":        keyStats.DimWeightRate,
+		"avgPackTime":          keyStats.AvgPackTime,
+		"errorRate":            keyStats.ErrorRate,
+		"avgLatency":           keyStats.AvgLatency,
+		"p95Latency":           keyStats.LatencyPercentiles.P95,
+	}
+}
+
+// Compare() compares the statistics of the given keystems. Keystems mapped to nil are listed as missing.
+func Compare(keyStats map[string]*KeyStats) *Comparison {
+	comparison := Comparison{
+		Keystems: make(map[string]*KeyStats),
+		Missing:  []string{},
+		Merged:   NewAggregatedKeyStats(),
+		Mean:     make(map[string]float64),
+		Deltas:   make(map[string]map[string]float64),
+	}
+	metricsByKeystem := make(map[string]map[string]float64)
+	for keystem, stats := range keyStats {
+		if stats == nil {
+			comparison.Missing = append(comparison.Missing, keystem)
+			continue
+		}
+		comparison.Keystems[keystem] = stats
+		comparison.Merged.AggregateKeyStats(stats)
+		metricsByKeystem[keystem] = stats.Metrics()
+		for metric, value := range metricsByKeystem[keystem] {
+			comparison.Mean[metric] += value
+		}
+	}
+	comparison.Merged.ComputePercentiles()
+	slices.Sort(comparison.Missing)
+	for metric, sum := range comparison.Mean {
+		comparison.Mean[metric] = sum / float64(len(metricsByKeystem))
+	}
+	for keystem, metrics := range metricsByKeystem {
+		deltas := make(map[string]float64, len(metrics))
+		for metric, value := range metrics {
+			deltas[metric] = value - comparison.Mean[metric]
+		}
+		comparison.Deltas[keystem] = deltas
+	}
+	return &comparison
+}
@@ -0,0 +1,67 @@
+package statistics
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCompare(t *testing.T) {
+	a := NewKeyStats("a")
+	a.TotalRequests, a.TotalItems, a.ErrorRate = 30, 100, 0.1
+	a.LatencySketch.Add(10e6)
+	b := NewKeyStats("b")
+	b.TotalRequests, b.TotalItems, b.ErrorRate = 10, 300, 0.3
+	b.LatencySketch.Add(30e6)
+
+	comparison := Compare(map[string]*KeyStats{"b": b, "zeta": nil, "a": a, "alpha": nil})
+	if len(comparison.Keystems) != 2 || comparison.Keystems["a"] != a || comparison.Keystems["b"] != b {
+		t.Errorf("compared keystems %v, want a and b", comparison.Keystems)
+	}
+	if !reflect.DeepEqual(comparison.Missing, []string{"alpha", "zeta"}) {
+		t.Errorf("missing %v, want them sorted", comparison.Missing)
+	}
+
+	// Keystems weigh the same in the mean, whatever their number of requests
+	mean := map[string]float64{"totalRequests": 20, "totalItems": 200, "errorRate": 0.2}
+	for metric, want := range mean {
+		if got := comparison.Mean[metric]; !approxEqual(got, want) {
+			t.Errorf("mean %s = %v, want %v", metric, got, want)
+		}
+	}
+	deltas := map[string]map[string]float64{
+		"a": {"totalRequests": 10, "totalItems": -100, "errorRate": -0.1},
+		"b": {"totalRequests": -10, "totalItems": 100, "errorRate": 0.1},
+	}
+	for keystem, metrics := range deltas {
+		if len(comparison.Deltas[keystem]) != len(comparison.Mean) {
+			t.Errorf("%s has %d deltas, want one per metric", keystem, len(comparison.Deltas[keystem]))
+		}
+		for metric, want := range metrics {
+			if got := comparison.Deltas[keystem][metric]; !approxEqual(got, want) {
+				t.Errorf("%s delta %s = %v, want %v", keystem, metric, got, want)
+			}
+		}
+	}
+
+	if comparison.Merged.TotalRequests != 40 || comparison.Merged.TotalItems != 400 {
+		t.Errorf("merged %d requests and %d items, want 40 and 400", comparison.Merged.TotalRequests, comparison.Merged.TotalItems)
+	}
+	if comparison.Merged.LatencySketch.Count != 2 || comparison.Merged.LatencyPercentiles.P50 == 0 {
+		t.Errorf("merged latency sketch counts %d values, want 2 with percentiles", comparison.Merged.LatencySketch.Count)
+	}
+}
+
+// Comparing only missing keystems doesn't divide by zero
+func TestCompareAllMissing(t *testing.T) {
+	comparison := Compare(map[string]*KeyStats{"a": nil})
+	if len(comparison.Mean) != 0 || len(comparison.Deltas) != 0 || len(comparison.Keystems) != 0 {
+		t.Errorf("comparison of missing keystems has values: %+v", comparison)
+	}
+	if !reflect.DeepEqual(comparison.Missing, []string{"a"}) {
+		t.Errorf("missing %v, want [a]", comparison.Missing)
+	}
+}
+
+func approxEqual(a, b float64) bool {
+	return a-b < 1e-9 && b-a < 1e-9
+}
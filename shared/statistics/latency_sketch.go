@@ -0,0 +1,117 @@
+package statistics
+
+import (
+	"math"
+	"slices"
+	"strconv"
+)
+
+// Latencies are bucketed logarithmically, so that every value in a bucket is within
+// sketchRelativeAccuracy of the bucket's representative value. Sketches with the same
+// accuracy are merged by adding their bucket counts.
+const (
+	sketchRelativeAccuracy float64 = 0.01
+	sketchMinValue         float64 = 1 // values below this are counted as zero
+)
+
+var (
+	sketchGamma    = (1 + sketchRelativeAccuracy) / (1 - sketchRelativeAccuracy)
+	sketchLogGamma = math.Log(sketchGamma)
+)
+
+// Mergeable quantile sketch of latencies
+type LatencySketch struct {
+	Counts    map[string]int `json:"counts" bson:"counts"` // bucket index -> count. Indexes are strings so they can be BSON keys.
+	ZeroCount int            `json:"zeroCount" bson:"zeroCount"`
+	Count     int            `json:"count" bson:"count"`
+}
+
+// Latency percentiles estimated from a LatencySketch
+type LatencyPercentiles struct {
+	P50 float64 `json:"p50" bson:"p50"`
+	P90 float64 `json:"p90" bson:"p90"`
+	P95 float64 `json:"p95" bson:"p95"`
+	P99 float64 `json:"p99" bson:"p99"`
+}
+
+// New LatencySketch with no values
+func NewLatencySketch() *LatencySketch {
+	return &LatencySketch{Counts: make(map[string]int)}
+}
+
+// Add a value to the sketch
+func (sketch *LatencySketch) Add(value float64) {
+	sketch.Count++
+	if value < sketchMinValue {
+		sketch.ZeroCount++
+		return
+	}
+	if sketch.Counts == nil {
+		sketch.Counts = make(map[string]int)
+	}
+	sketch.Counts[SketchBucket(value)]++
+}
+
+// Merge the values of another sketch into this one
+func (sketch *LatencySketch) Merge(other *LatencySketch) {
+	if sketch.Counts == nil {
+		sketch.Counts = make(map[string]int)
+	}
+	importCounts(other.Counts, sketch.Counts)
+	sketch.ZeroCount += other.ZeroCount
+	sketch.Count += other.Count
+}
+
+// Quantile() estimates the value at quantile q, between 0 and 1. 0 is returned for an empty sketch.
+func (sketch *LatencySketch) Quantile(q float64) float64 {
+	if sketch.Count == 0 {
+		return 0
+	}
+	rank := int(math.Ceil(q * float64(sketch.Count)))
+	if rank < 1 {
+		rank = 1
+	}
+	seen := sketch.ZeroCount
+	if seen >= rank {
+		return 0
+	}
+	indexes := make([]int, 0, len(sketch.Counts))
+	for key := range sketch.Counts {
+		index, err := strconv.Atoi(key)
+		if err == nil {
+			indexes = append(indexes, index)
+		}
+	}
+	slices.Sort(indexes)
+	for _, index := range indexes {
+		seen += sketch.Counts[strconv.Itoa(index)]
+		if seen >= rank {
+			return bucketValue(index)
+		}
+	}
+	if len(indexes) == 0 {
+		return 0
+	}
+	return bucketValue(indexes[len(indexes)-1])
+}
+
+// Percentiles() estimates the 50th, 90th, 95th and 99th percentiles
+func (sketch *LatencySketch) Percentiles() LatencyPercentiles {
+	return LatencyPercentiles{
+		P50: sketch.Quantile(0.50),
+		P90: sketch.Quantile(0.90),
+		P95: sketch.Quantile(0.95),
+		P99: sketch.Quantile(0.99),
+	}
+}
+
+// SketchBucket() returns the key of the bucket holding value
+func SketchBucket(value float64) string {
+	return strconv.Itoa(int(math.Ceil(math.Log(value) / sketchLogGamma)))
+}
+
+// bucketValue() returns the value representing a bucket, whose relative error to any value in the
+// bucket is at most sketchRelativeAccuracy
+func bucketValue(index int) float64 {
+	return 2 * math.Pow(sketchGamma, float64(index)) / (sketchGamma + 1)
+}
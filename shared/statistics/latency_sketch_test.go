@@ -0,0 +1,137 @@
+package statistics
+
+import (
+	"math"
+	"math/rand/v2"
+	"reflect"
+	"slices"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// Each estimated quantile is within the sketch's relative accuracy of the exact one
+func TestLatencySketchAccuracy(t *testing.T) {
+	random := rand.New(rand.NewPCG(1, 2))
+	distributions := []struct {
+		name   string
+		sample func() float64
+	}{
+		{"uniform", func() float64 { return 1e6 + random.Float64()*1e9 }},
+		{"log-normal", func() float64 { return math.Exp(18 + 1.5*random.NormFloat64()) }},
+		{"exponential", func() float64 { return 1 + random.ExpFloat64()*2e8 }},
+	}
+	for _, distribution := range distributions {
+		sketch := NewLatencySketch()
+		values := make([]float64, 10000)
+		for i := range values {
+			values[i] = distribution.sample()
+			sketch.Add(values[i])
+		}
+		slices.Sort(values)
+		for _, q := range []float64{0.01, 0.25, 0.5, 0.9, 0.95, 0.99, 1} {
+			exact := values[int(math.Ceil(q*float64(len(values))))-1]
+			estimate := sketch.Quantile(q)
+			if relativeError := math.Abs(estimate-exact) / exact; relativeError > sketchRelativeAccuracy {
+				t.Errorf("%s: quantile %v = %v, exact %v, relative error %v", distribution.name, q, estimate, exact, relativeError)
+			}
+		}
+	}
+}
+
+func TestLatencySketchMerge(t *testing.T) {
+	random := rand.New(rand.NewPCG(3, 4))
+	sketches := make([]*LatencySketch, 3)
+	all := NewLatencySketch()
+	for i := range sketches {
+		sketches[i] = NewLatencySketch()
+		for range 1000 * (i + 1) {
+			value := random.Float64() * 1e9
+			sketches[i].Add(value)
+			all.Add(value)
+		}
+		sketches[i].Add(0)
+		all.Add(0)
+	}
+	merge := func(sketches ...*LatencySketch) *LatencySketch {
+		merged := NewLatencySketch()
+		for _, sketch := range sketches {
+			merged.Merge(sketch)
+		}
+		return merged
+	}
+	a, b, c := sketches[0], sketches[1], sketches[2]
+	left := merge(merge(a, b), c)
+	right := merge(a, merge(b, c))
+	swapped := merge(c, b, a)
+	for _, merged := range []*LatencySketch{left, right, swapped} {
+		if !reflect.DeepEqual(merged, all) {
+			t.Errorf("merged sketch %+v differs from the sketch of every value", merged.Percentiles())
+		}
+	}
+	if left.Count != 6003 || left.ZeroCount != 3 {
+		t.Errorf("merged %d values with %d zeros, want 6003 with 3", left.Count, left.ZeroCount)
+	}
+
+	// Sketches decoded without counts can be merged into
+	var empty LatencySketch
+	empty.Merge(a)
+	if !reflect.DeepEqual(empty.Counts, a.Counts) {
+		t.Error("merging into a sketch without counts lost values")
+	}
+}
+
+func TestLatencySketchBSON(t *testing.T) {
+	sketch := NewLatencySketch()
+	for _, value := range []float64{0.5, 1, 12, 1e6, 2.5e8, 2.5e8, 3e9} {
+		sketch.Add(value)
+	}
+	raw, err := bson.Marshal(sketch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded LatencySketch
+	err = bson.Unmarshal(raw, &decoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(&decoded, sketch) {
+		t.Errorf("decoded %+v, want %+v", decoded, *sketch)
+	}
+	if decoded.Percentiles() != sketch.Percentiles() {
+		t.Errorf("decoded percentiles %+v, want %+v", decoded.Percentiles(), sketch.Percentiles())
+	}
+}
+
+func TestLatencySketchEdgeCases(t *testing.T) {
+	empty := NewLatencySketch()
+	if percentiles := empty.Percentiles(); percentiles != (LatencyPercentiles{}) {
+		t.Errorf("empty sketch percentiles = %+v, want zeros", percentiles)
+	}
+	var decoded LatencySketch
+	if q := decoded.Quantile(0.5); q != 0 {
+		t.Errorf("zero sketch median = %v, want 0", q)
+	}
+
+	zeros := NewLatencySketch()
+	zeros.Add(0)
+	zeros.Add(0.5)
+	zeros.Add(100)
+	if q := zeros.Quantile(0.5); q != 0 {
+		t.Errorf("median below the minimum value = %v, want 0", q)
+	}
+	if q := zeros.Quantile(1); math.Abs(q-100)/100 > sketchRelativeAccuracy {
+		t.Errorf("maximum = %v, want about 100", q)
+	}
+	if q := zeros.Quantile(0); q != 0 {
+		t.Errorf("quantile 0 = %v, want the minimum", q)
+	}
+
+	single := NewLatencySketch()
+	single.Add(42e6)
+	for _, q := range []float64{0.5, 0.99} {
+		if estimate := single.Quantile(q); math.Abs(estimate-42e6)/42e6 > sketchRelativeAccuracy {
+			t.Errorf("quantile %v of a single value = %v", q, estimate)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package statistics
+
+// Option value of requests that don't set an option, and get Paccurate's default
+const OptionDefault string = "default"
+
+// Option value counting the values Paccurate doesn't document. Values are chosen by callers, so each
+// distinct one would otherwise add fields to their keystem's stats without bound.
+const OptionOther string = "other"
+
+// Documented values of each option. Values missing here are counted as OptionOther.
+var (
+	boxTypeChoiceGoals = knownValues("lowest-cost", "most-items")
+	placementStyles    = knownValues("default", "corner", "distributed")
+	itemSorts          = knownValues("default", "largest-volume-first", "smallest-volume-first", "largest-longest-dimension-first",
+		"largest-weight-first", "smallest-weight-first", "sequence")
+	ruleOperations = knownValues("exclude", "exclude-all", "irreducible", "lock-orientation", "pack-as-is", "combine",
+		"internal-space", "fragile")
+)
+
+// Options of a pack request that shape how it's packed, recorded with its stats
+type RequestOptions struct {
+	BoxTypeChoiceGoal string   `json:"boxTypeChoiceGoal" bson:"boxTypeChoiceGoal"`
+	PlacementStyle    string   `json:"placementStyle" bson:"placementStyle"`
+	ItemSort          string   `json:"itemSort" bson:"itemSort"`
+	CohortPacking     bool     `json:"cohortPacking" bson:"cohortPacking"`
+	RuleOperations    []string `json:"ruleOperations" bson:"ruleOperations"` // operation of each rule
+	ItemSets          int      `json:"itemSets" bson:"itemSets"`
+	BoxTypeSets       int      `json:"boxTypeSets" bson:"boxTypeSets"`
+}
+
+// Outcomes of the requests using one value of an option
+type OptionOutcomes struct {
+	Requests             int     `json:"requests" bson:"requests"`
+	Packs                int     `json:"packs" bson:"packs"` // successful packs, including cache hits
+	AvgVolumeUtilization float64 `json:"avgVolumeUtilization" bson:"-"`
+	SumVolumeUtilization float64 `json:"-" bson:"sumVolumeUtilization"`
+}
+
+// Usage of request options, with the outcomes of each option's values, so that volume utilization
+// can be compared across them. Averages are derived when read, rather than stored.
+type OptionUsage struct {
+	BoxTypeChoiceGoals map[string]OptionOutcomes `json:"boxTypeChoiceGoals" bson:"boxTypeChoiceGoals"`
+	PlacementStyles    map[string]OptionOutcomes `json:"placementStyles" bson:"placementStyles"`
+	ItemSorts          map[string]OptionOutcomes `json:"itemSorts" bson:"itemSorts"`
+	CohortPacking      map[string]OptionOutcomes `json:"cohortPacking" bson:"cohortPacking"`
+	RuleOperations     map[string]OptionOutcomes `json:"ruleOperations" bson:"ruleOperations"` // requests with at least one rule of each operation
+
+	Requests              int     `json:"requests" bson:"requests"` // requests whose options were recorded
+	TotalItemSets         int     `json:"totalItemSets" bson:"totalItemSets"`
+	AvgItemSetsPerRequest float64 `json:"avgItemSetsPerRequest" bson:"-"`
+	TotalRules            int     `json:"totalRules" bson:"totalRules"`
+	AvgRulesPerRequest    float64 `json:"avgRulesPerRequest" bson:"-"`
+	RequestsWithRules     int     `json:"requestsWithRules" bson:"requestsWithRules"`
+	TotalBoxTypeSets      int     `json:"totalBoxTypeSets" bson:"totalBoxTypeSets"`
+}
+
+// New OptionUsage with no requests
+func NewOptionUsage() *OptionUsage {
+	return &OptionUsage{
+		BoxTypeChoiceGoals: make(map[string]OptionOutcomes),
+		PlacementStyles:    make(map[string]OptionOutcomes),
+		ItemSorts:          make(map[string]OptionOutcomes),
+		CohortPacking:      make(map[string]OptionOutcomes),
+		RuleOperations:     make(map[string]OptionOutcomes),
+	}
+}
+
+// OptionMaps() returns the outcomes of each option's values, by the option's field name
+func (usage *OptionUsage) OptionMaps() map[string]map[string]OptionOutcomes {
+	return map[string]map[string]OptionOutcomes{
+		"boxTypeChoiceGoals": usage.BoxTypeChoiceGoals,
+		"placementStyles":    usage.PlacementStyles,
+		"itemSorts":          usage.ItemSorts,
+		"cohortPacking":      usage.CohortPacking,
+		"ruleOperations":     usage.RuleOperations,
+	}
+}
+
+// AddStats() adds the options of one request, along with its outcome
+func (usage *OptionUsage) AddStats(stats *Stats) {
+	outcome := OptionOutcomes{Requests: 1}
+	if !stats.RequestError && !stats.ErrorResponse {
+		outcome.Packs = 1
+		outcome.SumVolumeUtilization = stats.VolumeUtilization
+	}
+	options := &stats.Options
+	addOptionOutcome(usage.BoxTypeChoiceGoals, optionValue(options.BoxTypeChoiceGoal, boxTypeChoiceGoals), outcome)
+	addOptionOutcome(usage.PlacementStyles, optionValue(options.PlacementStyle, placementStyles), outcome)
+	addOptionOutcome(usage.ItemSorts, optionValue(options.ItemSort, itemSorts), outcome)
+	cohortPacking := "false"
+	if options.CohortPacking {
+		cohortPacking = "true"
+	}
+	addOptionOutcome(usage.CohortPacking, cohortPacking, outcome)
+	seen := make(map[string]bool)
+	for _, operation := range options.RuleOperations {
+		operation = optionValue(operation, ruleOperations)
+		if !seen[operation] {
+			seen[operation] = true
+			addOptionOutcome(usage.RuleOperations, operation, outcome)
+		}
+	}
+
+	usage.Requests++
+	usage.TotalItemSets += options.ItemSets
+	usage.TotalRules += len(options.RuleOperations)
+	usage.RequestsWithRules += btoi(len(options.RuleOperations) > 0)
+	usage.TotalBoxTypeSets += options.BoxTypeSets
+	usage.DeriveAverages()
+}
+
+// Merge() adds the counts and sums of other
+func (usage *OptionUsage) Merge(other *OptionUsage) {
+	otherMaps := other.OptionMaps()
+	for field, outcomes := range usage.OptionMaps() {
+		for value, outcome := range otherMaps[field] {
+			addOptionOutcome(outcomes, value, outcome)
+		}
+	}
+	usage.Requests += other.Requests
+	usage.TotalItemSets += other.TotalItemSets
+	usage.TotalRules += other.TotalRules
+	usage.RequestsWithRules += other.RequestsWithRules
+	usage.TotalBoxTypeSets += other.TotalBoxTypeSets
+	usage.DeriveAverages()
+}
+
+// Negated() returns the counts and sums negated, so that merging them subtracts this usage
+func (usage *OptionUsage) Negated() OptionUsage {
+	negated := NewOptionUsage()
+	negatedMaps := negated.OptionMaps()
+	for field, outcomes := range usage.OptionMaps() {
+		for value, outcome := range outcomes {
+			negatedMaps[field][value] = OptionOutcomes{
+				Requests:             -outcome.Requests,
+				Packs:                -outcome.Packs,
+				SumVolumeUtilization: -outcome.SumVolumeUtilization,
+			}
+		}
+	}
+	negated.Requests = -usage.Requests
+	negated.TotalItemSets = -usage.TotalItemSets
+	negated.TotalRules = -usage.TotalRules
+	negated.RequestsWithRules = -usage.RequestsWithRules
+	negated.TotalBoxTypeSets = -usage.TotalBoxTypeSets
+	return *negated
+}
+
+// DeriveAverages() computes averages from the counts and sums they're based on
+func (usage *OptionUsage) DeriveAverages() {
+	for _, outcomes := range usage.OptionMaps() {
+		for value, outcome := range outcomes {
+			outcome.AvgVolumeUtilization = safeDiv(outcome.SumVolumeUtilization, outcome.Packs)
+			outcomes[value] = outcome
+		}
+	}
+	usage.AvgItemSetsPerRequest = safeDiv(float64(usage.TotalItemSets), usage.Requests)
+	usage.AvgRulesPerRequest = safeDiv(float64(usage.TotalRules), usage.Requests)
+}
+
+func addOptionOutcome(outcomes map[string]OptionOutcomes, value string, outcome OptionOutcomes) {
+	total := outcomes[value]
+	total.Requests += outcome.Requests
+	total.Packs += outcome.Packs
+	total.SumVolumeUtilization += outcome.SumVolumeUtilization
+	outcomes[value] = total
+}
+
+// optionValue() returns the value an option is counted under
+func optionValue(value string, known map[string]bool) string {
+	if value == "" {
+		return OptionDefault
+	}
+	if !known[value] {
+		return OptionOther
+	}
+	return value
+}
+
+func knownValues(values ...string) map[string]bool {
+	known := make(map[string]bool, len(values))
+	for _, value := range values {
+		known[value] = true
+	}
+	return known
+}
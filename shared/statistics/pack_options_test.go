@@ -0,0 +1,44 @@
+package statistics
+
+import "testing"
+
+func TestOptionUsageValues(t *testing.T) {
+	stats := NewStats()
+	stats.VolumeUtilization = 0.5
+	stats.Options = RequestOptions{
+		BoxTypeChoiceGoal: "most-items",
+		PlacementStyle:    "sideways\x00",
+		RuleOperations:    []string{"exclude", "exclude", "made-up", "also-made-up", ""},
+	}
+	usage := NewOptionUsage()
+	usage.AddStats(stats)
+
+	tests := []struct {
+		option string
+		counts map[string]OptionOutcomes
+		want   map[string]int // requests by value
+	}{
+		{"boxTypeChoiceGoals", usage.BoxTypeChoiceGoals, map[string]int{"most-items": 1}},
+		{"placementStyles", usage.PlacementStyles, map[string]int{OptionOther: 1}},
+		{"itemSorts", usage.ItemSorts, map[string]int{OptionDefault: 1}},
+		{"cohortPacking", usage.CohortPacking, map[string]int{"false": 1}},
+		{"ruleOperations", usage.RuleOperations, map[string]int{"exclude": 1, OptionOther: 1, OptionDefault: 1}},
+	}
+	for _, test := range tests {
+		if len(test.counts) != len(test.want) {
+			t.Errorf("%s counted %v, want %v", test.option, test.counts, test.want)
+			continue
+		}
+		for value, requests := range test.want {
+			if test.counts[value].Requests != requests {
+				t.Errorf("%s counted %d requests for %q, want %d", test.option, test.counts[value].Requests, value, requests)
+			}
+		}
+	}
+	if usage.TotalRules != 5 || usage.RequestsWithRules != 1 {
+		t.Errorf("counted %d rules in %d requests, want 5 in 1", usage.TotalRules, usage.RequestsWithRules)
+	}
+	if outcome := usage.BoxTypeChoiceGoals["most-items"]; outcome.AvgVolumeUtilization != 0.5 {
+		t.Errorf("avgVolumeUtilization = %v, want 0.5", outcome.AvgVolumeUtilization)
+	}
+}
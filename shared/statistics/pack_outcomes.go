@@ -0,0 +1,94 @@
+package statistics
+
+// Outcomes of successful packs, aggregated for one keystem or across keystems. Failed requests and error
+// responses have no pack, so they aren't counted.
+type PackOutcomes struct {
+	PackCount            int     `json:"packCount" bson:"packCount"` // successful packs, including cache hits
+	TotalCost            int     `json:"totalCost" bson:"totalCost"`
+	AvgCostPerPack       float64 `json:"avgCostPerPack" bson:"avgCostPerPack"`
+	TotalWeight          float64 `json:"totalWeight" bson:"totalWeight"`
+	AvgWeightUtilization float64 `json:"avgWeightUtilization" bson:"avgWeightUtilization"`
+	TotalBoxes           int     `json:"totalBoxes" bson:"totalBoxes"`
+	AvgBoxesPerPack      float64 `json:"avgBoxesPerPack" bson:"avgBoxesPerPack"`
+	TotalLeftovers       int     `json:"totalLeftovers" bson:"totalLeftovers"`
+	PacksWithLeftovers   int     `json:"packsWithLeftovers" bson:"packsWithLeftovers"`
+	LeftoverRate         float64 `json:"leftoverRate" bson:"leftoverRate"` // share of packs leaving items unpacked
+	DimWeightBoxes       int     `json:"dimWeightBoxes" bson:"dimWeightBoxes"`
+	DimWeightRate        float64 `json:"dimWeightRate" bson:"dimWeightRate"` // share of boxes priced on dimensional weight
+	AvgPackTime          float64 `json:"avgPackTime" bson:"avgPackTime"`     // time Paccurate spent packing, excluding cache hits
+	PackTimeShare        float64 `json:"packTimeShare" bson:"packTimeShare"` // share of the round trip through the proxy spent packing
+
+	// Sums the averages are derived from, so that they can be incremented in the database
+	SumWeightUtilization float64 `json:"-" bson:"sumWeightUtilization"`
+	SumPackTime          float64 `json:"-" bson:"sumPackTime"`    // excludes cache hits
+	SumPackLatency       float64 `json:"-" bson:"sumPackLatency"` // round trip latency of the packs in SumPackTime
+	TimedPackCount       int     `json:"-" bson:"timedPackCount"` // packs in SumPackTime
+}
+
+// AddStats() adds the outcome of one request, if it produced a pack
+func (outcomes *PackOutcomes) AddStats(stats *Stats) {
+	if stats.RequestError || stats.ErrorResponse {
+		return
+	}
+	outcomes.PackCount++
+	outcomes.TotalCost += stats.TotalCost
+	outcomes.TotalWeight += stats.TotalWeight
+	outcomes.SumWeightUtilization += stats.WeightUtilization
+	outcomes.TotalBoxes += stats.Boxes
+	outcomes.TotalLeftovers += stats.Leftovers
+	outcomes.PacksWithLeftovers += btoi(stats.Leftovers > 0)
+	outcomes.DimWeightBoxes += stats.DimWeightBoxes
+	if !stats.CacheHit { // A cache hit didn't wait for Paccurate to pack
+		outcomes.SumPackTime += stats.PackTime
+		outcomes.SumPackLatency += stats.Latency
+		outcomes.TimedPackCount++
+	}
+	outcomes.DeriveAverages()
+}
+
+// Merge() adds the counts and sums of other
+func (outcomes *PackOutcomes) Merge(other *PackOutcomes) {
+	outcomes.PackCount += other.PackCount
+	outcomes.TotalCost += other.TotalCost
+	outcomes.TotalWeight += other.TotalWeight
+	outcomes.SumWeightUtilization += other.SumWeightUtilization
+	outcomes.TotalBoxes += other.TotalBoxes
+	outcomes.TotalLeftovers += other.TotalLeftovers
+	outcomes.PacksWithLeftovers += other.PacksWithLeftovers
+	outcomes.DimWeightBoxes += other.DimWeightBoxes
+	outcomes.SumPackTime += other.SumPackTime
+	outcomes.SumPackLatency += other.SumPackLatency
+	outcomes.TimedPackCount += other.TimedPackCount
+	outcomes.DeriveAverages()
+}
+
+// Negated() returns the counts and sums negated, so that merging them subtracts these outcomes
+func (outcomes *PackOutcomes) Negated() PackOutcomes {
+	return PackOutcomes{
+		PackCount:            -outcomes.PackCount,
+		TotalCost:            -outcomes.TotalCost,
+		TotalWeight:          -outcomes.TotalWeight,
+		SumWeightUtilization: -outcomes.SumWeightUtilization,
+		TotalBoxes:           -outcomes.TotalBoxes,
+		TotalLeftovers:       -outcomes.TotalLeftovers,
+		PacksWithLeftovers:   -outcomes.PacksWithLeftovers,
+		DimWeightBoxes:       -outcomes.DimWeightBoxes,
+		SumPackTime:          -outcomes.SumPackTime,
+		SumPackLatency:       -outcomes.SumPackLatency,
+		TimedPackCount:       -outcomes.TimedPackCount,
+	}
+}
+
+// DeriveAverages() computes averages and rates from the counts and sums they're based on
+func (outcomes *PackOutcomes) DeriveAverages() {
+	outcomes.AvgCostPerPack = safeDiv(float64(outcomes.TotalCost), outcomes.PackCount)
+	outcomes.AvgWeightUtilization = safeDiv(outcomes.SumWeightUtilization, outcomes.PackCount)
+	outcomes.AvgBoxesPerPack = safeDiv(float64(outcomes.TotalBoxes), outcomes.PackCount)
+	outcomes.LeftoverRate = safeDiv(float64(outcomes.PacksWithLeftovers), outcomes.PackCount)
+	outcomes.DimWeightRate = safeDiv(float64(outcomes.DimWeightBoxes), outcomes.TotalBoxes)
+	outcomes.AvgPackTime = safeDiv(outcomes.SumPackTime, outcomes.TimedPackCount)
+	outcomes.PackTimeShare = 0
+	if outcomes.SumPackLatency > 0 {
+		outcomes.PackTimeShare = outcomes.SumPackTime / outcomes.SumPackLatency
+	}
+}
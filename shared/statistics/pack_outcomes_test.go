@@ -0,0 +1,82 @@
+package statistics
+
+import "testing"
+
+func packStats(cost int, boxes int, leftovers int, dimWeightBoxes int, packTime float64, latency float64) *Stats {
+	stats := NewStats()
+	stats.TotalCost = cost
+	stats.TotalWeight = 10
+	stats.WeightUtilization = 0.5
+	stats.Boxes = boxes
+	stats.Leftovers = leftovers
+	stats.DimWeightBoxes = dimWeightBoxes
+	stats.PackTime = packTime
+	stats.Latency = latency
+	return stats
+}
+
+func TestPackOutcomesAddStats(t *testing.T) {
+	cached := packStats(300, 1, 0, 0, 0, 5)
+	cached.CacheHit = true
+	requestError := packStats(0, 0, 0, 0, 0, 100)
+	requestError.RequestError = true
+	errorResponse := packStats(0, 0, 0, 0, 0, 100)
+	errorResponse.ErrorResponse = true
+
+	var outcomes PackOutcomes
+	for _, stats := range []*Stats{packStats(100, 2, 0, 1, 40, 100), packStats(200, 1, 3, 0, 60, 100), cached, requestError, errorResponse} {
+		outcomes.AddStats(stats)
+	}
+	want := PackOutcomes{
+		PackCount:            3, // failed requests and error responses have no pack
+		TotalCost:            600,
+		AvgCostPerPack:       200,
+		TotalWeight:          30,
+		AvgWeightUtilization: 0.5,
+		TotalBoxes:           4,
+		AvgBoxesPerPack:      4.0 / 3,
+		TotalLeftovers:       3,
+		PacksWithLeftovers:   1,
+		LeftoverRate:         1.0 / 3,
+		DimWeightBoxes:       1,
+		DimWeightRate:        0.25,
+		AvgPackTime:          50, // the cache hit isn't timed
+		PackTimeShare:        0.5,
+		SumWeightUtilization: 1.5,
+		SumPackTime:          100,
+		SumPackLatency:       200,
+		TimedPackCount:       2,
+	}
+	if outcomes != want {
+		t.Errorf("outcomes %+v, want %+v", outcomes, want)
+	}
+}
+
+func TestPackOutcomesMerge(t *testing.T) {
+	var first, second, whole PackOutcomes
+	for i, stats := range []*Stats{packStats(100, 2, 0, 1, 40, 100), packStats(200, 1, 3, 0, 60, 100), packStats(50, 3, 1, 3, 10, 80)} {
+		if i < 2 {
+			first.AddStats(stats)
+		} else {
+			second.AddStats(stats)
+		}
+		whole.AddStats(stats)
+	}
+	merged := first
+	merged.Merge(&second)
+	if merged != whole {
+		t.Errorf("merged %+v, want %+v", merged, whole)
+	}
+
+	// Merging the negated outcomes subtracts them, down to nothing
+	negated := second.Negated()
+	merged.Merge(&negated)
+	if merged != first {
+		t.Errorf("subtracted %+v, want %+v", merged, first)
+	}
+	negated = first.Negated()
+	merged.Merge(&negated)
+	if merged != (PackOutcomes{}) {
+		t.Errorf("subtracting everything left %+v", merged)
+	}
+}
@@ -2,82 +2,192 @@ package statistics
 
 //go:generate easytags $GOFILE json:camel bson:camel
 
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Granularities of time-bucketed statistics
+const (
+	GranularityMinute string = "minute"
+	GranularityHour   string = "hour"
+	GranularityDay    string = "day"
+)
+
+var Granularities = []string{GranularityMinute, GranularityHour, GranularityDay}
+
+// Classes of errors that kept a request from reaching Paccurate
+const (
+	ErrorClassDNS         string = "dns"
+	ErrorClassConnect     string = "connect"
+	ErrorClassTLS         string = "tls"
+	ErrorClassTimeout     string = "timeout"
+	ErrorClassCircuitOpen string = "circuit_open"
+	ErrorClassOther       string = "other"
+)
+
+// Categories of Paccurate error responses. Invalid items and boxes fitting no item point to catalog data,
+// while timeouts and service errors point to Paccurate.
+const (
+	ErrorCategoryInvalidItem    string = "invalid_item"
+	ErrorCategoryNoBoxFits      string = "no_box_fits"
+	ErrorCategoryInvalidRequest string = "invalid_request"
+	ErrorCategoryTimeout        string = "timeout"
+	ErrorCategoryAuth           string = "auth"
+	ErrorCategoryQuota          string = "quota"
+	ErrorCategoryService        string = "service"
+)
+
+// Keystem of stats that couldn't be attributed to one
+const UnknownKeystem string = "unknown"
+
+// Request to delete the stats of a keystem, either all of them or only those of a time range
 type DeleteRequest struct {
-	UsedKeystem string `json:"usedKeystem" bson:"usedKeystem"`
+	ID          string     `json:"id" bson:"id"` // ID of the delete job, reporting when the request was applied
+	UsedKeystem string     `json:"usedKeystem" bson:"usedKeystem"`
+	From        *time.Time `json:"from,omitempty" bson:"from,omitempty"` // start of the range, inclusive
+	To          *time.Time `json:"to,omitempty" bson:"to,omitempty"`     // end of the range, exclusive
+}
+
+// IsRange() reports whether the request only deletes the stats of a time range
+func (dr *DeleteRequest) IsRange() bool {
+	return dr.From != nil && dr.To != nil
 }
 
 // Statistics for a single request
 type Stats struct {
 	// Pack Request Stats
-	UsedKeystem       string         `json:"usedKeystem" bson:"usedKeystem"`
-	TotalItems        int            `json:"totalItems" bson:"totalItems"`
-	TotalVolume       float64        `json:"totalVolume" bson:"totalVolume"`
-	VolumeUtilization float64        `json:"volumeUtilization" bson:"volumeUtilization"`
-	BoxTypes          map[string]int `json:"boxTypes" bson:"boxTypes"`
+	UsedKeystem       string          `json:"usedKeystem" bson:"usedKeystem"`
+	TotalItems        int             `json:"totalItems" bson:"totalItems"`
+	TotalVolume       float64         `json:"totalVolume" bson:"totalVolume"`
+	VolumeUtilization float64         `json:"volumeUtilization" bson:"volumeUtilization"`
+	BoxTypes          map[string]int  `json:"boxTypes" bson:"boxTypes"`
+	TotalCost         int             `json:"totalCost" bson:"totalCost"`
+	TotalWeight       float64         `json:"totalWeight" bson:"totalWeight"`
+	WeightUtilization float64         `json:"weightUtilization" bson:"weightUtilization"` // average weight utilization of the pack's boxes
+	Boxes             int             `json:"boxes" bson:"boxes"`
+	Leftovers         int             `json:"leftovers" bson:"leftovers"`           // items that couldn't be packed
+	DimWeightBoxes    int             `json:"dimWeightBoxes" bson:"dimWeightBoxes"` // boxes priced on dimensional weight
+	PackTime          float64         `json:"packTime" bson:"packTime"`             // time Paccurate spent packing and rendering
+	Options           RequestOptions  `json:"options" bson:"options"`
+	BoxTypeStats      BoxTypeStatsMap `json:"boxTypeStats" bson:"boxTypeStats"` // performance of each box type in the pack, by refId
 
 	// API Stats
+	EventID       string  `json:"eventId" bson:"eventId"`                         // identifies the pack, so that duplicate messages can be dropped
+	RequestID     string  `json:"requestId,omitempty" bson:"requestId,omitempty"` // IDs the caller gave the pack request
+	OrderID       string  `json:"orderId,omitempty" bson:"orderId,omitempty"`
 	TimeStamp     string  `json:"timeStamp" bson:"timeStamp"`
 	CacheHit      bool    `json:"cacheHit" bson:"cacheHit"`
 	RequestError  bool    `json:"requestError" bson:"requestError"`
 	ErrorResponse bool    `json:"errorResponse" bson:"errorResponse"`
 	StatusCode    string  `json:"statusCode" bson:"statusCode"`
 	Latency       float64 `json:"latency" bson:"latency"`
+	Retries       int     `json:"retries" bson:"retries"`             // times the request was resent to Paccurate
+	CircuitOpen   bool    `json:"circuitOpen" bson:"circuitOpen"`     // true if the request wasn't sent, since Paccurate's circuit breaker was open
+	ErrorClass    string  `json:"errorClass" bson:"errorClass"`       // class of the error that kept the request from reaching Paccurate, if any
+	ErrorCategory string  `json:"errorCategory" bson:"errorCategory"` // category of Paccurate's error response, if any
 }
 
 // Aggregated statistics for one keystem
 type KeyStats struct {
-	UsedKeystem          string         `json:"usedKeystem" bson:"usedKeystem"`
-	TotalItems           int            `json:"totalItems" bson:"totalItems"`
-	TotalVolume          float64        `json:"totalVolume" bson:"totalVolume"`
-	AvgItemsPerPack      float64        `json:"avgItemsPerPack" bson:"avgItemsPerPack"`
-	AvgVolumeUtilization float64        `json:"avgVolumeUtilization" bson:"avgVolumeUtilization"`
-	BoxTypes             map[string]int `json:"boxTypes" bson:"boxTypes"`
+	UsedKeystem          string          `json:"usedKeystem" bson:"usedKeystem"`
+	TotalItems           int             `json:"totalItems" bson:"totalItems"`
+	TotalVolume          float64         `json:"totalVolume" bson:"totalVolume"`
+	AvgItemsPerPack      float64         `json:"avgItemsPerPack" bson:"avgItemsPerPack"`
+	AvgVolumeUtilization float64         `json:"avgVolumeUtilization" bson:"avgVolumeUtilization"`
+	BoxTypes             map[string]int  `json:"boxTypes" bson:"boxTypes"`
+	BoxTypeStats         BoxTypeStatsMap `json:"boxTypeStats" bson:"boxTypeStats"` // performance of each box type, by refId
+	PackOutcomes         `bson:",inline"`
+	Options              OptionUsage `json:"options" bson:"options"`
 
 	TotalRequests      int            `json:"totalRequests" bson:"totalRequests"`
 	StatusCodes        map[string]int `json:"statusCodes" bson:"statusCodes"`
 	RequestErrorCount  int            `json:"requestErrorCount" bson:"requestErrorCount"`
 	ErrorResponseCount int            `json:"errorCount" bson:"errorResponseCount"`
 	CacheHits          int            `json:"cacheHits" bson:"cacheHits"`
+	DuplicateCount     int            `json:"duplicateCount" bson:"duplicateCount"`     // duplicate stats messages dropped by the aggregators
+	RetryCount         int            `json:"retryCount" bson:"retryCount"`             // requests resent to Paccurate
+	CircuitOpenCount   int            `json:"circuitOpenCount" bson:"circuitOpenCount"` // requests rejected by Paccurate's circuit breaker
+	ErrorClasses       map[string]int `json:"errorClasses" bson:"errorClasses"`         // map of transport error classes and their frequency
+	ErrorCategories    map[string]int `json:"errorCategories" bson:"errorCategories"`   // map of Paccurate error response categories and their frequency
 	HighestLatency     MaxLatency     `json:"maxLatency" bson:"highestLatency"`
 
-	AvgLatency float64 `json:"avgLatency" bson:"avgLatency"`
+	AvgLatency         float64            `json:"avgLatency" bson:"avgLatency"`
+	ErrorRate          float64            `json:"errorRate" bson:"errorRate"` // share of requests that failed or got an error response
+	LatencySketch      LatencySketch      `json:"-" bson:"latencySketch"`
+	LatencyPercentiles LatencyPercentiles `json:"latencyPercentiles" bson:"-"` // filled in by ComputePercentiles()
+
+	// Sums the averages are derived from, so that they can be incremented in the database
+	SumVolumeUtilization float64 `json:"-" bson:"sumVolumeUtilization"`
+	SumLatency           float64 `json:"-" bson:"sumLatency"` // excludes cache hits
 }
 
 type MaxLatency struct {
-	Latency   float64 `json:"latency" bson:"latency"`
-	TimeStamp string  `json:"timeStamp" bson:"timeStamp"`
+	Latency   float64   `json:"latency" bson:"latency"`
+	TimeStamp time.Time `json:"timeStamp" bson:"timeStamp"`
 }
 
 // Aggregated statistics across multiple keystems
 type AggregatedKeyStats struct {
-	TotalItems           int            `json:"totalItems" bson:"totalItems"`
-	TotalVolume          float64        `json:"totalVolume" bson:"totalVolume"`
-	AvgItemsPerPack      float64        `json:"avgItemsPerPack" bson:"avgItemsPerPack"`
-	AvgVolumeUtilization float64        `json:"avgVolumeUtilization" bson:"avgVolumeUtilization"`
-	BoxTypes             map[string]int `json:"boxTypes" bson:"boxTypes"`
+	TotalItems           int             `json:"totalItems" bson:"totalItems"`
+	TotalVolume          float64         `json:"totalVolume" bson:"totalVolume"`
+	AvgItemsPerPack      float64         `json:"avgItemsPerPack" bson:"avgItemsPerPack"`
+	AvgVolumeUtilization float64         `json:"avgVolumeUtilization" bson:"avgVolumeUtilization"`
+	BoxTypes             map[string]int  `json:"boxTypes" bson:"boxTypes"`
+	BoxTypeStats         BoxTypeStatsMap `json:"boxTypeStats" bson:"boxTypeStats"` // performance of each box type, by refId
+	PackOutcomes         `bson:",inline"`
+	Options              OptionUsage `json:"options" bson:"options"`
 
 	TotalRequests      int            `json:"totalRequests" bson:"totalRequests"`
 	StatusCodes        map[string]int `json:"statusCodes" bson:"statusCodes"`
 	RequestErrorCount  int            `json:"requestErrorCount" bson:"requestErrorCount"`
 	ErrorResponseCount int            `json:"errorCount" bson:"errorResponseCount"`
 	CacheHits          int            `json:"cacheHits" bson:"cacheHits"`
+	DuplicateCount     int            `json:"duplicateCount" bson:"duplicateCount"`     // duplicate stats messages dropped by the aggregators
+	RetryCount         int            `json:"retryCount" bson:"retryCount"`             // requests resent to Paccurate
+	CircuitOpenCount   int            `json:"circuitOpenCount" bson:"circuitOpenCount"` // requests rejected by Paccurate's circuit breaker
+	ErrorClasses       map[string]int `json:"errorClasses" bson:"errorClasses"`         // map of transport error classes and their frequency
+	ErrorCategories    map[string]int `json:"errorCategories" bson:"errorCategories"`   // map of Paccurate error response categories and their frequency
 	MaxLatency         struct {
-		Latency     float64 `json:"latency" bson:"latency"`
-		UsedKeystem string  `json:"usedKeystem" bson:"usedKeystem"`
-		TimeStamp   string  `json:"timeStamp" bson:"timeStamp"`
+		Latency     float64   `json:"latency" bson:"latency"`
+		UsedKeystem string    `json:"usedKeystem" bson:"usedKeystem"`
+		TimeStamp   time.Time `json:"timeStamp" bson:"timeStamp"`
 	} `json:"maxLatency" bson:"maxLatency"`
 
 	AvgLatency        float64 `json:"avgLatency" bson:"avgLatency"`
+	ErrorRate         float64 `json:"errorRate" bson:"errorRate"` // share of requests that failed or got an error response
 	HighestAvgLatency struct {
 		Latency     float64 `json:"latency" bson:"latency"`
 		UsedKeystem string  `json:"usedKeystem" bson:"usedKeystem"`
 	} `json:"highestAvgLatency" bson:"highestAvgLatency"`
+	LatencySketch      LatencySketch      `json:"-" bson:"latencySketch"`
+	LatencyPercentiles LatencyPercentiles `json:"latencyPercentiles" bson:"-"` // filled in by ComputePercentiles()
+
+	// Sums the averages are derived from, so that they can be incremented in the database
+	SumVolumeUtilization float64 `json:"-" bson:"sumVolumeUtilization"`
+	SumLatency           float64 `json:"-" bson:"sumLatency"` // excludes cache hits
+}
+
+// Aggregated statistics for one keystem over one period, starting at Start
+type KeyStatsBucket struct {
+	Granularity string    `json:"granularity" bson:"granularity"`
+	Start       time.Time `json:"start" bson:"start"`
+	KeyStats    `bson:",inline"`
+}
+
+// Aggregated statistics across multiple keystems over one period, starting at Start
+type AggregatedKeyStatsBucket struct {
+	Granularity        string    `json:"granularity" bson:"granularity"`
+	Start              time.Time `json:"start" bson:"start"`
+	AggregatedKeyStats `bson:",inline"`
 }
 
 // New Stats instance with default values
 func NewStats() *Stats {
 	var stats Stats = Stats{
-		BoxTypes: make(map[string]int),
+		BoxTypes:     make(map[string]int),
+		BoxTypeStats: make(BoxTypeStatsMap),
 	}
 	return &stats
 }
@@ -92,8 +202,13 @@ func NewKeyStats(keystem string) *KeyStats {
 // New AggregatedKeyStats with default values
 func NewAggregatedKeyStats() *AggregatedKeyStats {
 	akstats := AggregatedKeyStats{
-		BoxTypes:    make(map[string]int),
-		StatusCodes: make(map[string]int),
+		BoxTypes:        make(map[string]int),
+		BoxTypeStats:    make(BoxTypeStatsMap),
+		Options:         *NewOptionUsage(),
+		StatusCodes:     make(map[string]int),
+		ErrorClasses:    make(map[string]int),
+		ErrorCategories: make(map[string]int),
+		LatencySketch:   *NewLatencySketch(),
 	}
 	return &akstats
 }
@@ -106,17 +221,92 @@ func (keyStats *KeyStats) Init(usedKeystem string) {
 	keyStats.AvgItemsPerPack = 0
 	keyStats.AvgVolumeUtilization = 0
 	keyStats.BoxTypes = make(map[string]int)
+	keyStats.BoxTypeStats = make(BoxTypeStatsMap)
+	keyStats.PackOutcomes = PackOutcomes{}
+	keyStats.Options = *NewOptionUsage()
 
 	keyStats.TotalRequests = 0
 	keyStats.StatusCodes = make(map[string]int)
 	keyStats.RequestErrorCount = 0
 	keyStats.ErrorResponseCount = 0
 	keyStats.CacheHits = 0
+	keyStats.DuplicateCount = 0
+	keyStats.RetryCount = 0
+	keyStats.CircuitOpenCount = 0
+	keyStats.ErrorClasses = make(map[string]int)
+	keyStats.ErrorCategories = make(map[string]int)
 	keyStats.HighestLatency = MaxLatency{
 		Latency:   0,
-		TimeStamp: "",
+		TimeStamp: time.Time{},
 	}
 	keyStats.AvgLatency = 0
+	keyStats.ErrorRate = 0
+	keyStats.LatencySketch = *NewLatencySketch()
+	keyStats.LatencyPercentiles = LatencyPercentiles{}
+	keyStats.SumVolumeUtilization = 0
+	keyStats.SumLatency = 0
+}
+
+// New KeyStatsBucket for the period of the given granularity containing t
+func NewKeyStatsBucket(keystem string, granularity string, t time.Time) (*KeyStatsBucket, error) {
+	start, err := BucketStart(t, granularity)
+	if err != nil {
+		return nil, err
+	}
+	bucket := KeyStatsBucket{
+		Granularity: granularity,
+		Start:       start,
+	}
+	bucket.Init(keystem)
+	return &bucket, nil
+}
+
+// New AggregatedKeyStatsBucket with default values
+func NewAggregatedKeyStatsBucket(granularity string, start time.Time) *AggregatedKeyStatsBucket {
+	return &AggregatedKeyStatsBucket{
+		Granularity:        granularity,
+		Start:              start,
+		AggregatedKeyStats: *NewAggregatedKeyStats(),
+	}
+}
+
+// BucketStart() returns the start of the period of the given granularity containing t, in UTC
+func BucketStart(t time.Time, granularity string) (time.Time, error) {
+	t = t.UTC()
+	switch granularity {
+	case GranularityMinute:
+		return t.Truncate(time.Minute), nil
+	case GranularityHour:
+		return t.Truncate(time.Hour), nil
+	case GranularityDay:
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC), nil
+	}
+	return time.Time{}, fmt.Errorf("unknown granularity %q", granularity)
+}
+
+// BucketLength() returns the length of a period of the given granularity
+func BucketLength(granularity string) (time.Duration, error) {
+	switch granularity {
+	case GranularityMinute:
+		return time.Minute, nil
+	case GranularityHour:
+		return time.Hour, nil
+	case GranularityDay:
+		return 24 * time.Hour, nil
+	}
+	return 0, fmt.Errorf("unknown granularity %q", granularity)
+}
+
+// ParseTimeStamp() parses a Stats timestamp. Both RFC 3339 and the format of Go's
+// time.Time.String(), including its monotonic clock suffix, are accepted.
+func ParseTimeStamp(timeStamp string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339Nano, timeStamp); err == nil {
+		return t, nil
+	}
+	if i := strings.Index(timeStamp, " m="); i >= 0 {
+		timeStamp = timeStamp[:i]
+	}
+	return time.Parse("2006-01-02 15:04:05.999999999 -0700 MST", timeStamp)
 }
 
 func (keyStats *KeyStats) Reset() {
@@ -126,64 +316,83 @@ func (keyStats *KeyStats) Reset() {
 // Aggregate the values from a Stats instance into a KeyStats instance
 func (keyStats *KeyStats) AggregateStats(stats *Stats) {
 	// Aggregate pack statistics
-	keyStats.TotalItems = keyStats.TotalItems + stats.TotalItems
+	keyStats.TotalItems += stats.TotalItems
 	keyStats.TotalVolume += stats.TotalVolume
-	keyStats.AvgItemsPerPack = (keyStats.AvgItemsPerPack*float64(keyStats.TotalRequests) + float64(stats.TotalItems)) / (float64(keyStats.TotalRequests) + 1)
-	keyStats.AvgVolumeUtilization = (keyStats.AvgVolumeUtilization*float64(keyStats.TotalRequests) + float64(stats.VolumeUtilization)) / (float64(keyStats.TotalRequests) + 1)
-	for k, v := range stats.BoxTypes {
-		_, keyExists := keyStats.BoxTypes[k]
-		if keyExists {
-			keyStats.BoxTypes[k] += v
-		} else {
-			keyStats.BoxTypes[k] = v
-		}
-	}
+	keyStats.SumVolumeUtilization += stats.VolumeUtilization
+	importCounts(stats.BoxTypes, keyStats.BoxTypes)
+	keyStats.BoxTypeStats.Merge(stats.BoxTypeStats)
+	keyStats.PackOutcomes.AddStats(stats)
+	keyStats.Options.AddStats(stats)
+
 	// Aggregate API statistics
 	if stats.StatusCode != "" {
-		if _, keyExists := keyStats.StatusCodes[stats.StatusCode]; keyExists {
-			keyStats.StatusCodes[stats.StatusCode]++
-		} else {
-			keyStats.StatusCodes[stats.StatusCode] = 1
-		}
+		keyStats.StatusCodes[stats.StatusCode]++
 	}
 	keyStats.RequestErrorCount += btoi(stats.RequestError)
 	keyStats.ErrorResponseCount += btoi(stats.ErrorResponse)
 	if !stats.CacheHit { // If cache hit, ignore the latency
 		if stats.Latency > keyStats.HighestLatency.Latency {
 			keyStats.HighestLatency.Latency = stats.Latency
-			keyStats.HighestLatency.TimeStamp = stats.TimeStamp
+			// An unparsable timestamp is recorded as the zero time rather than losing the latency
+			keyStats.HighestLatency.TimeStamp, _ = ParseTimeStamp(stats.TimeStamp)
 		}
-		keyStats.AvgLatency = ((keyStats.AvgLatency*float64(keyStats.TotalRequests-keyStats.CacheHits) + stats.Latency) / float64(keyStats.TotalRequests-keyStats.CacheHits+1))
+		keyStats.SumLatency += stats.Latency
+		keyStats.LatencySketch.Add(stats.Latency)
 	}
 	keyStats.CacheHits += btoi(stats.CacheHit)
+	keyStats.RetryCount += stats.Retries
+	keyStats.CircuitOpenCount += btoi(stats.CircuitOpen)
+	if stats.ErrorClass != "" {
+		keyStats.ErrorClasses[stats.ErrorClass]++
+	}
+	if stats.ErrorCategory != "" {
+		keyStats.ErrorCategories[stats.ErrorCategory]++
+	}
 	keyStats.TotalRequests++
+	keyStats.DeriveAverages()
 }
 
+// Aggregate the values from another KeyStats instance into this one
 func (keyStats *KeyStats) AggregateKeyStats(other *KeyStats) {
 	// Aggregate pack statistics
 	keyStats.TotalItems += other.TotalItems
 	keyStats.TotalVolume += other.TotalVolume
-	keyStats.AvgItemsPerPack = (keyStats.AvgItemsPerPack*float64(keyStats.TotalRequests) + float64(other.TotalRequests)*other.AvgItemsPerPack) / (float64(keyStats.TotalRequests + other.TotalRequests))
-	keyStats.AvgVolumeUtilization = (keyStats.AvgVolumeUtilization*float64(keyStats.TotalRequests) + float64(other.TotalRequests)*other.AvgVolumeUtilization) / (float64(keyStats.TotalRequests + other.TotalRequests))
+	keyStats.SumVolumeUtilization += other.SumVolumeUtilization
 	importCounts(other.BoxTypes, keyStats.BoxTypes)
+	keyStats.BoxTypeStats.Merge(other.BoxTypeStats)
+	keyStats.PackOutcomes.Merge(&other.PackOutcomes)
+	keyStats.Options.Merge(&other.Options)
 
 	// Aggregate API statistics
 	importCounts(other.StatusCodes, keyStats.StatusCodes)
 	keyStats.RequestErrorCount += other.RequestErrorCount
 	keyStats.ErrorResponseCount += other.ErrorResponseCount
-	keyStats.AvgLatency = ((keyStats.AvgLatency*float64(keyStats.TotalRequests-keyStats.CacheHits) + other.AvgItemsPerPack*float64(other.TotalRequests-other.CacheHits)) / float64(keyStats.TotalRequests-keyStats.CacheHits+other.TotalRequests-other.CacheHits))
+	if other.HighestLatency.Latency > keyStats.HighestLatency.Latency {
+		keyStats.HighestLatency = other.HighestLatency
+	}
+	keyStats.SumLatency += other.SumLatency
+	keyStats.LatencySketch.Merge(&other.LatencySketch)
 
 	keyStats.CacheHits += other.CacheHits
+	keyStats.DuplicateCount += other.DuplicateCount
+	keyStats.RetryCount += other.RetryCount
+	keyStats.CircuitOpenCount += other.CircuitOpenCount
+	importCounts(other.ErrorClasses, keyStats.ErrorClasses)
+	importCounts(other.ErrorCategories, keyStats.ErrorCategories)
 	keyStats.TotalRequests += other.TotalRequests
+	keyStats.DeriveAverages()
 }
 
+// Aggregate the values from a KeyStats instance into an AggregatedKeyStats instance
 func (akStats *AggregatedKeyStats) AggregateKeyStats(keyStats *KeyStats) {
 	// Aggregate pack statistics
 	akStats.TotalItems += keyStats.TotalItems
 	akStats.TotalVolume += keyStats.TotalVolume
-	akStats.AvgItemsPerPack = (akStats.AvgItemsPerPack*float64(akStats.TotalRequests) + float64(keyStats.TotalRequests)*keyStats.AvgItemsPerPack) / (float64(akStats.TotalRequests + keyStats.TotalRequests))
-	akStats.AvgVolumeUtilization = (akStats.AvgVolumeUtilization*float64(akStats.TotalRequests) + float64(keyStats.TotalRequests)*keyStats.AvgVolumeUtilization) / (float64(akStats.TotalRequests + keyStats.TotalRequests))
+	akStats.SumVolumeUtilization += keyStats.SumVolumeUtilization
 	importCounts(keyStats.BoxTypes, akStats.BoxTypes)
+	akStats.BoxTypeStats.Merge(keyStats.BoxTypeStats)
+	akStats.PackOutcomes.Merge(&keyStats.PackOutcomes)
+	akStats.Options.Merge(&keyStats.Options)
 
 	// Aggregate API statistics
 	importCounts(keyStats.StatusCodes, akStats.StatusCodes)
@@ -198,10 +407,51 @@ func (akStats *AggregatedKeyStats) AggregateKeyStats(keyStats *KeyStats) {
 		akStats.HighestAvgLatency.Latency = keyStats.AvgLatency
 		akStats.HighestAvgLatency.UsedKeystem = keyStats.UsedKeystem
 	}
-	akStats.AvgLatency = ((akStats.AvgLatency * float64(akStats.TotalRequests-akStats.CacheHits)) + (keyStats.AvgLatency * float64(keyStats.TotalRequests-keyStats.CacheHits))) / (float64(akStats.TotalRequests + keyStats.TotalRequests - akStats.CacheHits - keyStats.CacheHits))
+	akStats.SumLatency += keyStats.SumLatency
+	akStats.LatencySketch.Merge(&keyStats.LatencySketch)
 
 	akStats.CacheHits += keyStats.CacheHits
+	akStats.DuplicateCount += keyStats.DuplicateCount
+	akStats.RetryCount += keyStats.RetryCount
+	akStats.CircuitOpenCount += keyStats.CircuitOpenCount
+	importCounts(keyStats.ErrorClasses, akStats.ErrorClasses)
+	importCounts(keyStats.ErrorCategories, akStats.ErrorCategories)
 	akStats.TotalRequests += keyStats.TotalRequests
+	akStats.DeriveAverages()
+}
+
+// DeriveAverages() computes averages from the sums they're based on
+func (keyStats *KeyStats) DeriveAverages() {
+	keyStats.AvgItemsPerPack = safeDiv(float64(keyStats.TotalItems), keyStats.TotalRequests)
+	keyStats.AvgVolumeUtilization = safeDiv(keyStats.SumVolumeUtilization, keyStats.TotalRequests)
+	keyStats.AvgLatency = safeDiv(keyStats.SumLatency, keyStats.TotalRequests-keyStats.CacheHits)
+	keyStats.ErrorRate = safeDiv(float64(keyStats.RequestErrorCount+keyStats.ErrorResponseCount), keyStats.TotalRequests)
+}
+
+// DeriveAverages() computes averages from the sums they're based on
+func (akStats *AggregatedKeyStats) DeriveAverages() {
+	akStats.AvgItemsPerPack = safeDiv(float64(akStats.TotalItems), akStats.TotalRequests)
+	akStats.AvgVolumeUtilization = safeDiv(akStats.SumVolumeUtilization, akStats.TotalRequests)
+	akStats.AvgLatency = safeDiv(akStats.SumLatency, akStats.TotalRequests-akStats.CacheHits)
+	akStats.ErrorRate = safeDiv(float64(akStats.RequestErrorCount+akStats.ErrorResponseCount), akStats.TotalRequests)
+}
+
+// ComputePercentiles() estimates latency percentiles from the latency sketch
+func (keyStats *KeyStats) ComputePercentiles() {
+	keyStats.LatencyPercentiles = keyStats.LatencySketch.Percentiles()
+}
+
+// ComputePercentiles() estimates latency percentiles from the latency sketch
+func (akStats *AggregatedKeyStats) ComputePercentiles() {
+	akStats.LatencyPercentiles = akStats.LatencySketch.Percentiles()
+}
+
+// safeDiv() returns sum / count, or 0 if count is 0
+func safeDiv(sum float64, count int) float64 {
+	if count == 0 {
+		return 0
+	}
+	return sum / float64(count)
 }
 
 func importCounts(source map[string]int, dest map[string]int) {
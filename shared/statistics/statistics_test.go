@@ -0,0 +1,111 @@
+package statistics
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBucketStart(t *testing.T) {
+	// 23:30 in UTC-5 is 04:30 the next day in UTC
+	t0 := time.Date(2025, 3, 24, 23, 30, 45, 500, time.FixedZone("UTC-5", -5*60*60))
+	tests := []struct {
+		granularity string
+		want        time.Time
+		length      time.Duration
+	}{
+		{GranularityMinute, time.Date(2025, 3, 25, 4, 30, 0, 0, time.UTC), time.Minute},
+		{GranularityHour, time.Date(2025, 3, 25, 4, 0, 0, 0, time.UTC), time.Hour},
+		{GranularityDay, time.Date(2025, 3, 25, 0, 0, 0, 0, time.UTC), 24 * time.Hour},
+	}
+	for _, test := range tests {
+		start, err := BucketStart(t0, test.granularity)
+		if err != nil || !start.Equal(test.want) || start.Location() != time.UTC {
+			t.Errorf("%s: BucketStart() = %v, %v, want %v", test.granularity, start, err, test.want)
+		}
+		length, err := BucketLength(test.granularity)
+		if err != nil || length != test.length {
+			t.Errorf("%s: BucketLength() = %v, %v, want %v", test.granularity, length, err, test.length)
+		}
+		bucket, err := NewKeyStatsBucket("keystem", test.granularity, t0)
+		if err != nil || !bucket.Start.Equal(test.want) || bucket.UsedKeystem != "keystem" || bucket.StatusCodes == nil {
+			t.Errorf("%s: NewKeyStatsBucket() = %+v, %v", test.granularity, bucket, err)
+		}
+	}
+	if _, err := BucketStart(t0, "week"); err == nil {
+		t.Error("BucketStart() accepted an unknown granularity")
+	}
+	if _, err := BucketLength("week"); err == nil {
+		t.Error("BucketLength() accepted an unknown granularity")
+	}
+	if _, err := NewKeyStatsBucket("keystem", "week", t0); err == nil {
+		t.Error("NewKeyStatsBucket() accepted an unknown granularity")
+	}
+}
+
+func testStats(latency float64, timeStamp string) *Stats {
+	stats := NewStats()
+	stats.TotalItems = 4
+	stats.VolumeUtilization = 0.5
+	stats.BoxTypes["box"] = 1
+	stats.StatusCode = "200"
+	stats.Latency = latency
+	stats.TimeStamp = timeStamp
+	return stats
+}
+
+// Merging the buckets of a period gives the stats of aggregating its requests at once
+func TestAggregateKeyStats(t *testing.T) {
+	first, second := NewKeyStats("keystem"), NewKeyStats("keystem")
+	whole := NewKeyStats("keystem")
+	failed := testStats(0, "2025-03-25T10:01:20Z")
+	failed.StatusCode, failed.RequestError, failed.ErrorClass = "", true, ErrorClassTimeout
+	requests := []struct {
+		bucket *KeyStats
+		stats  *Stats
+	}{
+		{first, testStats(100, "2025-03-25T10:00:10Z")},
+		{first, testStats(300, "2025-03-25T10:00:20Z")},
+		{second, testStats(200, "2025-03-25T10:01:10Z")},
+		{second, failed},
+	}
+	for _, request := range requests {
+		request.bucket.AggregateStats(request.stats)
+		whole.AggregateStats(request.stats)
+	}
+
+	merged := NewKeyStats("keystem")
+	merged.AggregateKeyStats(first)
+	merged.AggregateKeyStats(second)
+	if merged.TotalRequests != 4 || merged.TotalItems != 16 || merged.StatusCodes["200"] != 3 || merged.BoxTypes["box"] != 4 {
+		t.Errorf("merged %d requests of %d items, status codes %v and box types %v", merged.TotalRequests, merged.TotalItems,
+			merged.StatusCodes, merged.BoxTypes)
+	}
+	if merged.RequestErrorCount != 1 || merged.ErrorClasses[ErrorClassTimeout] != 1 || merged.ErrorRate != 0.25 {
+		t.Errorf("merged %d request errors, classes %v, rate %f", merged.RequestErrorCount, merged.ErrorClasses, merged.ErrorRate)
+	}
+	if merged.HighestLatency != whole.HighestLatency || merged.HighestLatency.Latency != 300 {
+		t.Errorf("merged highest latency %+v, want %+v", merged.HighestLatency, whole.HighestLatency)
+	}
+	if merged.AvgLatency != whole.AvgLatency || merged.AvgItemsPerPack != whole.AvgItemsPerPack ||
+		merged.AvgVolumeUtilization != whole.AvgVolumeUtilization {
+		t.Errorf("merged averages %f, %f, %f, want %f, %f, %f", merged.AvgLatency, merged.AvgItemsPerPack, merged.AvgVolumeUtilization,
+			whole.AvgLatency, whole.AvgItemsPerPack, whole.AvgVolumeUtilization)
+	}
+	merged.ComputePercentiles()
+	whole.ComputePercentiles()
+	if merged.LatencyPercentiles != whole.LatencyPercentiles {
+		t.Errorf("merged percentiles %+v, want %+v", merged.LatencyPercentiles, whole.LatencyPercentiles)
+	}
+
+	// Across keystems, the highest latencies are attributed to their keystem
+	other := NewKeyStats("other")
+	other.AggregateStats(testStats(400, "2025-03-25T10:02:00Z"))
+	akStats := NewAggregatedKeyStats()
+	akStats.AggregateKeyStats(whole)
+	akStats.AggregateKeyStats(other)
+	if akStats.TotalRequests != 5 || akStats.MaxLatency.Latency != 400 || akStats.MaxLatency.UsedKeystem != "other" ||
+		akStats.HighestAvgLatency.UsedKeystem != "other" {
+		t.Errorf("aggregated %d requests, max latency %+v, highest average %+v", akStats.TotalRequests, akStats.MaxLatency,
+			akStats.HighestAvgLatency)
+	}
+}